@@ -0,0 +1,178 @@
+package kobopatch
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// FirmwareInfo is the metadata detected from the input firmware.
+type FirmwareInfo struct {
+	Versions  []string // the versions referenced by nickel, the primary one first, then the most common (or from the filename if not found)
+	Platforms []string // the platforms which have upgrade files in the firmware zip (e.g. mx6sll-ntx)
+}
+
+var (
+	fwVersionRe        = regexp.MustCompile(`(?:^|[^0-9.])([1-9]\.[0-9]{1,2}\.[0-9]{4,5})(?:[^0-9.]|$)`)
+	fwPrimaryVersionRe = regexp.MustCompile(`Kobo eReader ([1-9]\.[0-9]{1,2}\.[0-9]{4,5})(?:[^0-9.]|$)`)
+	fwVersionFileRe    = regexp.MustCompile(`^kobo-update-([1-9]\.[0-9]{1,2}\.[0-9]{4,5})\.zip$`)
+)
+
+// fwVersionFiles are the firmware entries which are scanned for the version.
+var fwVersionFiles = []string{"nickel", "libnickel.so.1.0.0"}
+
+// firmwareScan collects the FirmwareInfo while the input firmware is read. It
+// is reset by openIn.
+type firmwareScan struct {
+	zip       bool // whether the input is a firmware zip (the platforms are only known for one)
+	platforms []string
+	count     map[string]int
+	primary   string // from the "Kobo eReader" string, if found
+	checked   bool
+}
+
+// addPlatforms collects the platforms from the names of the files in the
+// firmware zip.
+func (s *firmwareScan) addPlatforms(files []*zip.File) {
+	seen := map[string]bool{}
+	for _, f := range files {
+		if p := strings.Split(strings.TrimPrefix(f.Name, "./"), "/"); len(p) >= 3 && p[0] == "upgrade" && p[1] != "" && !seen[p[1]] {
+			seen[p[1]] = true
+			s.platforms = append(s.platforms, p[1])
+		}
+	}
+	sort.Strings(s.platforms)
+}
+
+// readVersionFile reads an entry from the input firmware and collects the
+// versions referenced by it if it is one of fwVersionFiles, then checks the
+// firmware if the primary version was found. If it isn't, nothing is read and
+// nil is returned.
+func (k *KoboPatch) readVersionFile(h *tar.Header, r io.Reader) ([]byte, error) {
+	var match bool
+	for _, fn := range fwVersionFiles {
+		match = match || path.Base(h.Name) == fn
+	}
+	if !match || h.Typeflag != tar.TypeReg {
+		return nil, nil
+	}
+
+	k.d("    looking for versions in %s", h.Name)
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		k.d("--> could not read %s: %v", h.Name, err)
+		return nil, wrap(err, "could not read '%s' from input firmware", h.Name)
+	}
+	for _, m := range fwVersionRe.FindAllSubmatch(buf, -1) {
+		k.fw.count[string(m[1])]++
+	}
+	if m := fwPrimaryVersionRe.FindSubmatch(buf); m != nil && k.fw.primary == "" {
+		k.d("        --> primary version %s", m[1])
+		k.fw.primary = string(m[1])
+	}
+	if k.fw.primary != "" {
+		if err := k.checkFirmwareOnce(); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// checkFirmwareOnce calls CheckFirmware if it hasn't been done since the input
+// firmware was opened.
+func (k *KoboPatch) checkFirmwareOnce() error {
+	if k.fw.checked {
+		return nil
+	}
+	if _, err := k.CheckFirmware(); err != nil {
+		return wrap(err, "could not check firmware")
+	}
+	return nil
+}
+
+// firmwareInfo returns the FirmwareInfo collected while reading the input
+// firmware.
+func (k *KoboPatch) firmwareInfo() *FirmwareInfo {
+	fi := &FirmwareInfo{Versions: []string{}, Platforms: append([]string{}, k.fw.platforms...)}
+	for v := range k.fw.count {
+		fi.Versions = append(fi.Versions, v)
+	}
+	sort.Slice(fi.Versions, func(i, j int) bool {
+		if a, b := fi.Versions[i] == k.fw.primary, fi.Versions[j] == k.fw.primary; a != b {
+			return a
+		}
+		if k.fw.count[fi.Versions[i]] != k.fw.count[fi.Versions[j]] {
+			return k.fw.count[fi.Versions[i]] > k.fw.count[fi.Versions[j]]
+		}
+		return fi.Versions[i] < fi.Versions[j]
+	})
+
+	if len(fi.Versions) == 0 {
+		k.d("    no versions found, looking at the filename")
+		if m := fwVersionFileRe.FindStringSubmatch(filepath.Base(k.Config.In)); m != nil {
+			fi.Versions = append(fi.Versions, m[1])
+		}
+	}
+	return fi
+}
+
+// CheckFirmware checks the input firmware against the version and devices in
+// the config. It is done by ApplyPatches and RunPatchTests while they read the
+// input firmware, so it can only be called afterwards. The version must match
+// the primary one (the one in the "Kobo eReader" string, or the most common one
+// if not found). If the version could not be detected, a warning is displayed
+// instead.
+func (k *KoboPatch) CheckFirmware() (*FirmwareInfo, error) {
+	k.d("\n\nKoboPatch::CheckFirmware")
+	if k.fw == nil {
+		return nil, errors.New("the input firmware has not been read")
+	}
+	k.fw.checked = true
+	k.l("\nChecking firmware version")
+
+	fi := k.firmwareInfo()
+	k.dp("  | ", "%s", jm(fi))
+
+	switch {
+	case len(fi.Versions) == 0:
+		k.l("  Warning: could not detect the firmware version, so it could not be checked against %s", k.Config.Version)
+	case fi.Versions[0] != k.Config.Version:
+		err := fmt.Errorf("firmware version mismatch: the config is for %s, but the firmware is %s", k.Config.Version, fi.Versions[0])
+		k.d("--> %v", err)
+		return fi, err
+	default:
+		k.l("  Firmware version %s", k.Config.Version)
+	}
+
+	if len(k.Config.Devices) != 0 && !k.fw.zip {
+		k.l("  Warning: the input firmware is not a firmware zip, so the devices could not be checked against %s", strings.Join(k.Config.Devices, ", "))
+	} else if len(k.Config.Devices) != 0 {
+		if len(fi.Platforms) == 0 {
+			err := fmt.Errorf("could not detect the devices supported by the firmware (expected one of %s); remove devices from the config to skip this check", strings.Join(k.Config.Devices, ", "))
+			k.d("--> %v", err)
+			return fi, err
+		}
+		var ok bool
+		for _, d := range k.Config.Devices {
+			for _, p := range fi.Platforms {
+				ok = ok || strings.EqualFold(d, p)
+			}
+		}
+		if !ok {
+			err := fmt.Errorf("firmware device mismatch: the config is for %s, but the firmware is for %s", strings.Join(k.Config.Devices, ", "), strings.Join(fi.Platforms, ", "))
+			k.d("--> %v", err)
+			return fi, err
+		}
+		k.l("  Firmware platforms %s", strings.Join(fi.Platforms, ", "))
+	}
+
+	return fi, nil
+}
@@ -0,0 +1,265 @@
+package kobopatch
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/xi2/xz"
+)
+
+// openIn opens the input firmware as a tar reader. The input can be a firmware
+// zip (with KoboRoot.tgz anywhere inside it), a KoboRoot.tgz, a testdata
+// tarball (.tar.xz), a plain tar, or an extracted firmware directory. The type
+// is detected from the contents rather than the filename.
+func (k *KoboPatch) openIn() (*tar.Reader, func(), error) {
+	k.d("    KoboPatch::openIn")
+	closeReaders := func() {}
+	k.fw = &firmwareScan{platforms: []string{}, count: map[string]int{}}
+
+	fsys := k.inputs()
+	fi, err := fs.Stat(fsys, k.Config.In)
+	if err != nil {
+		k.d("        --> %v", err)
+		return nil, closeReaders, wrap(err, "could not open firmware")
+	}
+
+	if fi.IsDir() {
+		k.l("Reading input firmware directory")
+		k.d("        Walking firmware directory '%s'", k.Config.In)
+		var mtime time.Time
+		if k.Config.Reproducible {
+			mtime = k.modTime()
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(tarDir(pw, fsys, k.Config.In, mtime))
+		}()
+		closeReaders = func() { pr.Close() }
+		k.d("        Creating tar reader")
+		return tar.NewReader(k.readProgress(pr, 0)), closeReaders, nil
+	}
+
+	f, err := fsys.Open(k.Config.In)
+	if err != nil {
+		k.d("        --> %v", err)
+		return nil, closeReaders, wrap(err, "could not open firmware")
+	}
+
+	rf, err := asReaderAtSeeker(f)
+	if err != nil {
+		k.d("        --> %v", err)
+		f.Close()
+		return nil, closeReaders, wrap(err, "could not read firmware")
+	}
+
+	k.d("        Detecting firmware type")
+	magic := make([]byte, 262)
+	n, err := io.ReadFull(rf, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		k.d("        --> %v", err)
+		f.Close()
+		return nil, closeReaders, wrap(err, "could not read firmware")
+	}
+	magic = magic[:n]
+	if _, err := rf.Seek(0, io.SeekStart); err != nil {
+		k.d("        --> %v", err)
+		f.Close()
+		return nil, closeReaders, wrap(err, "could not read firmware")
+	}
+
+	var tbr io.Reader
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		k.l("Reading input firmware zip")
+		k.d("        Opening firmware zip '%s'", k.Config.In)
+
+		zr, err := zip.NewReader(rf, fi.Size())
+		if err != nil {
+			k.d("        --> %v", err)
+			f.Close()
+			return nil, closeReaders, wrap(err, "could not open firmware zip")
+		}
+		k.fw.zip = true
+		k.fw.addPlatforms(zr.File)
+
+		k.d("        Looking for KoboRoot.tgz in zip")
+		var kf *zip.File
+		for _, zf := range zr.File {
+			k.d("        --> found %s", zf.Name)
+			if path.Base(zf.Name) == "KoboRoot.tgz" && (kf == nil || zf.Name == "KoboRoot.tgz") {
+				kf = zf
+			}
+		}
+		if kf == nil {
+			k.d("        --> could not find KoboRoot.tgz")
+			f.Close()
+			return nil, closeReaders, errors.New("could not find KoboRoot.tgz")
+		}
+
+		k.d("        -->    opening %s", kf.Name)
+		kr, err := kf.Open()
+		if err != nil {
+			k.d("        -->    --> %v", err)
+			f.Close()
+			return nil, closeReaders, wrap(err, "could not open KoboRoot.tgz in firmware zip")
+		}
+
+		k.d("        Opening gzip reader")
+		gzr, err := gzip.NewReader(k.readProgress(kr, int64(kf.UncompressedSize64)))
+		if err != nil {
+			k.d("        --> %v", err)
+			kr.Close()
+			f.Close()
+			return nil, closeReaders, wrap(err, "could not decompress KoboRoot.tgz")
+		}
+		tbr = gzr
+		closeReaders = func() {
+			gzr.Close()
+			kr.Close()
+			f.Close()
+		}
+	case bytes.HasPrefix(magic, []byte{0x1F, 0x8B}):
+		k.l("Reading input firmware KoboRoot.tgz")
+		k.d("        Opening gzip reader for '%s'", k.Config.In)
+
+		gzr, err := gzip.NewReader(k.readProgress(rf, fi.Size()))
+		if err != nil {
+			k.d("        --> %v", err)
+			f.Close()
+			return nil, closeReaders, wrap(err, "could not decompress KoboRoot.tgz")
+		}
+		tbr = gzr
+		closeReaders = func() {
+			gzr.Close()
+			f.Close()
+		}
+	case bytes.HasPrefix(magic, []byte("\xFD7zXZ\x00")):
+		k.l("Reading input firmware testdata tarball")
+		k.d("        Opening testdata tarball '%s'", k.Config.In)
+
+		xzr, err := xz.NewReader(k.readProgress(rf, fi.Size()), 0)
+		if err != nil {
+			k.d("        --> %v", err)
+			f.Close()
+			return nil, closeReaders, wrap(err, "could not open firmware tarball as xz")
+		}
+		tbr = xzr
+		closeReaders = func() { f.Close() }
+		k.inPartial = true
+	case len(magic) >= 262 && string(magic[257:262]) == "ustar":
+		k.l("Reading input firmware tarball")
+		k.d("        Opening tarball '%s'", k.Config.In)
+		tbr = k.readProgress(rf, fi.Size())
+		closeReaders = func() { f.Close() }
+	default:
+		k.d("        --> unknown firmware type (magic: %x)", magic)
+		f.Close()
+		return nil, closeReaders, errors.New("could not open firmware: unrecognized format (expected a firmware zip, KoboRoot.tgz, tar, tar.xz, or directory)")
+	}
+
+	k.d("        Creating tar reader")
+	return tar.NewReader(tbr), closeReaders, nil
+}
+
+// readProgress returns a reader which reports the bytes read from r (out of
+// total, if known) for Options.Progress, and stops reading if the context is
+// cancelled.
+func (k *KoboPatch) readProgress(r io.Reader, total int64) io.Reader {
+	k.prog.update(func(p *Progress) {
+		*p = Progress{Total: total}
+	})
+	return &progressReader{k, r}
+}
+
+type progressReader struct {
+	k *KoboPatch
+	r io.Reader
+}
+
+func (c *progressReader) Read(b []byte) (int, error) {
+	if err := c.k.context().Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(b)
+	c.k.prog.update(func(p *Progress) {
+		p.Read += int64(n)
+	})
+	return n, err
+}
+
+// tarDir writes the contents of a directory to w as a tar, with the entries
+// named like the ones in KoboRoot.tgz (./usr/local/Kobo/...). Only regular
+// files, directories, and symlinks are included. Symlinks can only be read if
+// fsys implements readLinkFS. The entries are owned by root like the ones in
+// the firmware, and if mtime isn't zero, it replaces the local mtimes.
+func tarDir(w io.Writer, fsys fs.FS, dir string, mtime time.Time) error {
+	tw := tar.NewWriter(w)
+	if err := walkFS(fsys, dir, func(fn, rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if rel == "." {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		switch {
+		case fi.Mode().IsRegular(), fi.IsDir():
+		case fi.Mode()&fs.ModeSymlink != 0:
+			l, ok := fsys.(readLinkFS)
+			if !ok {
+				return fmt.Errorf("could not read symlink '%s': not supported by %T", fn, fsys)
+			}
+			if link, err = l.ReadLink(fn); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+
+		h, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		h.Name = "./" + rel
+		if fi.IsDir() {
+			h.Name += "/"
+		}
+		h.Uid, h.Gid = 0, 0
+		h.Uname, h.Gname = "root", "root"
+		h.AccessTime, h.ChangeTime = time.Time{}, time.Time{}
+		if !mtime.IsZero() {
+			h.ModTime = mtime
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			f, err := fsys.Open(fn)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
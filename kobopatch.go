@@ -0,0 +1,1642 @@
+package kobopatch
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pgaskin/kobopatch/lrelease"
+	"github.com/pgaskin/kobopatch/patchfile"
+	_ "github.com/pgaskin/kobopatch/patchfile/kobopatch"
+	_ "github.com/pgaskin/kobopatch/patchfile/patch32lsb"
+	"github.com/pgaskin/kobopatch/patchlib"
+
+	"gopkg.in/yaml.v3"
+)
+
+// KoboPatch patches firmware using a config. It should be created with New.
+type KoboPatch struct {
+	Config *Config
+
+	opt                 Options
+	out                 *tgzWriter
+	outTarExpectedSize  int64
+	restore             *tgzWriter // nil if not writing a restore tar.gz
+	restoreExpectedSize int64
+	sums                map[string]string
+	files               map[string]byte   // the types of the paths added by ApplyTranslations and ApplyFiles
+	inEntries           map[string]byte   // the types of the entries in the input firmware
+	inLinks             map[string]string // the targets of the symlinks in the input firmware
+	inPartial           bool              // whether the input firmware is a testdata tarball
+	inSums              map[string]string // the sha256 of the hard link targets in the input firmware
+	fw                  *firmwareScan     // set by openIn
+	plan                *Plan
+	manifest            *Manifest // set by WriteOutput
+	ctx                 context.Context
+	prog                *progress
+
+	Logf   func(format string, a ...interface{}) // displayed to user
+	Errorf func(format string, a ...interface{}) // displayed to user
+	Debugf func(format string, a ...interface{}) // for verbose logging (must be safe for concurrent use)
+}
+
+type Config struct {
+	Version            string
+	Devices            []string // if not empty, the firmware must contain upgrade files for one of these platforms (only checked for a firmware zip)
+	In                 string
+	Out                string
+	Log                string
+	Restore            string // if set, a KoboRoot.tgz with the original versions of the patched files is written here
+	PatchFormat        string `yaml:"patchFormat"` // DEPRECATED: now detected from the contents or extension
+	Patches            map[string]string
+	Overrides          map[string]map[string]bool
+	Profiles           map[string]map[string]map[string]bool // name -> overrides (selected with --profile)
+	Lrelease           string                                // if set, this lrelease is used instead of the built-in one
+	Translations       map[string]string
+	TranslationPatches map[string][]TranslationPatch `yaml:"translationPatches"` // qm file in the firmware -> messages to replace or add
+	Symlinks           map[string]string             // target -> link (targets starting with / or . are used as-is, otherwise they are relative to the root)
+	Hardlinks          map[string]string             // target -> link
+	Files              map[string]fileDests
+	Reproducible       bool       // if true, the output will be byte-identical between runs with the same inputs
+	ModTime            *time.Time `yaml:"mtime"` // the mtime for new or modified files (if reproducible, defaults to SOURCE_DATE_EPOCH or the unix epoch)
+}
+
+// OutputInit starts streaming the output to a temp file next to the output
+// (or to Options.Output).
+func (k *KoboPatch) OutputInit() error {
+	k.d("\n\nKoboPatch::OutputInit")
+	k.d("creating output")
+	out, err := k.createOutput(k.opt.Output, k.Config.Out)
+	if err != nil {
+		k.d("--> %v", err)
+		return wrap(err, "could not create output tar.gz")
+	}
+	k.out = out
+	k.outTarExpectedSize = 0
+
+	k.restore, k.restoreExpectedSize = nil, 0
+	if k.Config.Restore != "" {
+		k.d("creating restore output")
+		restore, err := k.createOutput(k.opt.Restore, k.Config.Restore)
+		if err != nil {
+			k.d("--> %v", err)
+			out.Abort()
+			return wrap(err, "could not create restore tar.gz")
+		}
+		k.restore = restore
+	}
+
+	k.files = map[string]byte{}
+	k.plan = &Plan{}
+	return nil
+}
+
+// createOutput creates a tgzWriter which writes to w, or to a temp file which
+// is moved to dest when it is closed if w is nil.
+func (k *KoboPatch) createOutput(w io.Writer, dest string) (*tgzWriter, error) {
+	if w != nil {
+		k.d("--> streaming to %T", w)
+		return newTGZStream(w), nil
+	}
+	t, err := newTGZWriter(k.outPath(dest))
+	if err != nil {
+		return nil, err
+	}
+	k.d("--> %s", t.f.Name())
+	return t, nil
+}
+
+// PlanInit is like OutputInit, but the output is discarded.
+func (k *KoboPatch) PlanInit() {
+	k.d("\n\nKoboPatch::PlanInit")
+	k.out, _ = newTGZWriter("")
+	k.outTarExpectedSize = 0
+	k.files = map[string]byte{}
+	k.plan = &Plan{}
+}
+
+// OutputAbort removes the partially written output, if any.
+func (k *KoboPatch) OutputAbort() {
+	k.d("\n\nKoboPatch::OutputAbort")
+	k.out.Abort()
+	k.restore.Abort()
+}
+
+func (k *KoboPatch) WriteOutput() error {
+	k.d("\n\nKoboPatch::WriteOutput")
+
+	k.l("\nChecking patched KoboRoot.tgz for consistency")
+	k.d("Finalizing output and checking consistency (expected size %d)", k.outTarExpectedSize)
+	if err := k.out.Close(k.outTarExpectedSize); err != nil {
+		k.d("--> %v", err)
+		if k.restore != nil {
+			k.restore.Abort()
+		}
+		return wrap(err, "could not write output tar.gz")
+	}
+	k.d("Moved output to '%s'", k.Config.Out)
+
+	if k.restore != nil {
+		k.l("\nChecking restore KoboRoot.tgz for consistency")
+		k.d("Finalizing restore output and checking consistency (expected size %d)", k.restoreExpectedSize)
+		if err := k.restore.Close(k.restoreExpectedSize); err != nil {
+			k.d("--> %v", err)
+			return wrap(err, "could not write restore tar.gz")
+		}
+		k.d("Moved restore output to '%s'", k.Config.Restore)
+
+		replaced := []string{}
+		for _, p := range sortedKeys(k.files) {
+			if _, ok := k.inEntries[p]; ok && k.files[p] != tar.TypeDir {
+				replaced = append(replaced, p)
+			}
+		}
+		for _, m := range []map[string]string{k.Config.Symlinks, k.Config.Hardlinks} {
+			for _, p := range m {
+				if _, ok := k.inEntries[cleanEntry(p)]; ok {
+					replaced = append(replaced, cleanEntry(p))
+				}
+			}
+		}
+		if len(replaced) != 0 {
+			sort.Strings(replaced)
+			k.l("  Warning: the restore KoboRoot.tgz only restores patched files, so these replaced firmware files will not be restored:\n    %s", strings.Join(replaced, "\n    "))
+		}
+	}
+
+	k.d("\nsha1 checksums:")
+	for _, f := range sortedKeys(k.sums) {
+		k.d("  %s %s", k.sums[f], f)
+	}
+
+	m, err := k.buildManifest()
+	if err != nil {
+		return wrap(err, "could not generate manifest")
+	}
+	k.manifest = m
+	if k.opt.Output == nil {
+		k.l("\nWriting manifest")
+		if err := k.writeManifest(); err != nil {
+			return wrap(err, "could not write manifest")
+		}
+	}
+
+	return nil
+}
+
+// modTime gets the mtime for new or modified files in the output.
+func (k *KoboPatch) modTime() time.Time {
+	if k.Config.ModTime != nil {
+		return *k.Config.ModTime
+	}
+	if k.Config.Reproducible {
+		if sde := os.Getenv("SOURCE_DATE_EPOCH"); sde != "" {
+			if sec, err := strconv.ParseInt(sde, 10, 64); err == nil {
+				return time.Unix(sec, 0)
+			}
+			k.d("warning: ignoring invalid SOURCE_DATE_EPOCH %#v", sde)
+		}
+		return time.Unix(0, 0)
+	}
+	return time.Now()
+}
+
+func (k *KoboPatch) LoadConfig(r io.Reader) error {
+	k.d("\n\nKoboPatch::LoadConfig")
+
+	k.d("reading config file from %v", reflect.TypeOf(r))
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		k.d("--> %v", err)
+		return wrap(err, "error reading config")
+	}
+
+	k.d("unmarshaling yaml")
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	err = dec.Decode(&k.Config)
+	if err != nil {
+		k.d("--> %v", err)
+		return wrap(err, "error reading kobopatch.yaml")
+	}
+
+	if k.Config.Version == "" || k.Config.In == "" || k.Config.Out == "" || k.Config.Log == "" {
+		err = errors.New("invalid kobopatch.yaml: version, in, out, and log are required")
+		k.d("--> %v", err)
+		return err
+	}
+
+	if _, ok := patchfile.GetFormat(k.Config.PatchFormat); !ok && k.Config.PatchFormat != "" {
+		err = fmt.Errorf("invalid patch format '%s', expected one of %s", k.Config.PatchFormat, strings.Join(patchfile.GetFormats(), ", "))
+		k.d("--> %v", err)
+		return err
+	}
+
+	for _, qm := range sortedKeys(k.Config.TranslationPatches) {
+		for i, tp := range k.Config.TranslationPatches[qm] {
+			if tp.Source == "" || (tp.Translation == "") == (len(tp.Translations) == 0) {
+				err = fmt.Errorf("invalid kobopatch.yaml: translation patch %d for '%s': source and one of translation or translations are required", i+1, qm)
+				k.d("--> %v", err)
+				return err
+			}
+		}
+	}
+
+	k.dp("  | ", "%s", jm(k.Config))
+	return nil
+}
+
+// ApplyOverrides layers the overrides from the selected profiles (in order),
+// then the patches to enable and disable (as FILE:PATCH), on top of the
+// overrides from the config. The patch names are checked when the patch files
+// are loaded.
+func (k *KoboPatch) ApplyOverrides(profiles, enable, disable []string) error {
+	k.d("\n\nKoboPatch::ApplyOverrides")
+
+	overrides := map[string]map[string]bool{}
+	set := func(pfn, name string, enabled bool) error {
+		if _, ok := k.Config.Patches[pfn]; !ok {
+			return fmt.Errorf("patch file '%s' is not in the config", pfn)
+		}
+		if overrides[pfn] == nil {
+			overrides[pfn] = map[string]bool{}
+		}
+		overrides[pfn][name] = enabled
+		return nil
+	}
+
+	for pfn, o := range k.Config.Overrides {
+		overrides[pfn] = map[string]bool{}
+		for name, enabled := range o {
+			overrides[pfn][name] = enabled
+		}
+	}
+
+	for _, p := range profiles {
+		o, ok := k.Config.Profiles[p]
+		if !ok {
+			err := fmt.Errorf("no such profile '%s' (available: %s)", p, strings.Join(sortedKeys(k.Config.Profiles), ", "))
+			k.d("--> %v", err)
+			return err
+		}
+		k.l("Using profile %s", p)
+		k.d("applying profile %s", p)
+		for _, pfn := range sortedKeys(o) {
+			for name, enabled := range o[pfn] {
+				k.d("    %s: %s -> enabled:%t", pfn, name, enabled)
+				if err := set(pfn, name, enabled); err != nil {
+					k.d("--> %v", err)
+					return wrap(err, "invalid profile '%s'", p)
+				}
+			}
+		}
+	}
+
+	for _, x := range []struct {
+		enabled bool
+		flags   []string
+	}{{true, enable}, {false, disable}} {
+		for _, f := range x.flags {
+			i := strings.Index(f, ":")
+			if i <= 0 || i == len(f)-1 {
+				err := fmt.Errorf("invalid patch '%s', expected FILE:PATCH", f)
+				k.d("--> %v", err)
+				return err
+			}
+			pfn, name := f[:i], f[i+1:]
+			k.d("command line: %s: %s -> enabled:%t", pfn, name, x.enabled)
+			if err := set(pfn, name, x.enabled); err != nil {
+				k.d("--> %v", err)
+				return wrap(err, "invalid patch '%s'", f)
+			}
+		}
+	}
+
+	k.Config.Overrides = overrides
+	k.dp("  | ", "%s", jm(overrides))
+	return nil
+}
+
+// patchJob is a firmware entry which is being patched by a worker.
+type patchJob struct {
+	h          *tar.Header
+	buf        []byte
+	orig       []byte // only if writing a restore tar.gz
+	patchfiles []string
+	qm         string // the key in Config.TranslationPatches, if any
+
+	out     bytes.Buffer // output to display to the user once the job is written
+	pl      *PlanTarget
+	err     error
+	started bool
+	done    chan struct{}
+}
+
+// ApplyPatches patches the firmware entries which have patch files. The
+// entries are read sequentially, patched in parallel, and written to the
+// output in the same order as the input. The firmware is checked with
+// CheckFirmware before any of them are patched.
+func (k *KoboPatch) ApplyPatches() error {
+	k.d("\n\nKoboPatch::ApplyPatches")
+
+	k.inEntries, k.inLinks, k.inPartial, k.inSums = map[string]byte{}, map[string]string{}, false, map[string]string{}
+	tr, closeAll, err := k.openIn()
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	// the hard link targets are hashed for the manifest, since they might not
+	// be in the output
+	linkTargets := map[string]bool{}
+	for src, dest := range k.Config.Hardlinks {
+		linkTargets[resolveLink(dest, linkTarget(src))] = true
+	}
+
+	workers := runtime.NumCPU()
+	k.d("    using %d workers", workers)
+
+	var pending []*patchJob
+	defer func() {
+		// if we're returning early, don't leave workers running
+		for _, j := range pending {
+			if j.started {
+				<-j.done
+			}
+		}
+	}()
+
+	// start starts the workers for the pending jobs once the firmware has been
+	// checked (until then, they are queued), so a patch error from a different
+	// firmware version can't be reported instead of the version mismatch.
+	start := func() {
+		if !k.fw.checked {
+			return
+		}
+		for _, j := range pending {
+			if !j.started {
+				k.d("        starting worker for %s", j.h.Name)
+				j.started = true
+				go func(j *patchJob) {
+					defer close(j.done)
+					j.pl, j.buf, j.err = k.patchEntry(j)
+				}(j)
+			}
+		}
+	}
+
+	// writeNext waits for the first pending job and writes it.
+	writeNext := func() error {
+		j := pending[0]
+		pending = pending[1:]
+		return k.writePatched(j)
+	}
+
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			k.d("--> could not read entry from tgz: %v", err)
+			return wrap(err, "could not read input firmware")
+		}
+		k.prog.update(func(p *Progress) {
+			p.Entry, p.Patch = h.Name, ""
+		})
+
+		patchfiles := []string{}
+		for _, n := range sortedKeys(k.Config.Patches) {
+			f := k.Config.Patches[n]
+			if h.Name == "./"+f || h.Name == f || filepath.Base(f) == h.Name {
+				if filepath.Base(f) == h.Name { // from testdata tarball
+					h.Name = "./" + f
+				}
+				patchfiles = append(patchfiles, n)
+			}
+		}
+
+		var qm string
+		for _, f := range sortedKeys(k.Config.TranslationPatches) {
+			if h.Name == "./"+f || h.Name == f || filepath.Base(f) == h.Name {
+				if filepath.Base(f) == h.Name { // from testdata tarball
+					h.Name = "./" + f
+				}
+				qm = f
+			}
+		}
+
+		switch n := cleanEntry(h.Name); h.Typeflag {
+		case tar.TypeSymlink:
+			k.inEntries[n] = h.Typeflag
+			k.inLinks[n] = h.Linkname
+		case tar.TypeLink:
+			k.inEntries[n] = k.inEntries[cleanEntry(h.Linkname)]
+		default:
+			k.inEntries[n] = h.Typeflag
+		}
+
+		buf, err := k.readVersionFile(h, tr)
+		if err != nil {
+			return err
+		}
+		start()
+
+		if n := cleanEntry(h.Name); linkTargets[n] && h.Typeflag == tar.TypeReg {
+			k.d("    hashing hard link target %s", h.Name)
+			if buf == nil {
+				if buf, err = ioutil.ReadAll(tr); err != nil {
+					k.d("    --> could not read contents: %v", err)
+					return wrap(err, "could not read '%s' from input firmware", h.Name)
+				}
+			}
+			k.inSums[n] = fmt.Sprintf("%x", sha256.Sum256(buf))
+		}
+
+		if len(patchfiles) < 1 && qm == "" {
+			continue
+		}
+
+		k.d("    patching entry name:'%s' size:%d mode:'%v' typeflag:'%v' with files: %s (translation patches: %t)", h.Name, h.Size, h.Mode, h.Typeflag, strings.Join(patchfiles, ", "), qm != "")
+
+		if h.Typeflag != tar.TypeReg {
+			k.d("    --> could not patch: not a regular file")
+			return fmt.Errorf("could not patch file '%s': not a regular file", h.Name)
+		}
+
+		for k.fw.checked && len(pending) >= workers {
+			k.d("        waiting for a worker")
+			if err := writeNext(); err != nil {
+				return err
+			}
+		}
+
+		if buf == nil {
+			k.d("        reading entry contents")
+			if buf, err = ioutil.ReadAll(tr); err != nil {
+				k.d("    --> could not patch: could not read contents: %v", err)
+				return wrap(err, "could not patch file '%s': could not read contents", h.Name)
+			}
+		}
+
+		j := &patchJob{h: h, buf: buf, patchfiles: patchfiles, qm: qm, done: make(chan struct{})}
+		if k.restore != nil {
+			j.orig = append([]byte(nil), buf...) // the patcher may modify buf in-place
+		}
+		pending = append(pending, j)
+		start()
+
+		for len(pending) != 0 && isDone(pending[0].done) {
+			if err := writeNext(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := k.checkFirmwareOnce(); err != nil {
+		return err
+	}
+	start()
+
+	for len(pending) != 0 {
+		if err := writeNext(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// patchEntry applies the patch files to a firmware entry and returns the
+// patched contents. It is safe to call concurrently. Output for the user is
+// written to j.out, and debugging messages are prefixed with the entry name.
+func (k *KoboPatch) patchEntry(j *patchJob) (*PlanTarget, []byte, error) {
+	w := &KoboPatch{
+		Config: k.Config,
+		opt:    k.opt,
+		ctx:    k.ctx,
+		Logf: func(format string, a ...interface{}) {
+			fmt.Fprintf(&j.out, format+"\n", a...)
+		},
+		Debugf: func(format string, a ...interface{}) {
+			k.dp(filepath.Base(j.h.Name)+" | ", format, a...)
+		},
+	}
+
+	w.l("\nPatching %s", j.h.Name)
+
+	pt := patchlib.NewPatcher(j.buf)
+	pt.SetContext(k.context())
+	obs := patchfile.Observers{patchfile.Printer(&j.out), k.observer(j.h.Name)}
+	pl := &PlanTarget{Name: j.h.Name, Size: j.h.Size}
+
+	for _, pfn := range j.patchfiles {
+		w.d("        loading patch file '%s'", pfn)
+		ps, format, err := w.readPatchFile(pfn)
+		if err != nil {
+			w.d("        --> %v", err)
+			return nil, nil, wrap(err, "could not load patch file '%s'", pfn)
+		}
+
+		if o := w.Config.Overrides[pfn]; len(o) >= 1 {
+			w.l("  Applying overrides")
+			w.d("        applying overrides")
+			for _, on := range sortedKeys(o) {
+				os := o[on]
+				if os {
+					w.l("    ENABLE  `%s`", on)
+				} else {
+					w.l("    DISABLE `%s`", on)
+				}
+				w.d("            override %s -> enabled:%t", on, os)
+				if err := ps.SetEnabled(on, os); err != nil {
+					w.d("            --> %v", err)
+					return nil, nil, wrap(err, "could not override enabled for patch '%s'", on)
+				}
+			}
+		}
+
+		w.d("        validating patch file")
+		if err := ps.Validate(); err != nil {
+			w.d("        --> %v", err)
+			return nil, nil, wrap(patchfile.SetErrorFile(err, pfn), "invalid patch file '%s'", pfn)
+		}
+
+		enabled, err := enabledPatches(ps)
+		if err != nil {
+			w.d("        --> %v", err)
+			return nil, nil, wrap(err, "could not list enabled patches in '%s'", pfn)
+		}
+		pl.PatchFiles = append(pl.PatchFiles, &PlanPatchFile{
+			Filename: pfn,
+			Format:   format,
+			Enabled:  enabled,
+		})
+
+		w.d("        applying patch file")
+		if err := ps.ApplyTo(pt, obs); err != nil {
+			w.d("        --> %v", err)
+			return nil, nil, wrap(patchfile.SetErrorFile(err, pfn), "error applying patch file '%s'", pfn)
+		}
+	}
+
+	buf := pt.GetBytes()
+	if j.qm != "" {
+		var err error
+		if buf, err = w.patchTranslations(buf, w.Config.TranslationPatches[j.qm], pl); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return pl, buf, nil
+}
+
+// observer returns an Observer which passes the events for the patches applied
+// to a firmware entry to Options.Observer, and reports them for
+// Options.Progress.
+func (k *KoboPatch) observer(entry string) patchfile.Observer {
+	return patchfile.ObserverFunc(func(e patchfile.Event) {
+		if e.Type == patchfile.EventPatchStart {
+			k.prog.update(func(p *Progress) {
+				p.Entry, p.Patch = entry, e.Patch
+			})
+		}
+		if k.opt.Observer != nil {
+			k.opt.Observer(entry, e)
+		}
+	})
+}
+
+// patchTranslations replaces or adds messages in a qm file.
+func (k *KoboPatch) patchTranslations(buf []byte, tps []TranslationPatch, pl *PlanTarget) ([]byte, error) {
+	k.l("  Patching translations")
+	k.d("        reading qm file")
+	q, err := patchlib.ReadQM(buf)
+	if err != nil {
+		k.d("        --> %v", err)
+		return nil, wrap(err, "could not read qm file")
+	}
+	k.d("        found %d messages (language %#v)", len(q.Messages), q.Language)
+
+	for _, tp := range tps {
+		tr := tp.Translations
+		if len(tr) == 0 {
+			tr = []string{tp.Translation}
+		}
+		k.d("        setting `%s` `%s` (comment %#v) to %#v", tp.Context, tp.Source, tp.Comment, tr)
+		if m := q.Find(tp.Context, tp.Source, tp.Comment); m != nil && len(m.Translations) != len(tr) {
+			err := fmt.Errorf("message has %d translations (numerus forms), but %d were specified", len(m.Translations), len(tr))
+			k.d("        --> %v", err)
+			return nil, wrap(err, "could not replace translation of `%s` in context `%s`", tp.Source, tp.Context)
+		}
+		if q.Set(tp.Context, tp.Source, tp.Comment, tr...) {
+			k.l("    REPLACE  `%s` `%s`", tp.Context, tp.Source)
+		} else {
+			k.l("    ADD      `%s` `%s`", tp.Context, tp.Source)
+		}
+		pl.Translations = append(pl.Translations, &PlanTranslation{Context: tp.Context, Source: tp.Source, Comment: tp.Comment})
+	}
+
+	k.d("        writing qm file")
+	return q.Bytes(), nil
+}
+
+// writePatched waits for a job to finish, displays its output, and writes the
+// patched entry to the output.
+func (k *KoboPatch) writePatched(j *patchJob) error {
+	<-j.done
+	k.d("    writing patched entry name:'%s'", j.h.Name)
+
+	if s := strings.TrimSuffix(j.out.String(), "\n"); s != "" {
+		k.l("%s", s)
+	}
+	if j.err != nil {
+		return j.err
+	}
+
+	h, fbuf := j.h, j.buf
+	k.plan.Targets = append(k.plan.Targets, j.pl)
+	if j.qm != "" {
+		k.outTarExpectedSize += int64(len(fbuf)) // translation patches change the size
+	} else {
+		k.outTarExpectedSize += h.Size
+	}
+	k.d("        patched file - orig:%d new:%d", h.Size, len(fbuf))
+
+	k.d("        copying new header to output tar - size:%d mode:'%v'", len(fbuf), h.Mode)
+	// Preserve attributes (VERY IMPORTANT)
+	err := k.out.WriteHeader(&tar.Header{
+		Typeflag:   h.Typeflag,
+		Name:       h.Name,
+		Mode:       h.Mode,
+		Uid:        h.Uid,
+		Gid:        h.Gid,
+		ModTime:    k.modTime(),
+		Uname:      h.Uname,
+		Gname:      h.Gname,
+		PAXRecords: h.PAXRecords,
+		Size:       int64(len(fbuf)),
+		Format:     h.Format,
+	})
+	if err != nil {
+		k.d("        --> %v", err)
+		return wrap(err, "could not write new file header to patched KoboRoot.tgz")
+	}
+
+	k.d("        writing patched file to tar writer")
+	if i, err := k.out.Write(fbuf); err != nil {
+		k.d("        --> %v", err)
+		return wrap(err, "error writing new file to patched KoboRoot.tgz")
+	} else if i != len(fbuf) {
+		k.d("        --> error writing new file to patched KoboRoot.tgz")
+		return errors.New("error writing new file to patched KoboRoot.tgz")
+	}
+
+	k.sums[h.Name] = fmt.Sprintf("%x", sha1.Sum(fbuf))
+
+	if k.restore != nil {
+		k.d("        copying original header and file to restore tar")
+		if err := k.restore.WriteHeader(h); err != nil {
+			k.d("        --> %v", err)
+			return wrap(err, "could not write original file header to restore KoboRoot.tgz")
+		}
+		if _, err := k.restore.Write(j.orig); err != nil {
+			k.d("        --> %v", err)
+			return wrap(err, "error writing original file to restore KoboRoot.tgz")
+		}
+		k.restoreExpectedSize += h.Size
+	}
+	return nil
+}
+
+func (k *KoboPatch) ApplyTranslations() error {
+	k.d("\n\nKoboPatch::ApplyTranslations")
+	if len(k.Config.Translations) >= 1 {
+		k.l("\nProcessing translations")
+		lr := k.Config.Lrelease
+		if lr != "" {
+			k.d("using external lrelease '%s' from config", lr)
+			var err error
+			if lr, err = exec.LookPath(lr); err != nil {
+				k.d("--> %v", err)
+				return wrap(err, "could not find lrelease (part of QT Linguist)")
+			}
+		}
+
+		for _, ts := range sortedKeys(k.Config.Translations) {
+			qm := k.Config.Translations[ts]
+			k.l("  LRELEASE  %s", ts)
+			k.d("    processing '%s' -> '%s'", ts, qm)
+			if !strings.HasPrefix(qm, "usr/local/Kobo/translations/") {
+				err := errors.New("output for translation must start with usr/local/Kobo/translations/")
+				k.d("    --> %v", err)
+				return wrap(err, "could not process translation")
+			}
+
+			var buf []byte
+			var err error
+			if lr != "" {
+				buf, err = k.lreleaseExternal(lr, ts)
+			} else {
+				buf, err = k.lrelease(ts)
+			}
+			if err != nil {
+				return err
+			}
+
+			k.d("        writing header")
+			err = k.out.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     "./" + qm,
+				Mode:     0777,
+				Uid:      0,
+				Gid:      0,
+				ModTime:  k.modTime(),
+				Size:     int64(len(buf)),
+			})
+			if err != nil {
+				k.d("    --> %v", err)
+				return wrap(err, "could not write translation file to KoboRoot.tgz")
+			}
+
+			k.d("        writing file")
+			if i, err := k.out.Write(buf); err != nil {
+				k.d("    --> %v", err)
+				return wrap(err, "error writing translation file to KoboRoot.tgz")
+			} else if i != len(buf) {
+				k.d("    --> error writing translation file to KoboRoot.tgz")
+				return errors.New("error writing translation file to KoboRoot.tgz")
+			}
+			k.outTarExpectedSize += int64(len(buf))
+			k.files[cleanEntry(qm)] = tar.TypeReg
+			k.plan.Translations = append(k.plan.Translations, &PlanFile{Source: ts, Dest: qm, Size: int64(len(buf))})
+		}
+	}
+	return nil
+}
+
+// lrelease compiles a translation using the built-in lrelease.
+func (k *KoboPatch) lrelease(ts string) ([]byte, error) {
+	k.d("        parsing '%s'", ts)
+	f, err := k.inputs().Open(ts)
+	if err != nil {
+		k.d("        --> %v", err)
+		return nil, wrap(err, "could not open translation")
+	}
+	defer f.Close()
+
+	t, err := lrelease.ParseTS(f)
+	if err != nil {
+		k.d("        --> %v", err)
+		return nil, wrap(err, "could not parse translation '%s'", ts)
+	}
+	k.d("        found %d messages (language %#v)", len(t.Messages), t.Language)
+
+	k.d("        generating qm")
+	var buf bytes.Buffer
+	if err := lrelease.Release(&buf, t, lrelease.Options{}); err != nil {
+		k.d("        --> %v", err)
+		return nil, wrap(err, "could not generate qm for '%s'", ts)
+	}
+	return buf.Bytes(), nil
+}
+
+// lreleaseExternal compiles a translation using an external lrelease.
+func (k *KoboPatch) lreleaseExternal(lr, ts string) ([]byte, error) {
+	k.d("        creating temp dir for lrelease")
+	td, err := ioutil.TempDir(os.TempDir(), "lrelease-qm")
+	if err != nil {
+		k.d("        --> %v", err)
+		return nil, wrap(err, "could not make temp dir for lrelease")
+	}
+	defer os.RemoveAll(td)
+
+	// the translation is copied since it might not be on the OS filesystem
+	k.d("        copying translation '%s'", ts)
+	buf, err := fs.ReadFile(k.inputs(), ts)
+	if err != nil {
+		k.d("        --> %v", err)
+		return nil, wrap(err, "could not open translation")
+	}
+	sf, tf := filepath.Join(td, "in.ts"), filepath.Join(td, "out.qm")
+	if err := ioutil.WriteFile(sf, buf, 0644); err != nil {
+		k.d("        --> %v", err)
+		return nil, wrap(err, "could not copy translation for lrelease")
+	}
+
+	cmd := exec.CommandContext(k.context(), lr, sf, "-qm", tf)
+	var outbuf, errbuf bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &outbuf, &errbuf
+
+	err = cmd.Run()
+	k.dp("          | ", "lrelease stdout: %s", outbuf.String())
+	k.dp("          | ", "lrelease stderr: %s", errbuf.String())
+	if err != nil {
+		k.e(errbuf.String())
+		k.d("        --> %v", err)
+		return nil, wrap(err, "error running lrelease")
+	}
+
+	k.d("        reading generated qm '%s'", ts)
+	buf, err = ioutil.ReadFile(tf)
+	if err != nil {
+		k.d("        --> %v", err)
+		return nil, wrap(err, "could not read generated qm file")
+	}
+	return buf, nil
+}
+
+func (k *KoboPatch) ApplyFiles() error {
+	k.d("\n\nKoboPatch::ApplyFiles")
+	if len(k.Config.Files) >= 1 {
+		k.l("\nAdding additional files")
+		for _, src := range sortedKeys(k.Config.Files) {
+			for _, fd := range k.Config.Files[src] {
+				dest := strings.TrimSuffix(fd.Dest, "/")
+				k.l("  ADD  %-35s  TO  %s", src, dest)
+				k.d("    %s -> %s", src, dest)
+				if strings.HasPrefix(dest, "/") {
+					k.d("    --> destination must not start with a slash")
+					return errors.New("could not add file: destination must not start with a slash")
+				}
+				if dest == "" {
+					k.d("    --> destination must not be empty")
+					return errors.New("could not add file: destination must not be empty")
+				}
+
+				if !strings.ContainsAny(src, "*?[") {
+					if err := k.addFiles(src, dest, fd); err != nil {
+						return err
+					}
+					continue
+				}
+
+				k.d("        expanding glob")
+				matches, err := fs.Glob(k.inputs(), src)
+				if err != nil {
+					k.d("    --> %v", err)
+					return wrap(err, "could not expand additional files '%s'", src)
+				} else if len(matches) == 0 {
+					k.d("    --> no matches")
+					return fmt.Errorf("could not expand additional files '%s': no matches", src)
+				}
+				for _, fn := range matches {
+					if err := k.addFiles(fn, path.Join(dest, filepath.Base(fn)), fd); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addFiles adds a file, or a directory and its contents, to the output.
+func (k *KoboPatch) addFiles(src, dest string, fd FileDest) error {
+	if fi, err := fs.Stat(k.inputs(), src); err != nil {
+		k.d("    --> %v", err)
+		return wrap(err, "could not read additional file '%s'", src)
+	} else if !fi.IsDir() {
+		return k.addFile(src, dest, fd)
+	}
+
+	k.d("        adding directory")
+	return walkFS(k.inputs(), src, func(fn, rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			k.d("    --> %v", err)
+			return wrap(err, "could not read additional file '%s'", fn)
+		}
+		if d.IsDir() {
+			return k.addDir(fn, path.Join(dest, rel), fd)
+		}
+		return k.addFile(fn, path.Join(dest, rel), fd)
+	})
+}
+
+// addDir adds a directory entry to the output. It is only used for directories
+// in a source tree, not for the destination of a glob.
+func (k *KoboPatch) addDir(src, dest string, fd FileDest) error {
+	k.d("        writing directory header for %s", dest)
+	mtime := k.modTime()
+	if fd.ModTime != nil {
+		mtime = *fd.ModTime
+	}
+	err := k.out.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     "./" + dest + "/",
+		Mode:     fd.DirMode.Or(0755),
+		Uid:      fd.Uid,
+		Gid:      fd.Gid,
+		ModTime:  mtime,
+	})
+	if err != nil {
+		k.d("    --> %v", err)
+		return wrap(err, "could not write additional directory to KoboRoot.tgz")
+	}
+
+	k.files[cleanEntry(dest)] = tar.TypeDir
+	k.plan.Files = append(k.plan.Files, &PlanFile{Source: src, Dest: dest + "/"})
+	return nil
+}
+
+// addFile adds a regular file to the output.
+func (k *KoboPatch) addFile(src, dest string, fd FileDest) error {
+	k.d("        opening file %s", src)
+	f, err := k.inputs().Open(src)
+	if err != nil {
+		k.d("    --> %v", err)
+		return wrap(err, "could not read additional file '%s'", src)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		k.d("    --> %v", err)
+		return wrap(err, "could not read additional file '%s'", src)
+	} else if !fi.Mode().IsRegular() {
+		k.d("    --> not a regular file")
+		return fmt.Errorf("could not read additional file '%s': not a regular file", src)
+	}
+
+	k.d("        writing header for %s", dest)
+	mtime := k.modTime()
+	if fd.ModTime != nil {
+		mtime = *fd.ModTime
+	}
+	err = k.out.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "./" + dest,
+		Mode:     fd.Mode.Or(0777),
+		Uid:      fd.Uid,
+		Gid:      fd.Gid,
+		ModTime:  mtime,
+		Size:     fi.Size(),
+	})
+	if err != nil {
+		k.d("    --> %v", err)
+		return wrap(err, "could not write additional file to KoboRoot.tgz")
+	}
+
+	k.d("        writing file")
+	if n, err := io.Copy(k.out, f); err != nil {
+		k.d("    --> %v", err)
+		return wrap(err, "error writing additional file to KoboRoot.tgz")
+	} else if n != fi.Size() {
+		k.d("    --> file size changed while reading")
+		return fmt.Errorf("error writing additional file to KoboRoot.tgz: size of '%s' changed while reading", src)
+	}
+
+	k.outTarExpectedSize += fi.Size()
+	k.files[cleanEntry(dest)] = tar.TypeReg
+	k.plan.Files = append(k.plan.Files, &PlanFile{Source: src, Dest: dest, Size: fi.Size()})
+	return nil
+}
+
+func (k *KoboPatch) ApplySymlinks() error {
+	k.d("\n\nKoboPatch::ApplySymlinks")
+
+	if len(k.Config.Symlinks) < 1 && len(k.Config.Hardlinks) < 1 {
+		return nil
+	}
+
+	g := newLinkGraph(k.inEntries, k.files, k.inLinks)
+
+	// check reports a problem with a link, or only warns about it if the input
+	// firmware is a testdata tarball (since it doesn't have every file).
+	check := func(err error) error {
+		if k.inPartial {
+			k.d("    --> warning: %v", err)
+			k.l("    Warning: %v (input firmware is incomplete)", err)
+			return nil
+		}
+		k.d("    --> %v", err)
+		return wrap(err, "could not add link")
+	}
+
+	if len(k.Config.Symlinks) >= 1 {
+		k.l("\nAdding additional symlinks")
+
+		for _, src := range sortedKeys(k.Config.Symlinks) {
+			dest := k.Config.Symlinks[src]
+			k.l("  SYMLINK  %-35s  TO  %s", src, dest)
+			k.d("    %s -> %s", src, dest)
+
+			if src == "" {
+				k.d("    --> source must not be empty")
+				return errors.New("could not add symlink: source must not be empty")
+			}
+			if strings.HasPrefix(dest, "/") {
+				k.d("    --> destination must not start with a slash")
+				return errors.New("could not add symlink: destination must not start with a slash")
+			}
+			g.Symlink(dest, linkTarget(src))
+		}
+	}
+
+	if len(k.Config.Hardlinks) >= 1 {
+		k.l("\nAdding additional hard links")
+
+		for _, src := range sortedKeys(k.Config.Hardlinks) {
+			dest := k.Config.Hardlinks[src]
+			k.l("  HARDLINK %-35s  TO  %s", src, dest)
+			k.d("    %s -> %s", src, dest)
+
+			if src == "" {
+				k.d("    --> source must not be empty")
+				return errors.New("could not add hard link: source must not be empty")
+			}
+			if strings.HasPrefix(dest, "/") {
+				k.d("    --> destination must not start with a slash")
+				return errors.New("could not add hard link: destination must not start with a slash")
+			}
+			if t := g.types[resolveLink(dest, linkTarget(src))]; t != tar.TypeReg {
+				if err := check(fmt.Errorf("hard link target '%s' is not a regular file in the firmware or additional files", src)); err != nil {
+					return err
+				}
+			}
+			g.Hardlink(dest, resolveLink(dest, linkTarget(src)))
+		}
+	}
+
+	k.d("    validating links")
+	for _, src := range sortedKeys(k.Config.Symlinks) {
+		dest := k.Config.Symlinks[src]
+		if p, t, err := g.Resolve(dest); err != nil {
+			k.d("    --> %v", err)
+			return wrap(err, "could not add symlink '%s'", dest)
+		} else if t == 0 {
+			if err := check(fmt.Errorf("symlink '%s' points to '%s', which does not exist in the firmware or additional files", dest, p)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, src := range sortedKeys(k.Config.Symlinks) {
+		dest := k.Config.Symlinks[src]
+		k.d("    writing symlink header for %s", dest)
+		err := k.out.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     "./" + dest,
+			Linkname: linkTarget(src),
+			Mode:     0777,
+			Uid:      0,
+			Gid:      0,
+			ModTime:  k.modTime(),
+		})
+		if err != nil {
+			k.d("    --> %v", err)
+			return wrap(err, "could not write additional symlink to KoboRoot.tgz")
+		}
+		k.plan.Symlinks = append(k.plan.Symlinks, &PlanSymlink{Target: src, Dest: dest})
+	}
+
+	for _, src := range sortedKeys(k.Config.Hardlinks) {
+		dest := k.Config.Hardlinks[src]
+		k.d("    writing hard link header for %s", dest)
+		err := k.out.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeLink,
+			Name:     "./" + dest,
+			Linkname: "./" + resolveLink(dest, linkTarget(src)),
+			Mode:     0777,
+			Uid:      0,
+			Gid:      0,
+			ModTime:  k.modTime(),
+		})
+		if err != nil {
+			k.d("    --> %v", err)
+			return wrap(err, "could not write additional hard link to KoboRoot.tgz")
+		}
+		k.plan.Symlinks = append(k.plan.Symlinks, &PlanSymlink{Target: src, Dest: dest, Hardlink: true})
+	}
+	return nil
+}
+
+// RunPatchTests tests the patches against the firmware using the specified
+// test modes (TestIndividual if none are specified).
+func (k *KoboPatch) RunPatchTests(modes ...string) (*TestReport, error) {
+	return k.RunPatchTestsContext(context.Background(), modes...)
+}
+
+// RunPatchTestsContext is like RunPatchTests, but stops if ctx is cancelled.
+func (k *KoboPatch) RunPatchTestsContext(ctx context.Context, modes ...string) (*TestReport, error) {
+	k.ctx = ctx
+	defer func() { k.ctx = nil }()
+
+	k.d("\n\nKoboPatch::RunPatchTests(%s)", strings.Join(modes, ", "))
+
+	if len(modes) == 0 {
+		modes = []string{TestIndividual}
+	}
+
+	start := time.Now()
+	res := &TestReport{
+		Version:  k.Config.Version,
+		Firmware: filepath.Base(k.Config.In),
+	}
+
+	tr, closeAll, err := k.openIn()
+	if err != nil {
+		return nil, err
+	}
+	defer closeAll()
+
+	// the entries are queued until the firmware has been checked, so a patch
+	// error from a different firmware version can't be reported instead of
+	// the version mismatch
+	type queuedEntry struct {
+		name       string
+		buf        []byte
+		patchfiles []string
+	}
+	var queued []queuedEntry
+	runQueued := func() error {
+		if !k.fw.checked {
+			return nil
+		}
+		for _, e := range queued {
+			if err := k.testEntry(ctx, res, e.name, e.buf, e.patchfiles, modes); err != nil {
+				return err
+			}
+		}
+		queued = nil
+		return nil
+	}
+
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			k.d("--> could not read entry from tgz: %v", err)
+			return nil, wrap(err, "could not read input firmware")
+		}
+		k.prog.update(func(p *Progress) {
+			p.Entry, p.Patch = h.Name, ""
+		})
+
+		patchfiles := []string{}
+		for _, n := range sortedKeys(k.Config.Patches) {
+			f := k.Config.Patches[n]
+			if h.Name == "./"+f || h.Name == f || filepath.Base(f) == h.Name {
+				patchfiles = append(patchfiles, n)
+			}
+		}
+
+		buf, err := k.readVersionFile(h, tr)
+		if err != nil {
+			return nil, err
+		}
+		if err := runQueued(); err != nil {
+			return nil, err
+		}
+
+		if len(patchfiles) < 1 {
+			continue
+		}
+
+		k.d("    patching entry name:'%s' size:%d mode:'%v' typeflag:'%v' with files: %s", h.Name, h.Size, h.Mode, h.Typeflag, strings.Join(patchfiles, ", "))
+
+		if h.Typeflag != tar.TypeReg {
+			k.d("    --> could not patch: not a regular file")
+			return nil, fmt.Errorf("could not patch file '%s': not a regular file", h.Name)
+		}
+
+		if buf == nil {
+			k.d("        reading entry contents")
+			if buf, err = ioutil.ReadAll(tr); err != nil {
+				k.d("    --> could not patch: could not read contents: %v", err)
+				return nil, wrap(err, "could not patch file '%s': could not read contents", h.Name)
+			}
+		}
+
+		queued = append(queued, queuedEntry{h.Name, buf, patchfiles})
+		if err := runQueued(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := k.checkFirmwareOnce(); err != nil {
+		return nil, err
+	}
+	if err := runQueued(); err != nil {
+		return nil, err
+	}
+	if fi := k.firmwareInfo(); len(fi.Versions) != 0 {
+		res.Version = fi.Versions[0]
+	}
+	res.Time = time.Since(start)
+
+	k.dp("  | ", "%s", jm(res))
+
+	return res, nil
+}
+
+// testEntry runs the tests for the patch files for a firmware entry and adds
+// the results to res.
+func (k *KoboPatch) testEntry(ctx context.Context, res *TestReport, name string, buf []byte, patchfiles, modes []string) error {
+	k.l("\nPatching %s", name)
+
+	getBuf := func() []byte {
+		nbuf := make([]byte, len(buf))
+		copy(nbuf, buf)
+		return nbuf
+	}
+
+	for _, pfn := range patchfiles {
+		k.d("        loading patch file '%s'", pfn)
+		ps, _, err := k.readPatchFile(pfn)
+		if err != nil {
+			k.d("        --> %v", err)
+			return wrap(err, "could not load patch file '%s'", pfn)
+		}
+
+		k.d("        validating patch file")
+		if err := ps.Validate(); err != nil {
+			k.d("        --> %v", err)
+			return wrap(err, "invalid patch file '%s'", pfn)
+		}
+
+		fstart := time.Now()
+		tf := &TestFile{Filename: pfn, Target: name}
+		res.Files = append(res.Files, tf)
+
+		if err := k.testPatchFile(tf, ps, getBuf, modes); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		tf.Time = time.Since(fstart)
+	}
+	return nil
+}
+
+// Test modes for RunPatchTests.
+const (
+	TestIndividual = "individual" // each patch alone
+	TestDefaults   = "defaults"   // the patches enabled in the patch file
+	TestConfigured = "configured" // the patches enabled after applying the overrides
+	TestGroups     = "groups"     // each member of each PatchGroup with the rest of the defaults
+)
+
+// TestModes is the list of valid test modes.
+var TestModes = []string{TestIndividual, TestDefaults, TestConfigured, TestGroups}
+
+// testPatchFile runs the tests for a single patch file.
+func (k *KoboPatch) testPatchFile(tf *TestFile, ps patchfile.PatchSet, getBuf func() []byte, modes []string) error {
+	in, ok := ps.(patchfile.Inspector)
+	if !ok {
+		k.d("        --> patch format does not support listing patches")
+		return fmt.Errorf("could not list patches in '%s': patch format does not support listing patches", tf.Filename)
+	}
+
+	sortedNames, defaults, patchGroups := []string{}, []string{}, map[string][]string{}
+	for _, p := range in.Patches() {
+		sortedNames = append(sortedNames, p.Name)
+		if p.Enabled {
+			defaults = append(defaults, p.Name)
+		}
+		patchGroups[p.Name] = p.Groups
+	}
+
+	// apply applies the patch file with only the specified patches enabled.
+	apply := func(enabled []string) error {
+		e := map[string]bool{}
+		for _, name := range enabled {
+			e[name] = true
+		}
+		for _, name := range sortedNames {
+			if err := ps.SetEnabled(name, e[name]); err != nil {
+				return err
+			}
+		}
+		pt := patchlib.NewPatcher(getBuf())
+		pt.SetContext(k.context())
+		return ps.ApplyTo(pt, k.observer(tf.Target))
+	}
+
+	// alone applies a single patch by itself (the results are cached).
+	aloneRes := map[string]error{}
+	alone := func(name string) error {
+		if err, ok := aloneRes[name]; ok {
+			return err
+		}
+		aloneRes[name] = apply([]string{name})
+		return aloneRes[name]
+	}
+
+	// conflicts finds the patches which cause a set of patches to fail when
+	// applied together, but not individually. Since patches are applied in
+	// sorted order and stop at the first error, the failing patch is the last
+	// one in the shortest failing prefix.
+	conflicts := func(enabled []string) []string {
+		enabled = append([]string{}, enabled...)
+		sort.Strings(enabled)
+		n := sort.Search(len(enabled), func(i int) bool {
+			return apply(enabled[:i+1]) != nil
+		})
+		if n == len(enabled) || alone(enabled[n]) != nil {
+			return nil
+		}
+		for _, other := range enabled[:n] {
+			if alone(other) == nil && apply([]string{other, enabled[n]}) != nil {
+				return []string{other, enabled[n]}
+			}
+		}
+		return enabled[:n+1]
+	}
+
+	// test runs a single test and displays the result (and the test while it
+	// is running if logging to Options.Log).
+	test := func(mode, name string, enabled []string, err error) {
+		label := name
+		if mode != TestIndividual {
+			label = "[" + mode + "] " + name
+		}
+		if k.opt.Log != nil {
+			fmt.Fprintf(k.opt.Log, " -  %s\r", label)
+		}
+		pstart := time.Now()
+		tp := &TestPatch{Name: name, Mode: mode}
+		if mode != TestIndividual {
+			tp.Enabled = enabled
+		}
+		tf.Patches = append(tf.Patches, tp)
+
+		if err == nil {
+			if mode == TestIndividual {
+				err = alone(name)
+			} else if err = apply(enabled); err != nil {
+				tp.Conflicts = conflicts(enabled)
+			}
+		}
+
+		tp.Time = time.Since(pstart)
+		if err != nil {
+			k.l(" ✕  %s", label)
+			tp.setError(err)
+			return
+		}
+		k.l(" ✔  %s", label)
+	}
+
+	for _, mode := range modes {
+		k.d("        running %s tests", mode)
+		switch mode {
+		case TestIndividual:
+			for _, name := range sortedNames {
+				test(mode, name, nil, nil)
+			}
+		case TestDefaults:
+			test(mode, "default patches", defaults, nil)
+		case TestConfigured:
+			var err error
+			e := map[string]bool{}
+			for _, name := range defaults {
+				e[name] = true
+			}
+			for _, name := range sortedKeys(k.Config.Overrides[tf.Filename]) {
+				if _, ok := patchGroups[name]; !ok {
+					err = fmt.Errorf("could not override enabled for patch '%s': no such patch", name)
+					break
+				}
+				e[name] = k.Config.Overrides[tf.Filename][name]
+			}
+			configured := []string{}
+			for _, name := range sortedNames {
+				if e[name] {
+					configured = append(configured, name)
+				}
+			}
+			test(mode, "configured patches", configured, err)
+		case TestGroups:
+			groups := map[string][]string{}
+			for _, name := range sortedNames {
+				for _, pg := range patchGroups[name] {
+					groups[pg] = append(groups[pg], name)
+				}
+			}
+			for _, pg := range sortedKeys(groups) {
+				for _, name := range groups[pg] {
+					// replace the defaults which share a PatchGroup with this patch
+					enabled := []string{name}
+				defaults:
+					for _, other := range defaults {
+						for _, opg := range patchGroups[other] {
+							for _, g := range patchGroups[name] {
+								if opg == g {
+									continue defaults
+								}
+							}
+						}
+						if other != name {
+							enabled = append(enabled, other)
+						}
+					}
+					sort.Strings(enabled)
+					test(mode, fmt.Sprintf("PatchGroup `%s`: `%s`", pg, name), enabled, nil)
+				}
+			}
+		default:
+			return fmt.Errorf("unknown test mode %#v", mode)
+		}
+	}
+	return nil
+}
+
+func (k *KoboPatch) l(format string, a ...interface{}) {
+	if k.Logf != nil {
+		k.Logf(format, a...)
+	}
+}
+
+func (k *KoboPatch) e(format string, a ...interface{}) {
+	if k.Errorf != nil {
+		k.Errorf(format, a...)
+	}
+}
+
+func (k *KoboPatch) d(format string, a ...interface{}) {
+	if k.Debugf != nil {
+		k.Debugf(format, a...)
+	}
+}
+
+func (k *KoboPatch) dp(prefix string, format string, a ...interface{}) {
+	k.d("%s%s", prefix, strings.ReplaceAll(fmt.Sprintf(format, a...), "\n", "\n"+prefix))
+}
+
+func wrap(err error, format string, a ...interface{}) error {
+	return fmt.Errorf("%s: %w", fmt.Sprintf(format, a...), err)
+}
+
+func jm(v interface{}) string {
+	if buf, err := json.MarshalIndent(v, "", "    "); err == nil {
+		return string(buf)
+	}
+	return ""
+}
+
+// isDone checks whether a channel is closed without blocking.
+func isDone(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// sortedKeys returns the keys of a map with string keys in sorted order. It
+// panics if m is not a map.
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readPatchFile reads a patch file from the inputs and returns it along with
+// the detected format.
+func (k *KoboPatch) readPatchFile(pfn string) (patchfile.PatchSet, string, error) {
+	buf, err := fs.ReadFile(k.inputs(), pfn)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not open patch file: %w", err)
+	}
+	format, err := patchfile.Detect(pfn, buf)
+	if err != nil {
+		return nil, "", err
+	}
+	k.d("        detected format %s", format)
+	ps, err := patchfile.Parse(format, pfn, buf)
+	return ps, format, err
+}
+
+// stringArray forces strings to become arrays during yaml decoding.
+type stringSlice []string
+
+// UnmarshalYAML unmarshals a stringArray.
+func (a *stringSlice) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var strings []string
+	if err := unmarshal(&strings); err != nil {
+		var str string
+		if err := unmarshal(&str); err != nil {
+			return err
+		}
+		*a = []string{str}
+	} else {
+		*a = strings
+	}
+	return nil
+}
+
+// FileDest is a destination for an entry in the files section of the config.
+// It can be unmarshaled from a string (the destination) or a mapping.
+type FileDest struct {
+	Dest    string
+	Mode    fileMode // for files (default 0777)
+	DirMode fileMode `yaml:"dirMode"` // for directories (default 0755)
+	Uid     int
+	Gid     int
+	ModTime *time.Time `yaml:"mtime"` // defaults to the mtime for new files
+}
+
+// UnmarshalYAML unmarshals a FileDest.
+func (d *FileDest) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err == nil {
+		*d = FileDest{Dest: str}
+		return nil
+	}
+	type fileDest FileDest
+	if err := unmarshal((*fileDest)(d)); err != nil {
+		return err
+	}
+	if d.Dest == "" {
+		return errors.New("dest is required")
+	}
+	return nil
+}
+
+// TranslationPatch replaces or adds a message in a qm file. For plural
+// messages, Translations is used instead of Translation.
+type TranslationPatch struct {
+	Context      string
+	Source       string
+	Comment      string // the disambiguation, usually empty
+	Translation  string
+	Translations []string
+}
+
+// fileDests is one or more FileDests.
+type fileDests []FileDest
+
+// UnmarshalYAML unmarshals a fileDests.
+func (a *fileDests) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var strs stringSlice
+	if err := unmarshal(&strs); err == nil {
+		*a = nil
+		for _, str := range strs {
+			*a = append(*a, FileDest{Dest: str})
+		}
+		return nil
+	}
+	var dests []FileDest
+	if err := unmarshal(&dests); err != nil {
+		var dest FileDest
+		if err := unmarshal(&dest); err != nil {
+			return err
+		}
+		*a = []FileDest{dest}
+	} else {
+		*a = dests
+	}
+	return nil
+}
+
+// fileMode is an octal file mode. Since the zero value means the default mode
+// is used, a mode of 0 is rejected when unmarshaling.
+type fileMode int64
+
+// UnmarshalYAML unmarshals a fileMode.
+func (m *fileMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimPrefix(str, "0o"), "0"), 8, 32)
+	if err != nil || v > 07777 {
+		return fmt.Errorf("invalid file mode %#v", str)
+	} else if v == 0 {
+		return fmt.Errorf("invalid file mode %#v: must not be zero", str)
+	}
+	*m = fileMode(v)
+	return nil
+}
+
+// Or returns the mode, or def if it isn't set.
+func (m fileMode) Or(def int64) int64 {
+	if m == 0 {
+		return def
+	}
+	return int64(m)
+}
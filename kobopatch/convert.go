@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pgaskin/kobopatch/patchfile"
+	"github.com/pgaskin/kobopatch/patchfile/patch32lsb"
+
+	"github.com/spf13/pflag"
+)
+
+// convertMain runs the convert subcommand and returns the exit code.
+func convertMain(args []string) int {
+	fs := pflag.NewFlagSet("convert", pflag.ContinueOnError)
+	help := fs.BoolP("help", "h", false, "show this help text")
+	bin := fs.StringP("binary", "b", "", "check that the converted patches give the same result as the original ones on this (extracted) binary")
+	if err := fs.Parse(args); err != nil || *help || fs.NArg() < 1 || fs.NArg() > 2 {
+		fmt.Fprintf(os.Stderr, "Usage: kobopatch convert [OPTIONS] PATCH_FILE [OUTPUT_FILE]\n")
+		fmt.Fprintf(os.Stderr, "\nVersion: %s\n\nConverts a patch32lsb patch file to a kobopatch one.\n\nOptions:\n", version)
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nIf OUTPUT_FILE is not specified, the converted patch file is written to stdout.\n")
+		return 1
+	}
+
+	ps, err := patchfile.ReadFromFile("patch32lsb", fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if err := ps.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid patch file: %v\n", err)
+		return 1
+	}
+
+	buf, err := patch32lsb.Convert(ps.(*patch32lsb.PatchSet))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not convert patch file: %v\n", err)
+		return 1
+	}
+
+	if *bin != "" {
+		b, err := ioutil.ReadFile(*bin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not read binary: %v\n", err)
+			return 1
+		}
+		if err := patch32lsb.CheckConvert(ps.(*patch32lsb.PatchSet), buf, b); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: converted patch file is not equivalent: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Checked converted patch file against %s.\n", *bin)
+	}
+
+	if fs.NArg() < 2 {
+		os.Stdout.Write(buf)
+		return 0
+	}
+	if err := ioutil.WriteFile(fs.Arg(1), buf, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not write converted patch file: %v\n", err)
+		return 1
+	}
+	return 0
+}
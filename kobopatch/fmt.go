@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pgaskin/kobopatch/patchfile"
+
+	"github.com/spf13/pflag"
+)
+
+// fmtMain runs the fmt subcommand and returns the exit code.
+func fmtMain(args []string) int {
+	fs := pflag.NewFlagSet("fmt", pflag.ContinueOnError)
+	help := fs.BoolP("help", "h", false, "show this help text")
+	check := fs.Bool("check", false, "don't write the files, and exit with an error if any aren't formatted")
+	if err := fs.Parse(args); err != nil || *help || fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: kobopatch fmt [OPTIONS] PATCH_FILE...\n")
+		fmt.Fprintf(os.Stderr, "\nVersion: %s\n\nRewrites patch files in the canonical style, and lists the ones which were\nchanged.\n\nOptions:\n", version)
+		fs.PrintDefaults()
+		return 1
+	}
+
+	var failed, changed bool
+	for _, fn := range fs.Args() {
+		buf, err := ioutil.ReadFile(fn)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			failed = true
+			continue
+		}
+
+		nbuf, err := patchfile.Reformat("", fn, buf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", fn, err)
+			failed = true
+			continue
+		}
+
+		if bytes.Equal(buf, nbuf) {
+			continue
+		}
+		changed = true
+		fmt.Println(fn)
+
+		if !*check {
+			fi, err := os.Stat(fn)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				failed = true
+				continue
+			}
+			if err := ioutil.WriteFile(fn, nbuf, fi.Mode()); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				failed = true
+				continue
+			}
+		}
+	}
+	if failed || (*check && changed) {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pgaskin/kobopatch"
+
+	"github.com/spf13/pflag"
+)
+
+// lintMain runs the lint subcommand and returns the exit code.
+func lintMain(args []string) int {
+	fs := pflag.NewFlagSet("lint", pflag.ContinueOnError)
+	help := fs.BoolP("help", "h", false, "show this help text")
+	strict := fs.Bool("strict", false, "treat warnings as errors")
+	if err := fs.Parse(args); err != nil || *help || fs.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Usage: kobopatch lint [OPTIONS] [CONFIG_FILE]\n")
+		fmt.Fprintf(os.Stderr, "\nVersion: %s\n\nChecks a config and the patch files, translations, and additional files it\nreferences for problems without needing the firmware.\n\nOptions:\n", version)
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nIf CONFIG_FILE is not specified, kobopatch will use ./kobopatch.yaml.\n")
+		return 1
+	}
+
+	fmt.Printf("kobopatch %s\nhttps://github.com/pgaskin/kobopatch\n\n", version)
+
+	conf := "kobopatch.yaml"
+	if fs.NArg() >= 1 {
+		conf = fs.Arg(0)
+	}
+
+	fmt.Printf("Loading configuration from %s\n", conf)
+	k, err := loadConfig(conf, kobopatch.Options{Log: os.Stdout})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load config file: %v\n", err)
+		return 1
+	}
+
+	r := k.Lint()
+	if len(r.Warnings) > 0 {
+		fmt.Printf("\nWarnings:\n  %s\n", strings.Join(r.Warnings, "\n  "))
+	}
+	if len(r.Errors) > 0 {
+		fmt.Printf("\nErrors:\n  %s\n", strings.Join(r.Errors, "\n  "))
+	}
+	if len(r.Errors) > 0 || (*strict && len(r.Warnings) > 0) {
+		return 1
+	}
+	if len(r.Warnings) > 0 {
+		fmt.Println("\nNo errors found.")
+	} else {
+		fmt.Println("\nNo problems found.")
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pgaskin/kobopatch"
+
+	"github.com/spf13/pflag"
+)
+
+// verifyMain runs the verify subcommand and returns the exit code.
+func verifyMain(args []string) int {
+	fs := pflag.NewFlagSet("verify", pflag.ContinueOnError)
+	help := fs.BoolP("help", "h", false, "show this help text")
+	if err := fs.Parse(args); err != nil || *help || fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: kobopatch verify [OPTIONS] MANIFEST ROOT\n")
+		fmt.Fprintf(os.Stderr, "\nVersion: %s\n\nChecks a mounted device root or an extracted KoboRoot.tgz against the manifest\nwritten next to the output (KoboRoot.tgz.manifest.json).\n\nOptions:\n", version)
+		fs.PrintDefaults()
+		return 1
+	}
+
+	fmt.Printf("kobopatch %s\nhttps://github.com/pgaskin/kobopatch\n\n", version)
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not open manifest: %v\n", err)
+		return 1
+	}
+	m, err := kobopatch.ReadManifest(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not read manifest: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Verifying %d entries from %s (firmware %s) against %s\n", len(m.Entries), fs.Arg(0), m.Version, fs.Arg(1))
+	if errs := m.Verify(fs.Arg(1)); len(errs) != 0 {
+		s := make([]string, len(errs))
+		for i, err := range errs {
+			s[i] = err.Error()
+		}
+		fmt.Printf("\nErrors:\n  %s\n", strings.Join(s, "\n  "))
+		return 1
+	}
+	fmt.Println("\nAll entries match the manifest.")
+	return 0
+}
@@ -0,0 +1,1225 @@
+package kobopatch
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pgaskin/kobopatch/patchfile/kobopatch"
+	"github.com/pgaskin/kobopatch/patchlib"
+	"gopkg.in/yaml.v3"
+)
+
+func TestStringSlice(t *testing.T) {
+	for _, c := range []struct {
+		In  string
+		Out []string
+	}{
+		{`asd`, []string{"asd"}},
+		{`asd sdf`, []string{"asd sdf"}},
+		{`[asd, sdf]`, []string{"asd", "sdf"}},
+		{`["asd", "sdf"]`, []string{"asd", "sdf"}},
+		{`
+    - asd
+    - sdf`, []string{"asd", "sdf"}},
+		{`
+    - "asd"
+    - "sdf"`, []string{"asd", "sdf"}},
+	} {
+		t.Run(c.In, func(t *testing.T) {
+			t.Parallel()
+			var obj struct {
+				Test stringSlice `yaml:"Test"`
+			}
+			if err := yaml.Unmarshal([]byte(fmt.Sprintf("Test: %s", c.In)), &obj); err != nil {
+				t.Fatalf("unexpected unmarshal error: %v", err)
+			}
+			t.Logf("out: %#v", obj)
+			for _, ev := range c.Out {
+				var found bool
+				for _, av := range obj.Test {
+					found = found || av == ev
+				}
+				if !found {
+					t.Errorf("expected to find '%s' in output", ev)
+				}
+			}
+		})
+	}
+}
+
+func TestEnabledPatches(t *testing.T) {
+	ps, err := kobopatch.Parse([]byte(`
+B:
+  - Enabled: yes
+  - FindReplaceString: {Find: "b", Replace: "c"}
+A:
+  - Enabled: yes
+  - FindReplaceString: {Find: "a", Replace: "b"}
+C:
+  - Enabled: no
+  - FindReplaceString: {Find: "c", Replace: "d"}
+`))
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if err := ps.SetEnabled("C", true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ps.SetEnabled("B", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	enabled, err := enabledPatches(ps)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(enabled) != "[A C]" {
+		t.Errorf("expected [A C], got %v", enabled)
+	}
+}
+
+func TestModTime(t *testing.T) {
+	fixed := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		Name   string
+		Config Config
+		SDE    string
+		Out    time.Time
+	}{
+		{"Reproducible", Config{Reproducible: true}, "", time.Unix(0, 0)},
+		{"ReproducibleSourceDateEpoch", Config{Reproducible: true}, "1561939200", fixed},
+		{"ReproducibleInvalidSourceDateEpoch", Config{Reproducible: true}, "asd", time.Unix(0, 0)},
+		{"ModTime", Config{ModTime: &fixed}, "", fixed},
+		{"ModTimeOverridesSourceDateEpoch", Config{Reproducible: true, ModTime: &fixed}, "1", fixed},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			t.Setenv("SOURCE_DATE_EPOCH", c.SDE)
+			k := &KoboPatch{Config: &c.Config}
+			if mt := k.modTime(); !mt.Equal(c.Out) {
+				t.Errorf("expected %s, got %s", c.Out, mt)
+			}
+		})
+	}
+	k := &KoboPatch{Config: &Config{}}
+	if mt := k.modTime(); time.Since(mt) > time.Minute {
+		t.Errorf("expected current time, got %s", mt)
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	td := t.TempDir()
+	for fn, buf := range map[string]string{
+		"fw/usr/local/Kobo/libtest.so": "hello world",
+		"fw/usr/local/Kobo/stock.so":   "stock",
+		"libtest.yaml":                 "Test:\n  - Enabled: yes\n  - FindReplaceString: {Find: \"hello\", Replace: \"HELLO\"}\n",
+		"addon/bin/run.sh":             "#!/bin/sh",
+		"addon/fonts/a.ttf":            "a",
+	} {
+		os.MkdirAll(filepath.Join(td, filepath.Dir(fn)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(td, fn), []byte(buf), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	conf := &Config{
+		Version:      "4.20.14622",
+		In:           "fw",
+		Out:          "KoboRoot.tgz",
+		Restore:      "KoboRoot-restore.tgz",
+		Reproducible: true,
+		Patches:      map[string]string{"libtest.yaml": "usr/local/Kobo/libtest.so"},
+		Files: map[string]fileDests{
+			"addon":         {{Dest: "usr/local/addon"}},
+			"addon/fonts/*": {{Dest: "usr/local/fonts"}},
+		},
+		Symlinks:  map[string]string{"usr/local/addon/bin/run.sh": "usr/bin/run"},
+		Hardlinks: map[string]string{"usr/local/Kobo/stock.so": "usr/local/stock.so"},
+	}
+
+	// run runs the full pipeline and returns the sha256 of the outputs
+	run := func() string {
+		var log bytes.Buffer
+		k := New(Options{Dir: td, Log: &log})
+		k.Config = conf
+		if err := k.Run(); err != nil {
+			t.Fatalf("unexpected error: %v\n%s", err, log.String())
+		}
+		var sums []string
+		for _, fn := range []string{conf.Out, conf.Restore, conf.Out + ".manifest.json"} {
+			buf, err := ioutil.ReadFile(filepath.Join(td, fn))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			sums = append(sums, fmt.Sprintf("%s %x", fn, sha256.Sum256(buf)))
+		}
+		return strings.Join(sums, "\n")
+	}
+
+	a := run()
+
+	// the local mtimes must not affect the output
+	mtime := time.Now().Add(-time.Hour)
+	filepath.Walk(td, func(fn string, fi os.FileInfo, err error) error {
+		if err == nil {
+			os.Chtimes(fn, mtime, mtime)
+		}
+		return nil
+	})
+
+	if b := run(); a != b {
+		t.Errorf("expected identical outputs, got:\n%s\nand:\n%s", a, b)
+	}
+}
+
+// testFirmware creates a firmware zip containing a KoboRoot.tgz with the
+// specified files (in order, as name/contents pairs), and returns the path to
+// it.
+func testFirmware(t *testing.T, files ...string) string {
+	return testFirmwareZip(t, nil, files...)
+}
+
+// testFirmwareZip is like testFirmware, but also adds empty files with the
+// specified names to the zip.
+func testFirmwareZip(t *testing.T, extra []string, files ...string) string {
+	var tbuf bytes.Buffer
+	zw := gzip.NewWriter(&tbuf)
+	tw := tar.NewWriter(zw)
+	for i := 0; i < len(files); i += 2 {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./" + files[i], Mode: 0755, Size: int64(len(files[i+1]))}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := tw.Write([]byte(files[i+1])); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fn := filepath.Join(t.TempDir(), "kobo-update-4.20.14622.zip")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	if zf, err := w.Create("KoboRoot.tgz"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := zf.Write(tbuf.Bytes()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, fn := range extra {
+		if _, err := w.Create(fn); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return fn
+}
+
+// readTGZ reads the files in a tar.gz as name/contents pairs.
+func readTGZ(t *testing.T, fn string) []string {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tr := tar.NewReader(zr)
+	files := []string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		buf, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		files = append(files, h.Name, string(buf))
+	}
+	return files
+}
+
+func TestApplyPatches(t *testing.T) {
+	td := t.TempDir()
+
+	fw, patches := []string{}, map[string]string{}
+	for i := 0; i < 16; i++ {
+		name := fmt.Sprintf("usr/local/Kobo/lib%02d.so", i)
+		fw = append(fw, name, fmt.Sprintf("hello from %02d", i))
+
+		pfn := filepath.Join(td, fmt.Sprintf("lib%02d.so.yaml", i))
+		if err := ioutil.WriteFile(pfn, []byte(fmt.Sprintf("Test:\n  - Enabled: yes\n  - FindReplaceString: {Find: \"hello\", Replace: \"HELLO\"}\nTest %02d:\n  - Enabled: no\n  - FindReplaceString: {Find: \"from\", Replace: \"FROM\"}\n", i)), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		patches[pfn] = name
+	}
+
+	var out bytes.Buffer
+	k := &KoboPatch{
+		Config: &Config{
+			Version: "4.20.14622",
+			In:      testFirmware(t, append(fw, "usr/local/Kobo/unpatched", "hello")...),
+			Out:     filepath.Join(td, "KoboRoot.tgz"),
+			Patches: patches,
+		},
+		Logf: func(format string, a ...interface{}) {
+			fmt.Fprintf(&out, format+"\n", a...)
+		},
+		sums: map[string]string{},
+	}
+	if err := k.OutputInit(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := k.ApplyPatches(); err != nil {
+		k.OutputAbort()
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := k.WriteOutput(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exp := []string{}
+	for i := 0; i < len(fw); i += 2 {
+		exp = append(exp, "./"+fw[i], strings.Replace(fw[i+1], "hello", "HELLO", 1))
+	}
+	if act := readTGZ(t, k.Config.Out); fmt.Sprint(act) != fmt.Sprint(exp) {
+		t.Errorf("expected output %q, got %q", exp, act)
+	}
+
+	var last int
+	for i := 0; i < len(fw); i += 2 {
+		s := fmt.Sprintf("\nPatching ./%s\n  APPLY `Test`\n  SKIP  `Test %02d`\n", fw[i], i/2)
+		if n := strings.Index(out.String(), s); n < last {
+			t.Errorf("expected output for %s to be displayed in order, got:\n%s", fw[i], out.String())
+			break
+		} else {
+			last = n
+		}
+	}
+}
+
+func TestOpenIn(t *testing.T) {
+	td := t.TempDir()
+
+	var tbuf bytes.Buffer
+	tw := tar.NewWriter(&tbuf)
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "./usr/", Mode: 0755},
+		{Typeflag: tar.TypeDir, Name: "./usr/local/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "./usr/local/test", Mode: 0644, Size: 4},
+		{Typeflag: tar.TypeSymlink, Name: "./usr/local/link", Linkname: "test"},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if h.Size != 0 {
+			tw.Write([]byte("test"))
+		}
+	}
+	tw.Close()
+
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	zw.Write(tbuf.Bytes())
+	zw.Close()
+
+	mkzip := func(names ...string) []byte {
+		var buf bytes.Buffer
+		w := zip.NewWriter(&buf)
+		for _, n := range names {
+			f, _ := w.Create(n)
+			f.Write(zbuf.Bytes())
+		}
+		w.Close()
+		return buf.Bytes()
+	}
+
+	write := func(name string, buf []byte) string {
+		fn := filepath.Join(td, name)
+		if err := ioutil.WriteFile(fn, buf, 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return fn
+	}
+
+	dir := filepath.Join(td, "dir")
+	os.MkdirAll(filepath.Join(dir, "usr", "local"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "usr", "local", "test"), []byte("test"), 0644)
+	os.Symlink("test", filepath.Join(dir, "usr", "local", "link"))
+
+	for _, c := range []struct {
+		Name string
+		In   string
+		Err  bool
+	}{
+		{"Zip", write("kobo-update.zip", mkzip("KoboRoot.tgz")), false},
+		{"ZipSubdirectory", write("kobo-update-nested", mkzip("upgrade/", "kobo-update/KoboRoot.tgz")), false},
+		{"ZipMissing", write("kobo-update-missing.zip", mkzip("KoboRoot.tar")), true},
+		{"TGZ", write("KoboRoot.tgz", zbuf.Bytes()), false},
+		{"TGZNoExtension", write("KoboRoot", zbuf.Bytes()), false},
+		{"Tar", write("KoboRoot.tar", tbuf.Bytes()), false},
+		{"Directory", dir, false},
+		{"Unknown", write("unknown.zip", []byte("not a firmware file")), true},
+		{"Missing", filepath.Join(td, "missing"), true},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			mtime := time.Unix(1e9, 0)
+			k := &KoboPatch{Config: &Config{In: c.In, Reproducible: true, ModTime: &mtime}}
+			tr, closeAll, err := k.openIn()
+			defer closeAll()
+			if c.Err {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			entries := []string{}
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				buf, _ := ioutil.ReadAll(tr)
+				entries = append(entries, fmt.Sprintf("%c:%s:%s%s", h.Typeflag, h.Name, h.Linkname, buf))
+				if c.Name == "Directory" {
+					if h.Uid != 0 || h.Gid != 0 || h.Uname != "root" || h.Gname != "root" {
+						t.Errorf("%s: expected root ownership, got %d:%d (%s:%s)", h.Name, h.Uid, h.Gid, h.Uname, h.Gname)
+					}
+					if !h.ModTime.Equal(mtime) {
+						t.Errorf("%s: expected mtime %s, got %s", h.Name, mtime, h.ModTime)
+					}
+				}
+			}
+			sort.Strings(entries) // directories are walked in lexical order
+			if exp := "[0:./usr/local/test:test 2:./usr/local/link:test 5:./usr/: 5:./usr/local/:]"; fmt.Sprint(entries) != exp {
+				t.Errorf("expected %s, got %s", exp, entries)
+			}
+		})
+	}
+}
+
+func TestRunPatchTests(t *testing.T) {
+	td := t.TempDir()
+
+	yfn := filepath.Join(td, "libtest.so.yaml")
+	if err := ioutil.WriteFile(yfn, []byte("Pass:\n  - Enabled: no\n  - FindReplaceString: {Find: \"hello\", Replace: \"HELLO\"}\nFail:\n  - Enabled: no\n  - FindReplaceString: {Find: \"missing\", Replace: \"MISSING\"}\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pfn := filepath.Join(td, "test.patch")
+	if err := ioutil.WriteFile(pfn, []byte("<Patch>\npatch_name = `Pass`\npatch_enable = `no`\nreplace_bytes = 0000, 6E 6F, 4E 4F\n</Patch>\n<Patch>\npatch_name = `Fail`\npatch_enable = `no`\nreplace_bytes = 0000, 61 61, 42 42\n</Patch>\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k := &KoboPatch{
+		Config: &Config{
+			Version: "4.20.14622",
+			In:      testFirmware(t, "usr/local/Kobo/libtest.so", "hello world", "usr/local/Kobo/test", "no world"),
+			Patches: map[string]string{
+				yfn: "usr/local/Kobo/libtest.so",
+				pfn: "usr/local/Kobo/test",
+			},
+		},
+	}
+	res, err := k.RunPatchTests()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if res.Version != "4.20.14622" {
+		t.Errorf("expected the detected firmware version, got %q", res.Version)
+	}
+	if len(res.Files) != 2 {
+		t.Fatalf("expected results for 2 files, got %d", len(res.Files))
+	}
+	for _, tf := range res.Files {
+		if len(tf.Patches) != 2 {
+			t.Errorf("%s: expected 2 results, got %d", tf.Filename, len(tf.Patches))
+			continue
+		}
+		for _, tp := range tf.Patches {
+			if exp := tp.Name == "Pass"; (tp.Error == nil) != exp {
+				t.Errorf("%s: %s: expected pass=%t, got error %v", tf.Filename, tp.Name, exp, tp.Error)
+			}
+		}
+	}
+	if n := res.Failed(); n != 2 {
+		t.Errorf("expected 2 failures, got %d", n)
+	}
+}
+
+func TestRunPatchTestsModes(t *testing.T) {
+	td := t.TempDir()
+
+	yfn := filepath.Join(td, "libtest.so.yaml")
+	if err := ioutil.WriteFile(yfn, []byte(`
+A:
+  - Enabled: yes
+  - FindReplaceString: {Find: "hello", Replace: "HELLO"}
+B:
+  - Enabled: yes
+  - FindReplaceString: {Find: "hello world", Replace: "howdy world"}
+G1:
+  - Enabled: yes
+  - PatchGroup: Test
+  - FindReplaceString: {Find: "world", Replace: "WORLD"}
+G2:
+  - Enabled: no
+  - PatchGroup: Test
+  - FindReplaceString: {Find: "world", Replace: "earth"}
+`), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k := &KoboPatch{
+		Config: &Config{
+			Version:   "4.20.14622",
+			In:        testFirmware(t, "usr/local/Kobo/libtest.so", "hello world"),
+			Patches:   map[string]string{yfn: "usr/local/Kobo/libtest.so"},
+			Overrides: map[string]map[string]bool{yfn: {"B": false}},
+		},
+	}
+	res, err := k.RunPatchTests(TestModes...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Files) != 1 {
+		t.Fatalf("expected results for 1 file, got %d", len(res.Files))
+	}
+
+	act := []string{}
+	for _, tp := range res.Files[0].Patches {
+		act = append(act, fmt.Sprintf("%s:%s:%t:%v:%v", tp.Mode, tp.Name, tp.Error == nil, tp.Enabled, tp.Conflicts))
+	}
+	exp := []string{
+		"individual:A:true:[]:[]",
+		"individual:B:true:[]:[]",
+		"individual:G1:true:[]:[]",
+		"individual:G2:true:[]:[]",
+		"defaults:default patches:false:[A B G1]:[A B]",
+		"configured:configured patches:true:[A G1]:[]",
+		"groups:PatchGroup `Test`: `G1`:false:[A B G1]:[A B]",
+		"groups:PatchGroup `Test`: `G2`:false:[A B G2]:[A B]",
+	}
+	if fmt.Sprint(act) != fmt.Sprint(exp) {
+		t.Errorf("expected:\n  %s\ngot:\n  %s", strings.Join(exp, "\n  "), strings.Join(act, "\n  "))
+	}
+}
+
+func TestCheckFirmware(t *testing.T) {
+	nickel := "\x00Kobo eReader 4.20.14622\x00nickel 4.20.14622\x00migrate from 4.19.14123\x00not a version 1.2.3.4567\x00"
+	fw := testFirmwareZip(t, []string{"upgrade/mx6sll-ntx/uImage", "upgrade/mx6sll-ntx/upgrade-generic.sh", "upgrade/mx6ull-ntx/uImage"},
+		"usr/local/Kobo/libnickel.so.1.0.0", nickel)
+
+	k := &KoboPatch{Config: &Config{In: fw, Version: "4.20.14622"}}
+	if err := k.ApplyPatches(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fi, err := k.CheckFirmware()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(fi.Versions) != "[4.20.14622 4.19.14123]" {
+		t.Errorf("unexpected versions %v", fi.Versions)
+	}
+	if fmt.Sprint(fi.Platforms) != "[mx6sll-ntx mx6ull-ntx]" {
+		t.Errorf("unexpected platforms %v", fi.Platforms)
+	}
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "usr", "local", "Kobo"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, "usr", "local", "Kobo", "nickel"), []byte(nickel), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, c := range []struct {
+		Name    string
+		In      string
+		Version string
+		Devices []string
+		Err     bool
+	}{
+		{"Match", fw, "4.20.14622", nil, false},
+		{"MatchDevice", fw, "4.20.14622", []string{"mx6ull-ntx"}, false},
+		{"VersionMismatch", fw, "4.21.15015", nil, true},
+		{"SecondaryVersion", fw, "4.19.14123", nil, true},
+		{"MostCommonVersion", testFirmware(t, "usr/local/Kobo/nickel", "a 4.19.14123 b 4.20.14622 c 4.20.14622 d"), "4.19.14123", nil, true},
+		{"DeviceMismatch", fw, "4.20.14622", []string{"mx50-ntx"}, true},
+		{"FilenameVersion", testFirmware(t, "usr/local/Kobo/libnickel.so.1.0.0", "nothing"), "4.20.14622", nil, false},
+		{"FilenameVersionMismatch", testFirmware(t, "usr/local/Kobo/libnickel.so.1.0.0", "nothing"), "4.21.15015", nil, true},
+		{"NoDevices", testFirmware(t), "4.20.14622", []string{"mx6ull-ntx"}, true},
+		{"DevicesNotZip", dir, "4.20.14622", []string{"mx50-ntx"}, false},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			k := &KoboPatch{Config: &Config{In: c.In, Version: c.Version, Devices: c.Devices}}
+			if err := k.ApplyPatches(); c.Err && err == nil {
+				t.Errorf("expected error")
+			} else if !c.Err && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if _, err := k.RunPatchTests(); c.Err && err == nil {
+				t.Errorf("expected error from patch tests")
+			} else if !c.Err && err != nil {
+				t.Errorf("unexpected error from patch tests: %v", err)
+			}
+		})
+	}
+
+	t.Run("BeforePatching", func(t *testing.T) {
+		pfn := filepath.Join(t.TempDir(), "libtest.yaml")
+		if err := ioutil.WriteFile(pfn, []byte("Test:\n  - Enabled: yes\n  - FindReplaceString: {Find: \"missing\", Replace: \"MISSING\"}\n"), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		k := &KoboPatch{
+			Config: &Config{
+				Version: "4.21.15015",
+				In:      testFirmware(t, "usr/local/Kobo/libtest.so", "hello", "usr/local/Kobo/libnickel.so.1.0.0", nickel),
+				Out:     filepath.Join(t.TempDir(), "KoboRoot.tgz"),
+				Patches: map[string]string{pfn: "usr/local/Kobo/libtest.so"},
+			},
+			sums: map[string]string{},
+		}
+		if err := k.OutputInit(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer k.OutputAbort()
+		if err := k.ApplyPatches(); err == nil || !strings.Contains(err.Error(), "version mismatch") {
+			t.Errorf("expected a version mismatch before patching, got %v", err)
+		}
+		if _, err := k.RunPatchTests(); err == nil || !strings.Contains(err.Error(), "version mismatch") {
+			t.Errorf("expected a version mismatch before testing, got %v", err)
+		}
+	})
+}
+
+func TestFileDests(t *testing.T) {
+	mtime := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		In  string
+		Out []FileDest
+		Err bool
+	}{
+		{`asd`, []FileDest{{Dest: "asd"}}, false},
+		{`[asd, sdf]`, []FileDest{{Dest: "asd"}, {Dest: "sdf"}}, false},
+		{`{dest: asd, mode: 0644, dirMode: 0o700, uid: 1, gid: 2}`, []FileDest{{Dest: "asd", Mode: 0644, DirMode: 0700, Uid: 1, Gid: 2}}, false},
+		{`[asd, {dest: sdf, mode: "0755", mtime: 2019-07-01T00:00:00Z}]`, []FileDest{{Dest: "asd"}, {Dest: "sdf", Mode: 0755, ModTime: &mtime}}, false},
+		{`{dest: asd, mode: 0999}`, nil, true},
+		{`{dest: asd, mode: 0}`, nil, true},
+		{`{dest: asd, mode: 0000}`, nil, true},
+		{`{dest: asd, dirMode: "0o0"}`, nil, true},
+		{`{mode: 0644}`, nil, true},
+		{`{dest: asd, unknown: 1}`, nil, true},
+	} {
+		t.Run(c.In, func(t *testing.T) {
+			var obj struct {
+				Test fileDests `yaml:"Test"`
+			}
+			dec := yaml.NewDecoder(strings.NewReader(fmt.Sprintf("Test: %s", c.In)))
+			dec.KnownFields(true)
+			if err := dec.Decode(&obj); c.Err {
+				if err == nil {
+					t.Errorf("expected error, got %#v", obj.Test)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected unmarshal error: %v", err)
+			}
+			if fmt.Sprint(jm(obj.Test)) != fmt.Sprint(jm(c.Out)) {
+				t.Errorf("expected %s, got %s", jm(c.Out), jm(obj.Test))
+			}
+		})
+	}
+}
+
+func TestApplyFiles(t *testing.T) {
+	td := t.TempDir()
+	for fn, buf := range map[string]string{
+		"addon/bin/run.sh":      "#!/bin/sh",
+		"addon/fonts/a.ttf":     "a",
+		"addon/fonts/b.ttf":     "bb",
+		"addon/fonts/README.md": "readme",
+		"single.txt":            "single",
+	} {
+		os.MkdirAll(filepath.Join(td, filepath.Dir(fn)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(td, fn), []byte(buf), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	mtime := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	k := &KoboPatch{
+		Config: &Config{
+			Out:          filepath.Join(td, "KoboRoot.tgz"),
+			Reproducible: true,
+			Files: map[string]fileDests{
+				filepath.Join(td, "single.txt"):        {{Dest: "usr/local/single.txt"}},
+				filepath.Join(td, "addon", "bin"):      {{Dest: "usr/local/addon/bin/", Mode: 0755, DirMode: 0700, Uid: 1, Gid: 2, ModTime: &mtime}},
+				filepath.Join(td, "addon/fonts/*.ttf"): {{Dest: "usr/local/addon/fonts", Mode: 0644}},
+			},
+		},
+		sums: map[string]string{},
+	}
+	if err := k.OutputInit(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := k.ApplyFiles(); err != nil {
+		k.OutputAbort()
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := k.WriteOutput(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f, err := os.Open(k.Config.Out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tr := tar.NewReader(zr)
+	act := []string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		act = append(act, fmt.Sprintf("%c %s %o %d:%d %d %d", h.Typeflag, h.Name, h.Mode, h.Uid, h.Gid, h.Size, h.ModTime.Unix()))
+	}
+	exp := []string{
+		"5 ./usr/local/addon/bin/ 700 1:2 0 1561939200",
+		"0 ./usr/local/addon/bin/run.sh 755 1:2 9 1561939200",
+		"0 ./usr/local/addon/fonts/a.ttf 644 0:0 1 0",
+		"0 ./usr/local/addon/fonts/b.ttf 644 0:0 2 0",
+		"0 ./usr/local/single.txt 777 0:0 6 0",
+	}
+	if fmt.Sprint(act) != fmt.Sprint(exp) {
+		t.Errorf("expected:\n  %s\ngot:\n  %s", strings.Join(exp, "\n  "), strings.Join(act, "\n  "))
+	}
+	for _, fn := range []string{"usr/local/addon/bin", "usr/local/addon/bin/run.sh", "usr/local/addon/fonts/a.ttf", "usr/local/single.txt"} {
+		if k.files[fn] == 0 {
+			t.Errorf("expected %s to be recorded as an added file", fn)
+		}
+	}
+}
+
+func TestApplySymlinks(t *testing.T) {
+	td := t.TempDir()
+	extra := filepath.Join(td, "extra.txt")
+	if err := ioutil.WriteFile(extra, []byte("extra"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var tbuf bytes.Buffer
+	tw := tar.NewWriter(&tbuf)
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "./usr/local/Kobo/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "./usr/local/Kobo/libfoo.so", Mode: 0755},
+		{Typeflag: tar.TypeSymlink, Name: "./usr/lib/libfoo.so", Linkname: "../local/Kobo/libfoo.so"},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	tw.Close()
+	fw := filepath.Join(td, "KoboRoot.tar")
+	if err := ioutil.WriteFile(fw, tbuf.Bytes(), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, c := range []struct {
+		Name      string
+		Symlinks  map[string]string
+		Hardlinks map[string]string
+		Partial   bool
+		Out       []string
+		Err       bool
+	}{
+		{"AddedFile", map[string]string{"usr/local/extra.txt": "usr/bin/extra"}, nil, false, []string{"2 ./usr/bin/extra /usr/local/extra.txt"}, false},
+		{"Absolute", map[string]string{"/usr/local/Kobo/libfoo.so": "usr/bin/libfoo.so"}, nil, false, []string{"2 ./usr/bin/libfoo.so /usr/local/Kobo/libfoo.so"}, false},
+		{"Relative", map[string]string{"../extra.txt": "usr/local/bin/extra"}, nil, false, []string{"2 ./usr/local/bin/extra ../extra.txt"}, false},
+		{"RedirectFirmwareFile", map[string]string{"/usr/local/extra.txt": "usr/local/Kobo/libfoo.so"}, nil, false, []string{"2 ./usr/local/Kobo/libfoo.so /usr/local/extra.txt"}, false},
+		{"FirmwareSymlink", map[string]string{"./libfoo.so": "usr/lib/libbar.so"}, nil, false, []string{"2 ./usr/lib/libbar.so ./libfoo.so"}, false},
+		{"Chain", map[string]string{"usr/bin/a": "usr/bin/b", "usr/local/extra.txt": "usr/bin/a"}, nil, false, []string{"2 ./usr/bin/b /usr/bin/a", "2 ./usr/bin/a /usr/local/extra.txt"}, false},
+		{"Hardlink", nil, map[string]string{"usr/local/Kobo/libfoo.so": "usr/local/Kobo/libfoo2.so"}, false, []string{"1 ./usr/local/Kobo/libfoo2.so ./usr/local/Kobo/libfoo.so"}, false},
+		{"HardlinkDirectory", nil, map[string]string{"usr/local/Kobo": "usr/local/Kobo2"}, false, nil, true},
+		{"HardlinkMissing", nil, map[string]string{"usr/local/missing": "usr/local/Kobo2"}, false, nil, true},
+		{"Missing", map[string]string{"usr/local/missing": "usr/bin/missing"}, nil, false, nil, true},
+		{"MissingPartial", map[string]string{"usr/local/missing": "usr/bin/missing"}, nil, true, []string{"2 ./usr/bin/missing /usr/local/missing"}, false},
+		{"Cycle", map[string]string{"usr/bin/a": "usr/bin/b", "usr/bin/b": "usr/bin/a"}, nil, false, nil, true},
+		{"CyclePartial", map[string]string{"usr/bin/a": "usr/bin/b", "./b": "usr/bin/a"}, nil, true, nil, true},
+		{"AbsoluteDest", map[string]string{"usr/local/extra.txt": "/usr/bin/extra"}, nil, false, nil, true},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			k := &KoboPatch{
+				Config: &Config{
+					In:        fw,
+					Out:       filepath.Join(t.TempDir(), "KoboRoot.tgz"),
+					Files:     map[string]fileDests{extra: {{Dest: "usr/local/extra.txt"}}},
+					Symlinks:  c.Symlinks,
+					Hardlinks: c.Hardlinks,
+				},
+				sums: map[string]string{},
+			}
+			if err := k.OutputInit(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer k.OutputAbort()
+			if err := k.ApplyPatches(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			k.inPartial = c.Partial
+			if err := k.ApplyFiles(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := k.ApplySymlinks(); c.Err {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := k.WriteOutput(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			f, err := os.Open(k.Config.Out)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer f.Close()
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tr := tar.NewReader(zr)
+			act := []string{}
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if h.Typeflag == tar.TypeSymlink || h.Typeflag == tar.TypeLink {
+					act = append(act, fmt.Sprintf("%c %s %s", h.Typeflag, h.Name, h.Linkname))
+				}
+			}
+			if fmt.Sprint(act) != fmt.Sprint(c.Out) {
+				t.Errorf("expected %q, got %q", c.Out, act)
+			}
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	td := t.TempDir()
+
+	pfn := filepath.Join(td, "libtest.so.yaml")
+	if err := ioutil.WriteFile(pfn, []byte("Test:\n  - Enabled: yes\n  - FindReplaceString: {Find: \"hello\", Replace: \"HELLO\"}\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k := &KoboPatch{
+		Config: &Config{
+			Version:      "4.20.14622",
+			In:           testFirmware(t, "usr/local/Kobo/libtest.so", "hello world", "usr/local/Kobo/other", "hello"),
+			Out:          filepath.Join(td, "KoboRoot.tgz"),
+			Restore:      filepath.Join(td, "KoboRoot-restore.tgz"),
+			Reproducible: true,
+			Patches:      map[string]string{pfn: "usr/local/Kobo/libtest.so"},
+			Symlinks:     map[string]string{"usr/local/Kobo/libtest.so": "usr/local/Kobo/other"},
+		},
+		sums: map[string]string{},
+	}
+	var out bytes.Buffer
+	k.Logf = func(format string, a ...interface{}) {
+		fmt.Fprintf(&out, format+"\n", a...)
+	}
+	if err := k.OutputInit(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := k.ApplyPatches(); err != nil {
+		k.OutputAbort()
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := k.ApplySymlinks(); err != nil {
+		k.OutputAbort()
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := k.WriteOutput(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if exp, act := []string{"./usr/local/Kobo/libtest.so", "HELLO world", "./usr/local/Kobo/other", ""}, readTGZ(t, k.Config.Out); fmt.Sprint(act) != fmt.Sprint(exp) {
+		t.Errorf("expected output %q, got %q", exp, act)
+	}
+	if exp, act := []string{"./usr/local/Kobo/libtest.so", "hello world"}, readTGZ(t, k.Config.Restore); fmt.Sprint(act) != fmt.Sprint(exp) {
+		t.Errorf("expected restore output %q, got %q", exp, act)
+	}
+	if !strings.Contains(out.String(), "will not be restored:\n    usr/local/Kobo/other\n") {
+		t.Errorf("expected warning about replaced firmware file, got:\n%s", out.String())
+	}
+
+	t.Run("OutputError", func(t *testing.T) {
+		td := t.TempDir()
+		k := &KoboPatch{
+			Config: &Config{
+				Version:      "4.20.14622",
+				In:           k.Config.In,
+				Out:          filepath.Join(td, "KoboRoot.tgz"),
+				Restore:      filepath.Join(td, "KoboRoot-restore.tgz"),
+				Reproducible: true,
+				Patches:      map[string]string{pfn: "usr/local/Kobo/libtest.so"},
+			},
+			sums: map[string]string{},
+		}
+		if err := k.OutputInit(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := k.ApplyPatches(); err != nil {
+			k.OutputAbort()
+			t.Fatalf("unexpected error: %v", err)
+		}
+		k.outTarExpectedSize++ // make the main output fail its consistency check
+		if err := k.WriteOutput(); err == nil || !strings.Contains(err.Error(), "could not write output tar.gz") {
+			t.Errorf("expected output error, got %v", err)
+		}
+		if fis, err := ioutil.ReadDir(td); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if len(fis) != 0 {
+			t.Errorf("expected no files to be left in the output dir, got %d (first: %s)", len(fis), fis[0].Name())
+		}
+	})
+}
+
+func TestApplyTranslations(t *testing.T) {
+	td := t.TempDir()
+
+	ts := filepath.Join(td, "test.ts")
+	if err := ioutil.WriteFile(ts, []byte("<TS language=\"de\"><context><name>C</name><message><source>a</source><translation>b</translation></message></context></TS>"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	newKoboPatch := func(lr string) *KoboPatch {
+		return &KoboPatch{
+			Config: &Config{
+				In:           testFirmware(t, "usr/local/Kobo/libtest.so", "hello world"),
+				Out:          filepath.Join(td, "KoboRoot.tgz"),
+				Reproducible: true,
+				Lrelease:     lr,
+				Translations: map[string]string{ts: "usr/local/Kobo/translations/test.qm"},
+			},
+			sums: map[string]string{},
+		}
+	}
+
+	t.Run("Builtin", func(t *testing.T) {
+		k := newKoboPatch("")
+		if err := k.OutputInit(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := k.ApplyTranslations(); err != nil {
+			k.OutputAbort()
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := k.WriteOutput(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if out := readTGZ(t, k.Config.Out); len(out) != 2 || out[0] != "./usr/local/Kobo/translations/test.qm" || !strings.HasPrefix(out[1], "\x3C\xB8\x64\x18") {
+			t.Errorf("expected a single qm file, got %q", out)
+		}
+	})
+
+	t.Run("External", func(t *testing.T) {
+		k := newKoboPatch(filepath.Join(td, "nonexistent-lrelease"))
+		if err := k.OutputInit(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer k.OutputAbort()
+		if err := k.ApplyTranslations(); err == nil || !strings.Contains(err.Error(), "could not find lrelease") {
+			t.Errorf("expected error about missing lrelease, got %v", err)
+		}
+	})
+}
+
+func TestTranslationPatches(t *testing.T) {
+	td := t.TempDir()
+
+	qm := (&patchlib.QM{
+		Language: "de",
+		Messages: []*patchlib.QMMessage{
+			{Context: "C", Source: "a", Translations: []string{"A"}},
+			{Context: "C", Source: "%n b", Translations: []string{"%n B", "%n Bs"}},
+		},
+	}).Bytes()
+
+	for _, tc := range []struct {
+		what  string
+		tps   []TranslationPatch
+		err   bool
+		trans map[string][]string
+	}{
+		{"ReplaceAndAdd", []TranslationPatch{
+			{Context: "C", Source: "a", Translation: "X"},
+			{Context: "C", Source: "%n b", Translations: []string{"%n Y", "%n Ys"}},
+			{Context: "D", Source: "new", Translation: "Z"},
+		}, false, map[string][]string{
+			"C a":    {"X"},
+			"C %n b": {"%n Y", "%n Ys"},
+			"D new":  {"Z"},
+		}},
+		{"NumerusMismatch", []TranslationPatch{
+			{Context: "C", Source: "%n b", Translation: "%n Y"},
+		}, true, nil},
+	} {
+		t.Run(tc.what, func(t *testing.T) {
+			k := &KoboPatch{
+				Config: &Config{
+					Version:            "4.20.14622",
+					In:                 testFirmware(t, "usr/local/Kobo/translations/trans_de.qm", string(qm), "usr/local/Kobo/other", "hello"),
+					Out:                filepath.Join(td, "KoboRoot.tgz"),
+					Reproducible:       true,
+					TranslationPatches: map[string][]TranslationPatch{"usr/local/Kobo/translations/trans_de.qm": tc.tps},
+				},
+				sums: map[string]string{},
+			}
+			if err := k.OutputInit(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := k.ApplyPatches(); err != nil {
+				k.OutputAbort()
+				if !tc.err {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			} else if tc.err {
+				k.OutputAbort()
+				t.Fatalf("expected error")
+			}
+			if err := k.WriteOutput(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			out := readTGZ(t, k.Config.Out)
+			if len(out) != 2 || out[0] != "./usr/local/Kobo/translations/trans_de.qm" {
+				t.Fatalf("expected only the patched qm file, got %q", out)
+			}
+			q, err := patchlib.ReadQM([]byte(out[1]))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			trans := map[string][]string{}
+			for _, m := range q.Messages {
+				trans[m.Context+" "+m.Source] = m.Translations
+			}
+			if fmt.Sprint(trans) != fmt.Sprint(tc.trans) {
+				t.Errorf("expected translations %q, got %q", tc.trans, trans)
+			}
+		})
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	newConfig := func() *Config {
+		return &Config{
+			Patches: map[string]string{
+				"a.yaml": "usr/local/Kobo/libnickel.so.1.0.0",
+				"b.yaml": "usr/local/Kobo/nickel",
+			},
+			Overrides: map[string]map[string]bool{
+				"a.yaml": {"One": true, "Two": true},
+			},
+			Profiles: map[string]map[string]map[string]bool{
+				"minimal": {"a.yaml": {"Two": false}},
+				"full":    {"a.yaml": {"Two": true, "Three": true}, "b.yaml": {"Four: with colon": true}},
+				"bad":     {"c.yaml": {"Five": true}},
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		what     string
+		profiles []string
+		enable   []string
+		disable  []string
+		err      bool
+		res      map[string]map[string]bool
+	}{
+		{"None", nil, nil, nil, false, map[string]map[string]bool{
+			"a.yaml": {"One": true, "Two": true},
+		}},
+		{"Profile", []string{"minimal"}, nil, nil, false, map[string]map[string]bool{
+			"a.yaml": {"One": true, "Two": false},
+		}},
+		{"ProfilesLayered", []string{"minimal", "full"}, nil, nil, false, map[string]map[string]bool{
+			"a.yaml": {"One": true, "Two": true, "Three": true},
+			"b.yaml": {"Four: with colon": true},
+		}},
+		{"Flags", []string{"full"}, []string{"b.yaml:Six: with colon"}, []string{"a.yaml:One", "b.yaml:Four: with colon"}, false, map[string]map[string]bool{
+			"a.yaml": {"One": false, "Two": true, "Three": true},
+			"b.yaml": {"Four: with colon": false, "Six: with colon": true},
+		}},
+		{"UnknownProfile", []string{"missing"}, nil, nil, true, nil},
+		{"UnknownProfileFile", []string{"bad"}, nil, nil, true, nil},
+		{"UnknownFlagFile", nil, []string{"c.yaml:One"}, nil, true, nil},
+		{"InvalidFlag", nil, nil, []string{"a.yaml"}, true, nil},
+		{"InvalidFlagEmpty", nil, nil, []string{"a.yaml:"}, true, nil},
+	} {
+		t.Run(tc.what, func(t *testing.T) {
+			k := &KoboPatch{Config: newConfig()}
+			if err := k.ApplyOverrides(tc.profiles, tc.enable, tc.disable); err != nil {
+				if !tc.err {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			} else if tc.err {
+				t.Fatalf("expected error")
+			}
+			if fmt.Sprint(k.Config.Overrides) != fmt.Sprint(tc.res) {
+				t.Errorf("expected overrides %v, got %v", tc.res, k.Config.Overrides)
+			}
+		})
+	}
+}
+
+func TestLint(t *testing.T) {
+	td := t.TempDir()
+	for fn, buf := range map[string]string{
+		"good.yaml": "One:\n  - Enabled: no\n  - ReplaceString: {Offset: 0, Find: a, Replace: b}\nTwo:\n  - Enabled: no\n  - BaseAddress: 0\n  - ReplaceBytesNOP: {Offset: 4, Find: [0x00, 0x46]}\n",
+		"bad.yaml":  "One:\n  - Enabled: yes\n",
+		"tr.ts":     "<TS><context><name>C</name></context></TS>",
+		"bad.ts":    "<notts/>",
+		"f.txt":     "f",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(td, fn), []byte(buf), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	p := func(fn string) string { return filepath.Join(td, fn) }
+
+	k := &KoboPatch{Config: &Config{
+		Patches: map[string]string{
+			p("good.yaml"):    "usr/local/Kobo/libnickel.so.1.0.0",
+			p("bad.yaml"):     "usr/local/Kobo/../Kobo/nickel",
+			p("missing.yaml"): "./usr/local/Kobo/libadobe.so",
+		},
+		Overrides: map[string]map[string]bool{
+			p("good.yaml"): {"One": true, "Typo": true},
+			p("c.yaml"):    {"One": true},
+		},
+		Profiles: map[string]map[string]map[string]bool{
+			"p": {p("good.yaml"): {"Two": true, "Other": true}},
+		},
+		Translations: map[string]string{
+			p("tr.ts"):      "usr/local/Kobo/translations/tr.qm",
+			p("bad.ts"):     "usr/local/Kobo/bad.qm",
+			p("missing.ts"): "/usr/local/Kobo/translations/missing.qm",
+		},
+		TranslationPatches: map[string][]TranslationPatch{
+			"usr/local/Kobo/translations/nickel-de.qm": nil,
+		},
+		Files: map[string]fileDests{
+			p("f.txt"):   {{Dest: "usr/local/f.txt"}, {Dest: "usr/local/dir/"}, {Dest: ""}},
+			p("*.bin"):   {{Dest: "usr/local/bin"}},
+			p("missing"): {{Dest: "usr/local/missing"}},
+		},
+		Symlinks: map[string]string{
+			"usr/local/f.txt": "usr/local/./link",
+		},
+		Hardlinks: map[string]string{
+			"": "usr/local/hardlink",
+		},
+	}}
+
+	r := k.Lint()
+	for _, tc := range []struct {
+		s       string
+		warning bool
+	}{
+		{"good.yaml: invalid override: no such patch \"Typo\"", false},
+		{"good.yaml: patch \"Two\": line 7: inst 3: ReplaceBytesNOP is deprecated", true},
+		{"bad.yaml: invalid target 'usr/local/Kobo/../Kobo/nickel': must be a normalized path relative to the root (did you mean 'usr/local/Kobo/nickel'?)", false},
+		{"bad.yaml: invalid patch file: patch \"One\": no instructions which modify anything", false},
+		{"missing.yaml: could not open patch file", false},
+		{"overrides: patch file '" + p("c.yaml") + "' is not in the config", false},
+		{"profile 'p': " + p("good.yaml") + ": no such patch \"Other\"", false},
+		{"bad.ts': destination must start with usr/local/Kobo/translations/", false},
+		{"bad.ts': could not parse translation", false},
+		{"missing.ts': invalid destination '/usr/local/Kobo/translations/missing.qm': must not start with a slash", false},
+		{"missing.ts': open", false},
+		{"*.bin': no matches", false},
+		{"missing': stat", false},
+		{"f.txt': invalid destination '': must not be empty", false},
+		{"symlink to 'usr/local/f.txt': invalid destination 'usr/local/./link'", false},
+		{"hard link 'usr/local/hardlink': target must not be empty", false},
+	} {
+		l := r.Errors
+		if tc.warning {
+			l = r.Warnings
+		}
+		var found bool
+		for _, x := range l {
+			found = found || strings.Contains(x, tc.s)
+		}
+		if !found {
+			t.Errorf("expected problem (warning=%t) containing %q", tc.warning, tc.s)
+		}
+	}
+	if len(r.Errors) != 15 || len(r.Warnings) != 1 {
+		t.Errorf("expected 15 errors and 1 warning, got:\n  %s\n  %s", strings.Join(r.Errors, "\n  "), strings.Join(r.Warnings, "\n  "))
+	}
+}
+
+func TestCheckEntryPath(t *testing.T) {
+	for _, tc := range []struct {
+		p  string
+		ok bool
+	}{
+		{"usr/local/Kobo/nickel", true},
+		{"./usr/local/Kobo/nickel", true},
+		{"usr/local/Kobo/", true},
+		{"", false},
+		{"/usr/local/Kobo/nickel", false},
+		{"../usr/local/Kobo/nickel", false},
+		{"usr/local//Kobo/nickel", false},
+		{"usr/local/Kobo/./nickel", false},
+	} {
+		if err := checkEntryPath(tc.p); (err == nil) != tc.ok {
+			t.Errorf("%q: expected ok=%t, got %v", tc.p, tc.ok, err)
+		}
+	}
+}
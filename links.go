@@ -0,0 +1,95 @@
+package kobopatch
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// cleanEntry normalizes a tar entry name or path into the form
+// usr/local/Kobo/nickel.
+func cleanEntry(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// linkTarget returns the link target to use in the output for a symlink
+// target from the config. Absolute targets and ones starting with ./ or ../
+// are used as-is, and anything else is relative to the root (for backwards
+// compatibility).
+func linkTarget(target string) string {
+	if path.IsAbs(target) || target == "." || target == ".." || strings.HasPrefix(target, "./") || strings.HasPrefix(target, "../") {
+		return target
+	}
+	return "/" + target
+}
+
+// resolveLink returns the path a symlink at name with the specified target
+// points to.
+func resolveLink(name, target string) string {
+	if path.IsAbs(target) {
+		return cleanEntry(target)
+	}
+	return cleanEntry(path.Join(path.Dir(cleanEntry(name)), target))
+}
+
+// linkGraph is the filesystem resulting from applying the output on top of
+// the input firmware, used for validating links.
+type linkGraph struct {
+	types map[string]byte   // the tar typeflag of each path
+	links map[string]string // the resolved symlink targets
+}
+
+// newLinkGraph creates a linkGraph from the input firmware entries and the
+// added files.
+func newLinkGraph(in, files map[string]byte, inLinks map[string]string) *linkGraph {
+	g := &linkGraph{types: map[string]byte{}, links: map[string]string{}}
+	for _, m := range []map[string]byte{in, files} {
+		for p, t := range m {
+			g.types[p] = t
+		}
+	}
+	for p, t := range inLinks {
+		g.links[p] = resolveLink(p, t)
+	}
+	return g
+}
+
+// Symlink adds a symlink.
+func (g *linkGraph) Symlink(name, target string) {
+	name = cleanEntry(name)
+	g.types[name] = tar.TypeSymlink
+	g.links[name] = resolveLink(name, target)
+}
+
+// Hardlink adds a hard link.
+func (g *linkGraph) Hardlink(name, target string) {
+	name, target = cleanEntry(name), cleanEntry(target)
+	g.types[name] = g.types[target]
+	if l, ok := g.links[target]; ok {
+		g.links[name] = l
+	} else {
+		delete(g.links, name)
+	}
+}
+
+// Resolve follows the symlinks starting at the specified path, and returns
+// the final path and its type. If there is a cycle, an error is returned. If
+// the final path does not exist, the type is 0.
+func (g *linkGraph) Resolve(name string) (string, byte, error) {
+	name = cleanEntry(name)
+	seen := map[string]bool{}
+	chain := []string{name}
+	for {
+		if seen[name] {
+			return "", 0, fmt.Errorf("symlink cycle: %s", strings.Join(chain, " -> "))
+		}
+		seen[name] = true
+		if l, ok := g.links[name]; ok {
+			name = l
+			chain = append(chain, name)
+			continue
+		}
+		return name, g.types[name], nil
+	}
+}
@@ -0,0 +1,202 @@
+package kobopatch
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+
+	"github.com/pgaskin/kobopatch/lrelease"
+	"github.com/pgaskin/kobopatch/patchfile"
+)
+
+// LintResult is the result of checking a config and the files it references.
+type LintResult struct {
+	Errors   []string // problems which would cause kobopatch to fail or do the wrong thing
+	Warnings []string // problems which don't prevent kobopatch from running (e.g. deprecated instructions)
+}
+
+func (r *LintResult) errorf(format string, a ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, a...))
+}
+
+func (r *LintResult) warnf(format string, a ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, a...))
+}
+
+// Lint checks the config and the files it references without needing the
+// firmware. Unlike the other steps, it reports every problem it finds rather
+// than stopping at the first one. It should be called after LoadConfig (and
+// ApplyOverrides, if used), with paths relative to the config.
+func (k *KoboPatch) Lint() *LintResult {
+	k.d("\n\nKoboPatch::Lint")
+	r := &LintResult{}
+
+	if k.Config.Lrelease != "" {
+		if _, err := exec.LookPath(k.Config.Lrelease); err != nil {
+			k.d("--> %v", err)
+			r.errorf("lrelease: could not find '%s': %v", k.Config.Lrelease, err)
+		}
+	}
+
+	if len(k.Config.Patches) >= 1 {
+		k.l("\nChecking patch files")
+	}
+	patchsets := map[string]patchfile.PatchSet{}
+	for _, pfn := range sortedKeys(k.Config.Patches) {
+		k.l("  CHECK  %s", pfn)
+		k.d("    checking patch file '%s' for '%s'", pfn, k.Config.Patches[pfn])
+		if err := checkEntryPath(k.Config.Patches[pfn]); err != nil {
+			k.d("    --> %v", err)
+			r.errorf("%s: invalid target '%s': %v", pfn, k.Config.Patches[pfn], err)
+		}
+
+		ps, _, err := k.readPatchFile(pfn)
+		if err != nil {
+			k.d("    --> %v", err)
+			r.errorf("%s: %v", pfn, err)
+			continue
+		}
+		patchsets[pfn] = ps
+
+		for _, name := range sortedKeys(k.Config.Overrides[pfn]) {
+			if err := ps.SetEnabled(name, k.Config.Overrides[pfn][name]); err != nil {
+				k.d("    --> %v", err)
+				r.errorf("%s: invalid override: %v", pfn, err)
+			}
+		}
+
+		if err := ps.Validate(); err != nil {
+			k.d("    --> %v", err)
+			r.errorf("%s: invalid patch file: %v", pfn, err)
+		}
+
+		if l, ok := ps.(patchfile.Linter); ok {
+			for _, w := range l.Lint() {
+				k.d("    --> warning: %s", w)
+				r.warnf("%s: %s", pfn, w)
+			}
+		}
+	}
+
+	for _, pfn := range sortedKeys(k.Config.Overrides) {
+		if _, ok := k.Config.Patches[pfn]; !ok {
+			r.errorf("overrides: patch file '%s' is not in the config", pfn)
+		}
+	}
+
+	for _, p := range sortedKeys(k.Config.Profiles) {
+		for _, pfn := range sortedKeys(k.Config.Profiles[p]) {
+			if _, ok := k.Config.Patches[pfn]; !ok {
+				r.errorf("profile '%s': patch file '%s' is not in the config", p, pfn)
+				continue
+			}
+			ps, ok := patchsets[pfn]
+			if !ok {
+				continue // already reported
+			}
+			in, ok := ps.(patchfile.Inspector)
+			if !ok {
+				continue // can't check the names
+			}
+			exists := map[string]bool{}
+			for _, pp := range in.Patches() {
+				exists[pp.Name] = true
+			}
+			for _, name := range sortedKeys(k.Config.Profiles[p][pfn]) {
+				if !exists[name] {
+					r.errorf("profile '%s': %s: no such patch %q", p, pfn, name)
+				}
+			}
+		}
+	}
+
+	if len(k.Config.Translations) >= 1 || len(k.Config.TranslationPatches) >= 1 {
+		k.l("\nChecking translations")
+	}
+	for _, ts := range sortedKeys(k.Config.Translations) {
+		qm := k.Config.Translations[ts]
+		k.l("  CHECK  %s", ts)
+		k.d("    checking translation '%s' -> '%s'", ts, qm)
+		if err := checkEntryPath(qm); err != nil {
+			r.errorf("translation '%s': invalid destination '%s': %v", ts, qm, err)
+		} else if !strings.HasPrefix(qm, "usr/local/Kobo/translations/") {
+			r.errorf("translation '%s': destination must start with usr/local/Kobo/translations/", ts)
+		}
+
+		f, err := k.inputs().Open(ts)
+		if err != nil {
+			k.d("    --> %v", err)
+			r.errorf("translation '%s': %v", ts, err)
+			continue
+		}
+		if _, err := lrelease.ParseTS(f); err != nil && k.Config.Lrelease == "" {
+			k.d("    --> %v", err)
+			r.errorf("translation '%s': could not parse translation: %v", ts, err)
+		}
+		f.Close()
+	}
+	for _, qm := range sortedKeys(k.Config.TranslationPatches) {
+		k.l("  CHECK  %s", qm)
+		if err := checkEntryPath(qm); err != nil {
+			r.errorf("translation patches: invalid target '%s': %v", qm, err)
+		}
+	}
+
+	if len(k.Config.Files) >= 1 {
+		k.l("\nChecking additional files")
+	}
+	for _, src := range sortedKeys(k.Config.Files) {
+		k.l("  CHECK  %s", src)
+		k.d("    checking additional file '%s'", src)
+		if strings.ContainsAny(src, "*?[") {
+			if matches, err := fs.Glob(k.inputs(), src); err != nil {
+				r.errorf("additional files '%s': %v", src, err)
+			} else if len(matches) == 0 {
+				r.errorf("additional files '%s': no matches", src)
+			}
+		} else if _, err := fs.Stat(k.inputs(), src); err != nil {
+			k.d("    --> %v", err)
+			r.errorf("additional file '%s': %v", src, err)
+		}
+		for _, fd := range k.Config.Files[src] {
+			if err := checkEntryPath(fd.Dest); err != nil {
+				r.errorf("additional file '%s': invalid destination '%s': %v", src, fd.Dest, err)
+			}
+		}
+	}
+
+	for _, x := range []struct {
+		what  string
+		links map[string]string
+	}{{"symlink", k.Config.Symlinks}, {"hard link", k.Config.Hardlinks}} {
+		for _, src := range sortedKeys(x.links) {
+			dest := x.links[src]
+			if src == "" {
+				r.errorf("%s '%s': target must not be empty", x.what, dest)
+			}
+			if err := checkEntryPath(dest); err != nil {
+				r.errorf("%s to '%s': invalid destination '%s': %v", x.what, src, dest, err)
+			}
+		}
+	}
+
+	k.dp("  | ", "%s", jm(r))
+	return r
+}
+
+// checkEntryPath checks that a path from the config for an entry in the
+// firmware or the output is relative to the root and normalized (e.g.
+// usr/local/Kobo/nickel). A leading ./ or trailing slash is allowed.
+func checkEntryPath(p string) error {
+	switch {
+	case p == "":
+		return errors.New("must not be empty")
+	case strings.HasPrefix(p, "/"):
+		return errors.New("must not start with a slash")
+	case cleanEntry(p) != strings.TrimSuffix(strings.TrimPrefix(p, "./"), "/"):
+		return fmt.Errorf("must be a normalized path relative to the root (did you mean '%s'?)", cleanEntry(p))
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package lrelease
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTS = `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE TS>
+<TS version="2.1" language="ru" sourcelanguage="en">
+<dependencies>
+    <dependency catalog="qtbase_ru"/>
+</dependencies>
+<context>
+    <name>Dialog</name>
+    <message>
+        <location filename="dialog.cpp" line="10"/>
+        <source>Open &amp;file</source>
+        <comment>menu</comment>
+        <extracomment>ignored</extracomment>
+        <translation>Открыть &amp;файл</translation>
+    </message>
+    <message numerus="yes">
+        <source>%n book(s)</source>
+        <translation>
+            <numerusform>%n книга</numerusform>
+            <numerusform>%n книги</numerusform>
+        </translation>
+    </message>
+    <message>
+        <source>Escape<byte value="x1b"/></source>
+        <translation variants="yes"><lengthvariant>Long</lengthvariant><lengthvariant>Short</lengthvariant></translation>
+    </message>
+    <message>
+        <source>Unfinished</source>
+        <translation type="unfinished"></translation>
+    </message>
+    <message>
+        <source>Old</source>
+        <translation type="obsolete">Старый</translation>
+    </message>
+</context>
+</TS>
+`
+
+func TestParseTS(t *testing.T) {
+	ts, err := ParseTS(strings.NewReader(testTS))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ts.Language != "ru" || ts.SourceLanguage != "en" {
+		t.Errorf("unexpected languages %q and %q", ts.Language, ts.SourceLanguage)
+	}
+	if !reflect.DeepEqual(ts.Dependencies, []string{"qtbase_ru"}) {
+		t.Errorf("unexpected dependencies %q", ts.Dependencies)
+	}
+	for i, m := range []*Message{
+		{"Dialog", "Open &file", "menu", false, Finished, []string{"Открыть &файл"}},
+		{"Dialog", "%n book(s)", "", true, Finished, []string{"%n книга", "%n книги"}},
+		{"Dialog", "Escape\x1b", "", false, Finished, []string{"Long\u009cShort"}},
+		{"Dialog", "Unfinished", "", false, Unfinished, []string{""}},
+		{"Dialog", "Old", "", false, Obsolete, []string{"Старый"}},
+	} {
+		if i >= len(ts.Messages) {
+			t.Errorf("missing message %d", i)
+		} else if !reflect.DeepEqual(ts.Messages[i], m) {
+			t.Errorf("message %d: expected %+v, got %+v", i, m, ts.Messages[i])
+		}
+	}
+
+	for _, tc := range []string{
+		``,
+		`<notts/>`,
+		`<TS><context><name>C</name><message><source>a`,
+		`<TS><context><name>C</name><message><source>a<b/></source></message></context></TS>`,
+		`<TS><context><name>C</name><message numerus="yes"><translation><a/></translation></message></context></TS>`,
+	} {
+		if _, err := ParseTS(strings.NewReader(tc)); err == nil {
+			t.Errorf("%q: expected error", tc)
+		}
+	}
+}
+
+func TestRelease(t *testing.T) {
+	for _, tc := range []struct {
+		what string
+		ts   *TS
+		opt  Options
+		qm   string
+	}{
+		{"Empty", &TS{}, Options{}, "3cb86418caef9c95cd211cbf60a1bddd"},
+		{"Simple", &TS{Language: "de", Messages: []*Message{
+			{Context: "C", Source: "a", Translations: []string{"b"}},
+		}}, Options{}, "" +
+			"3cb86418caef9c95cd211cbf60a1bddd" + // magic
+			"a7" + "00000002" + "6465" + // language
+			"42" + "00000008" + "00000061" + "00000000" + // hashes
+			"69" + "00000019" + "03" + "00000002" + "0062" + "08" + "00000000" + "06" + "00000001" + "61" + "07" + "00000001" + "43" + "01" + // messages
+			"88" + "00000002" + "0101", // numerus rules
+		},
+		{"Skipped", &TS{Language: "ja", Messages: []*Message{
+			{Context: "C", Source: "a", Type: Unfinished, Translations: []string{""}},
+			{Context: "C", Source: "b", Type: Obsolete, Translations: []string{"c"}},
+			{Context: "C", Source: "c", Type: Vanished, Translations: []string{"c"}},
+		}}, Options{}, "" +
+			"3cb86418caef9c95cd211cbf60a1bddd" + // magic
+			"a7" + "00000002" + "6a61", // language
+		},
+		{"NoUnfinished", &TS{Messages: []*Message{
+			{Context: "C", Source: "a", Type: Unfinished, Translations: []string{"b"}},
+		}}, Options{NoUnfinished: true}, "3cb86418caef9c95cd211cbf60a1bddd"},
+		{"PluralPadded", &TS{Language: "ru_RU", Messages: []*Message{
+			{Context: "", Source: "a", Plural: true, Translations: []string{"b"}},
+		}}, Options{}, "" +
+			"3cb86418caef9c95cd211cbf60a1bddd" + // magic
+			"a7" + "00000005" + "72755f5255" + // language
+			"42" + "00000008" + "00000061" + "00000000" + // hashes
+			"69" + "00000022" + "03" + "00000002" + "0062" + "03" + "ffffffff" + "03" + "ffffffff" + "08" + "00000000" + "06" + "00000001" + "61" + "07" + "00000000" + "01" + // messages
+			"88" + "0000000d" + "1101fd290bff140204fd2c0a13", // numerus rules
+		},
+	} {
+		t.Run(tc.what, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Release(&buf, tc.ts, tc.opt); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if qm := hex.EncodeToString(buf.Bytes()); qm != tc.qm {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.qm, qm)
+			}
+		})
+	}
+}
+
+func TestReleaseComments(t *testing.T) {
+	ts := &TS{Messages: []*Message{
+		{Context: "C", Source: "dropped", Comment: "x", Translations: []string{"1"}},
+		{Context: "C", Source: "ambiguous", Comment: "", Translations: []string{"2"}},
+		{Context: "C", Source: "ambiguous", Comment: "x", Translations: []string{"3"}},
+		{Context: "C", Source: "twice", Comment: "x", Translations: []string{"4"}},
+		{Context: "C", Source: "twice", Comment: "y", Translations: []string{"5"}},
+		{Context: "", Source: "nocontext", Comment: "x", Translations: []string{"6"}},
+		{Context: "C", Source: "dropped", Comment: "x", Translations: []string{"duplicate"}},
+	}}
+
+	var buf bytes.Buffer
+	if err := Release(&buf, ts, Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range []struct {
+		source, comment string
+		present         bool
+	}{
+		{"dropped", "", true},
+		{"dropped", "x", false},
+		{"ambiguous", "", true},
+		{"ambiguous", "x", true},
+		{"twice", "", true},
+		{"twice", "x", false},
+		{"twice", "y", true},
+		{"nocontext", "x", true},
+	} {
+		m := []byte{8} // comment
+		m = append(m, 0, 0, 0, byte(len(c.comment)))
+		m = append(m, c.comment...)
+		m = append(m, 6, 0, 0, 0, byte(len(c.source)))
+		m = append(m, c.source...)
+		if bytes.Contains(buf.Bytes(), m) != c.present {
+			t.Errorf("%s (%q): expected present=%t", c.source, c.comment, c.present)
+		}
+	}
+	if bytes.Contains(buf.Bytes(), []byte("d\x00u\x00p")) {
+		t.Errorf("expected first duplicate to be used")
+	}
+}
+
+func TestReleaseCompress(t *testing.T) {
+	ts := &TS{Messages: []*Message{
+		{Context: "A", Source: "a", Translations: []string{"1"}},
+		{Context: "B", Source: "a", Translations: []string{"2"}},
+	}}
+
+	var buf bytes.Buffer
+	if err := Release(&buf, ts, Options{Compress: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	qm := buf.Bytes()
+
+	// the messages have the same hash but a different context, so only the
+	// context is needed for the first one (the last one is always written in
+	// full)
+	msgs := "" +
+		"69" + "00000027" +
+		"03" + "00000002" + "0031" + "07" + "00000001" + "41" + "01" +
+		"03" + "00000002" + "0032" + "08" + "00000000" + "06" + "00000001" + "61" + "07" + "00000001" + "42" + "01"
+	if !strings.Contains(hex.EncodeToString(qm), msgs) {
+		t.Errorf("expected messages %s in %x", msgs, qm)
+	}
+
+	// 151 buckets, A (65) and B (66), each padded to an even offset
+	i := bytes.IndexByte(qm, 0x2F)
+	if i == -1 || len(qm) != i+5+2+151*2+6 {
+		t.Fatalf("expected contexts section")
+	}
+	ctx := qm[i+5:]
+	if ctx[0] != 0 || ctx[1] != 151 {
+		t.Errorf("expected table size 151, got %x", ctx[:2])
+	}
+	if a, b := ctx[2+65*2:2+65*2+2], ctx[2+66*2:2+66*2+2]; !bytes.Equal(a, []byte{0, 1}) || !bytes.Equal(b, []byte{0, 2}) {
+		t.Errorf("unexpected offsets %x and %x", a, b)
+	}
+	if pool := ctx[2+151*2:]; !bytes.Equal(pool, []byte{0, 0, 1, 'A', 1, 'B'}) {
+		t.Errorf("unexpected pool %x", pool)
+	}
+}
+
+func TestNumerusInfo(t *testing.T) {
+	for _, tc := range []struct {
+		lang  string
+		forms int
+		ok    bool
+	}{
+		{"", 0, false},
+		{"xx", 0, false},
+		{"en", 2, true},
+		{"de_DE", 2, true},
+		{"pt", 2, true},
+		{"pt_BR", 2, true},
+		{"ja_JP", 1, true},
+		{"zh_Hant_TW", 1, true},
+		{"ru", 3, true},
+		{"ar", 6, true},
+	} {
+		n, ok := numerusInfo(tc.lang)
+		if ok != tc.ok || n.forms != tc.forms {
+			t.Errorf("%q: expected %d forms (%t), got %d (%t)", tc.lang, tc.forms, tc.ok, n.forms, ok)
+		}
+	}
+	if pt, ptBR := mustNumerus(t, "pt"), mustNumerus(t, "pt_BR"); bytes.Equal(pt.rules, ptBR.rules) {
+		t.Errorf("expected pt_BR to use french-style rules")
+	}
+}
+
+func mustNumerus(t *testing.T, lang string) numerus {
+	n, ok := numerusInfo(lang)
+	if !ok {
+		t.Fatalf("%q: expected numerus info", lang)
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+package lrelease
+
+import "strings"
+
+// Numerus rule bytecode, as interpreted by QTranslator.
+const (
+	qEQ      = 0x01
+	qLT      = 0x02
+	qLEQ     = 0x03
+	qBetween = 0x04
+
+	qNot      = 0x08
+	qMod10    = 0x10
+	qMod100   = 0x20
+	qLead1000 = 0x40
+
+	qAnd     = 0xFD
+	qOr      = 0xFE
+	qNewRule = 0xFF
+
+	qNEQ        = qNot | qEQ
+	qGEQ        = qNot | qLT
+	qNotBetween = qNot | qBetween
+)
+
+type numerus struct {
+	rules []byte
+	forms int
+}
+
+// These are the same as the ones in Qt's numerus.cpp.
+var (
+	japaneseStyle = numerus{nil, 1}
+	englishStyle  = numerus{[]byte{qEQ, 1}, 2}
+	frenchStyle   = numerus{[]byte{qLEQ, 1}, 2}
+	latvian       = numerus{[]byte{qMod10 | qEQ, 1, qAnd, qMod100 | qNEQ, 11, qNewRule, qNEQ, 0}, 3}
+	icelandic     = numerus{[]byte{qMod10 | qEQ, 1, qAnd, qMod100 | qNEQ, 11}, 2}
+	irishStyle    = numerus{[]byte{qEQ, 1, qNewRule, qEQ, 2}, 3}
+	gaelicStyle   = numerus{[]byte{qEQ, 1, qOr, qEQ, 11, qNewRule, qEQ, 2, qOr, qEQ, 12, qNewRule, qBetween, 3, 19}, 4}
+	slovakStyle   = numerus{[]byte{qEQ, 1, qNewRule, qBetween, 2, 4}, 3}
+	macedonian    = numerus{[]byte{qMod10 | qEQ, 1, qNewRule, qMod10 | qEQ, 2}, 3}
+	lithuanian    = numerus{[]byte{qMod10 | qEQ, 1, qAnd, qMod100 | qNEQ, 11, qNewRule, qMod10 | qNEQ, 0, qAnd, qMod100 | qNotBetween, 10, 19}, 3}
+	russianStyle  = numerus{[]byte{qMod10 | qEQ, 1, qAnd, qMod100 | qNEQ, 11, qNewRule, qMod10 | qBetween, 2, 4, qAnd, qMod100 | qNotBetween, 10, 19}, 3}
+	polish        = numerus{[]byte{qEQ, 1, qNewRule, qMod10 | qBetween, 2, 4, qAnd, qMod100 | qNotBetween, 10, 19}, 3}
+	romanian      = numerus{[]byte{qEQ, 1, qNewRule, qEQ, 0, qOr, qMod100 | qBetween, 1, 19}, 3}
+	slovenian     = numerus{[]byte{qMod100 | qEQ, 1, qNewRule, qMod100 | qEQ, 2, qNewRule, qMod100 | qBetween, 3, 4}, 4}
+	maltese       = numerus{[]byte{qEQ, 1, qNewRule, qEQ, 0, qOr, qMod100 | qBetween, 1, 10, qNewRule, qMod100 | qBetween, 11, 19}, 4}
+	welsh         = numerus{[]byte{qEQ, 0, qNewRule, qEQ, 1, qNewRule, qBetween, 2, 5, qNewRule, qEQ, 6}, 5}
+	arabic        = numerus{[]byte{qEQ, 0, qNewRule, qEQ, 1, qNewRule, qEQ, 2, qNewRule, qMod100 | qBetween, 3, 10, qNewRule, qMod100 | qGEQ, 11}, 6}
+	catalan       = numerus{[]byte{qEQ, 1, qNewRule, qLead1000 | qEQ, 11}, 3}
+)
+
+// numerusLanguages maps ISO 639 language codes (including the legacy ones
+// accepted by QLocale) to their numerus rules.
+var numerusLanguages = map[string]numerus{}
+
+func init() {
+	for n, langs := range map[*numerus]string{
+		&japaneseStyle: "bi my zh dz fj gn hu id in ja jv ko ms na om fa su tt th bo tr vi yo za",
+		&englishStyle:  "ab aa af sq am as ay az ba eu bn bh bg km kw co da nl en eo et fo fi fy gl ka de el kl gu ha he iw hi ia ie it kn ks kk rw ky ku rn lo la ln lb mg ml mr mn ne nb no nn oc or ps pt pa qu rm sd si so es sw ss sv tg ta te to ts tk tw ug ur uz vo wo xh yi ji zu",
+		&frenchStyle:   "hy br fr fil tl ti wa", // Qt treats Tagalog as an alias of Filipino
+		&latvian:       "lv",
+		&icelandic:     "is",
+		&irishStyle:    "dv iu ik ga gv mi se sm sa",
+		&gaelicStyle:   "gd",
+		&slovakStyle:   "sk cs",
+		&macedonian:    "mk",
+		&lithuanian:    "lt",
+		&russianStyle:  "bs be hr ru sr uk",
+		&polish:        "pl",
+		&romanian:      "ro mo",
+		&slovenian:     "sl",
+		&maltese:       "mt",
+		&welsh:         "cy",
+		&arabic:        "ar",
+		&catalan:       "ca",
+	} {
+		for _, lang := range strings.Fields(langs) {
+			numerusLanguages[lang] = *n
+		}
+	}
+}
+
+// numerusInfo returns the numerus rules for a language code (e.g. de or
+// pt_BR). If the language is unknown, ok is false, and messages will only have
+// a single form.
+func numerusInfo(code string) (n numerus, ok bool) {
+	lang, country := code, ""
+	if i := strings.IndexByte(code, '_'); i != -1 {
+		lang, country = code[:i], code[strings.LastIndexByte(code, '_')+1:]
+	}
+	if i := strings.IndexByte(lang, '-'); i != -1 {
+		lang = lang[:i]
+	}
+	lang = strings.ToLower(lang)
+	if lang == "pt" && strings.EqualFold(country, "BR") {
+		return frenchStyle, true
+	}
+	n, ok = numerusLanguages[lang]
+	return n, ok
+}
@@ -0,0 +1,124 @@
+package lrelease
+
+import (
+	"io"
+
+	"github.com/pgaskin/kobopatch/patchlib"
+)
+
+// Options controls how the .qm file is generated. The zero value matches the
+// defaults of lrelease.
+type Options struct {
+	Compress     bool // equivalent to lrelease -compress
+	NoUnfinished bool // equivalent to lrelease -nounfinished
+}
+
+type msgKey struct {
+	Context, Source, Comment string
+}
+
+// Release compiles ts into a .qm file. Obsolete and vanished messages, and
+// unfinished ones without a translation, are left out. Plural messages are
+// padded or truncated to the number of numerus forms of the language.
+func Release(w io.Writer, ts *TS, opt Options) error {
+	_, err := w.Write(Compile(ts, opt).Bytes())
+	return err
+}
+
+// Compile is like Release, but returns the QM.
+func Compile(ts *TS, opt Options) *patchlib.QM {
+	n, ok := numerusInfo(ts.Language)
+	if !ok {
+		n = numerus{nil, 1}
+	}
+
+	msgs := resolveDuplicates(ts.Messages)
+
+	all := map[msgKey]bool{}
+	for _, m := range msgs {
+		all[msgKey{m.Context, m.Source, m.Comment}] = true
+	}
+
+	q := &patchlib.QM{
+		Language:     ts.Language,
+		Dependencies: ts.Dependencies,
+		NumerusRules: n.rules,
+		Compressed:   opt.Compress,
+	}
+	seen := map[msgKey]bool{}
+	insert := func(k msgKey, tr []string) {
+		if !seen[k] {
+			seen[k] = true
+			q.Messages = append(q.Messages, &patchlib.QMMessage{
+				Context:      k.Context,
+				Source:       k.Source,
+				Comment:      k.Comment,
+				Translations: tr,
+			})
+		}
+	}
+	for _, m := range msgs {
+		tr := normalizeTranslations(m, n.forms)
+		switch m.Type {
+		case Obsolete, Vanished:
+			continue
+		case Unfinished:
+			if tr[0] == "" || opt.NoUnfinished {
+				continue
+			}
+		}
+		// the comment is dropped unless the message would be ambiguous
+		// without it, or the context is empty
+		k := msgKey{m.Context, m.Source, m.Comment}
+		if k.Comment != "" && k.Context != "" && !all[msgKey{k.Context, k.Source, ""}] {
+			if k2 := (msgKey{k.Context, k.Source, ""}); !seen[k2] {
+				insert(k2, tr)
+				continue
+			}
+		}
+		insert(k, tr)
+	}
+	return q
+}
+
+// resolveDuplicates removes messages with the same context, source, and
+// comment as a previous one. The translations of the first message are kept
+// unless it is untranslated.
+func resolveDuplicates(msgs []*Message) []*Message {
+	res := make([]*Message, 0, len(msgs))
+	idx := map[msgKey]int{}
+	for _, m := range msgs {
+		k := msgKey{m.Context, m.Source, m.Comment}
+		if i, ok := idx[k]; ok {
+			if !isTranslated(res[i]) && isTranslated(m) {
+				om := *res[i]
+				om.Translations = m.Translations
+				res[i] = &om
+			}
+			continue
+		}
+		idx[k] = len(res)
+		res = append(res, m)
+	}
+	return res
+}
+
+func isTranslated(m *Message) bool {
+	for _, t := range m.Translations {
+		if t != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeTranslations returns the translations of m padded or truncated to
+// the number of forms.
+func normalizeTranslations(m *Message, forms int) []string {
+	if !m.Plural {
+		forms = 1
+	}
+	tr := make([]string, forms)
+	copy(tr, m.Translations)
+	return tr
+}
@@ -0,0 +1,261 @@
+// Package lrelease compiles Qt Linguist translation sources (.ts) into the
+// binary .qm format used by QTranslator. It follows the behaviour of lrelease
+// from Qt 5 (qm.cpp, ts.cpp, and numerus.cpp) so the output can be used as a
+// drop-in replacement.
+package lrelease
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Type is the state of a translation.
+type Type int
+
+// Translation states, from the type attribute of the translation element.
+const (
+	Finished Type = iota
+	Unfinished
+	Obsolete
+	Vanished
+)
+
+// TS is a parsed translation source file.
+type TS struct {
+	Language       string
+	SourceLanguage string
+	Dependencies   []string // catalogs
+	Messages       []*Message
+}
+
+// Message is a single translatable string.
+type Message struct {
+	Context string
+	Source  string
+	Comment string // the disambiguation (not the translator or extra comment)
+	Plural  bool
+	Type    Type
+
+	// Translations contains one string for each numerus form if the message
+	// is plural, or a single string otherwise. Empty strings are untranslated.
+	Translations []string
+}
+
+// ParseTS parses a .ts file. Elements which do not affect the output (i.e.
+// locations, extra comments, and old sources) are ignored.
+func ParseTS(r io.Reader) (*TS, error) {
+	t := &tsReader{d: xml.NewDecoder(r)}
+	for {
+		tok, err := t.d.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no TS element")
+		} else if err != nil {
+			return nil, t.wrap(err)
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			if se.Name.Local != "TS" {
+				return nil, t.errorf("unexpected element %s, expected TS", se.Name.Local)
+			}
+			return t.ts(se)
+		}
+	}
+}
+
+type tsReader struct {
+	d *xml.Decoder
+}
+
+func (t *tsReader) errorf(format string, a ...interface{}) error {
+	line, _ := t.d.InputPos()
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, a...))
+}
+
+func (t *tsReader) wrap(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	line, _ := t.d.InputPos()
+	return fmt.Errorf("line %d: %w", line, err)
+}
+
+// children calls fn for each child element until the end of the current
+// element. Character data between elements is ignored. The fn must consume the
+// entire child element.
+func (t *tsReader) children(fn func(se xml.StartElement) error) error {
+	for {
+		tok, err := t.d.Token()
+		if err != nil {
+			return t.wrap(err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if err := fn(tok); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// skip skips the rest of the current element.
+func (t *tsReader) skip() error {
+	if err := t.d.Skip(); err != nil {
+		return t.wrap(err)
+	}
+	return nil
+}
+
+func (t *tsReader) ts(se xml.StartElement) (*TS, error) {
+	ts := &TS{
+		Language:       attr(se, "language"),
+		SourceLanguage: attr(se, "sourcelanguage"),
+	}
+	return ts, t.children(func(se xml.StartElement) error {
+		switch se.Name.Local {
+		case "dependencies":
+			return t.children(func(se xml.StartElement) error {
+				if se.Name.Local == "dependency" {
+					ts.Dependencies = append(ts.Dependencies, attr(se, "catalog"))
+				}
+				return t.skip()
+			})
+		case "context":
+			return t.context(ts)
+		default:
+			return t.skip()
+		}
+	})
+}
+
+func (t *tsReader) context(ts *TS) error {
+	var name string
+	return t.children(func(se xml.StartElement) error {
+		switch se.Name.Local {
+		case "name":
+			var err error
+			name, err = t.contents()
+			return err
+		case "message":
+			m, err := t.message(se, name)
+			if err != nil {
+				return err
+			}
+			ts.Messages = append(ts.Messages, m)
+			return nil
+		default:
+			return t.skip()
+		}
+	})
+}
+
+func (t *tsReader) message(se xml.StartElement, context string) (*Message, error) {
+	m := &Message{
+		Context: context,
+		Plural:  attr(se, "numerus") == "yes",
+	}
+	return m, t.children(func(se xml.StartElement) error {
+		var err error
+		switch se.Name.Local {
+		case "source":
+			m.Source, err = t.contents()
+		case "comment":
+			m.Comment, err = t.contents()
+		case "translation":
+			switch attr(se, "type") {
+			case "unfinished":
+				m.Type = Unfinished
+			case "obsolete":
+				m.Type = Obsolete
+			case "vanished":
+				m.Type = Vanished
+			}
+			if !m.Plural {
+				var s string
+				s, err = t.transContents(se)
+				m.Translations = []string{s}
+				break
+			}
+			m.Translations = nil
+			err = t.children(func(se xml.StartElement) error {
+				if se.Name.Local != "numerusform" {
+					return t.errorf("unexpected element %s in translation", se.Name.Local)
+				}
+				s, err := t.transContents(se)
+				m.Translations = append(m.Translations, s)
+				return err
+			})
+		default:
+			err = t.skip()
+		}
+		return err
+	})
+}
+
+// transContents reads the contents of a translation or numerusform element,
+// joining length variants with the separator used by QTranslator.
+func (t *tsReader) transContents(se xml.StartElement) (string, error) {
+	if attr(se, "variants") != "yes" {
+		return t.contents()
+	}
+	var b strings.Builder
+	err := t.children(func(se xml.StartElement) error {
+		if se.Name.Local != "lengthvariant" {
+			return t.errorf("unexpected element %s in translation", se.Name.Local)
+		}
+		s, err := t.contents()
+		if b.Len() != 0 {
+			b.WriteRune(0x9C) // binary variant separator
+		}
+		b.WriteString(s)
+		return err
+	})
+	return b.String(), err
+}
+
+// contents reads the text of the current element, including characters
+// encoded as byte elements.
+func (t *tsReader) contents() (string, error) {
+	var b strings.Builder
+	for {
+		tok, err := t.d.Token()
+		if err != nil {
+			return "", t.wrap(err)
+		}
+		switch tok := tok.(type) {
+		case xml.CharData:
+			b.Write(tok)
+		case xml.StartElement:
+			if tok.Name.Local != "byte" {
+				return "", t.errorf("unexpected element %s in text", tok.Name.Local)
+			}
+			v := attr(tok, "value")
+			var c uint64
+			if strings.HasPrefix(v, "x") {
+				c, err = strconv.ParseUint(v[1:], 16, 32)
+			} else {
+				c, err = strconv.ParseUint(v, 10, 32)
+			}
+			if err == nil {
+				b.WriteRune(rune(uint16(c))) // invalid values are ignored, like Qt
+			}
+			if err := t.skip(); err != nil {
+				return "", err
+			}
+		case xml.EndElement:
+			return b.String(), nil
+		}
+	}
+}
+
+func attr(se xml.StartElement, name string) string {
+	for _, a := range se.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,298 @@
+package kobopatch
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Manifest records what was written to a KoboRoot.tgz and what it was
+// generated from. It is written next to the output as JSON, along with a
+// sha256sum-compatible list of the regular files (relative to the root).
+type Manifest struct {
+	Kobopatch  string               `json:"kobopatch"` // the kobopatch version
+	Version    string               `json:"version"`   // the firmware version from the config
+	Firmware   ManifestInput        `json:"firmware"`
+	Output     ManifestInput        `json:"output"`
+	PatchFiles []*ManifestPatchFile `json:"patchFiles"`
+	Entries    []*ManifestEntry     `json:"entries"`
+}
+
+// ManifestInput is a file used or generated by kobopatch.
+type ManifestInput struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256,omitempty"` // not set for directories
+}
+
+// ManifestPatchFile is a patch file from the config.
+type ManifestPatchFile struct {
+	Filename string   `json:"filename"`
+	Target   string   `json:"target"`
+	SHA256   string   `json:"sha256"`
+	Enabled  []string `json:"enabled"` // empty if the target wasn't in the firmware
+}
+
+// ManifestEntry is an entry in the output tar.
+type ManifestEntry struct {
+	Name   string `json:"name"` // relative to the root, e.g. usr/local/Kobo/nickel
+	Type   string `json:"type"`
+	Mode   string `json:"mode"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"` // for files and hard links (if the target was hashed)
+	Link   string `json:"link,omitempty"`   // for symlinks and hard links
+}
+
+// Manifest entry types.
+const (
+	ManifestTypeFile     = "file"
+	ManifestTypeDir      = "dir"
+	ManifestTypeSymlink  = "symlink"
+	ManifestTypeHardlink = "hardlink"
+)
+
+// newManifestEntry creates a ManifestEntry from a tar header.
+func newManifestEntry(h *tar.Header) *ManifestEntry {
+	e := &ManifestEntry{
+		Name: cleanEntry(h.Name),
+		Mode: fmt.Sprintf("%04o", h.Mode),
+		Size: h.Size,
+	}
+	switch h.Typeflag {
+	case tar.TypeDir:
+		e.Type = ManifestTypeDir
+	case tar.TypeSymlink:
+		e.Type, e.Link = ManifestTypeSymlink, h.Linkname
+	case tar.TypeLink:
+		e.Type, e.Link = ManifestTypeHardlink, cleanEntry(h.Linkname)
+	default:
+		e.Type = ManifestTypeFile
+	}
+	return e
+}
+
+// ManifestPaths returns the paths to write the manifest and the sha256sum file
+// for an output to.
+func ManifestPaths(out string) (string, string) {
+	return out + ".manifest.json", out + ".sha256sums"
+}
+
+// Manifest returns the manifest for the output written by WriteOutput.
+func (k *KoboPatch) Manifest() *Manifest {
+	return k.manifest
+}
+
+// buildManifest generates the manifest for the output, which must have
+// already been closed.
+func (k *KoboPatch) buildManifest() (*Manifest, error) {
+	k.d("generating manifest")
+
+	m := &Manifest{
+		Kobopatch:  Version,
+		Version:    k.Config.Version,
+		Firmware:   ManifestInput{Path: k.Config.In},
+		Output:     ManifestInput{Path: k.Config.Out, SHA256: k.out.Sum()},
+		PatchFiles: []*ManifestPatchFile{},
+		Entries:    k.out.Entries(),
+	}
+
+	fsys := k.inputs()
+	if fi, err := fs.Stat(fsys, k.Config.In); err != nil {
+		k.d("--> could not hash firmware: %v", err) // it has already been read, so this only happens if In isn't set
+	} else if fi.Mode().IsRegular() {
+		k.d("hashing firmware '%s'", k.Config.In)
+		if m.Firmware.SHA256, err = sha256File(fsys, k.Config.In); err != nil {
+			k.d("--> %v", err)
+			return nil, wrap(err, "could not hash firmware")
+		}
+	}
+
+	enabled := map[string][]string{}
+	for _, t := range k.plan.Targets {
+		for _, pf := range t.PatchFiles {
+			enabled[pf.Filename] = pf.Enabled
+		}
+	}
+	for _, pfn := range sortedKeys(k.Config.Patches) {
+		k.d("hashing patch file '%s'", pfn)
+		sum, err := sha256File(fsys, pfn)
+		if err != nil {
+			k.d("--> %v", err)
+			return nil, wrap(err, "could not hash patch file")
+		}
+		e := enabled[pfn]
+		if e == nil {
+			e = []string{}
+		}
+		m.PatchFiles = append(m.PatchFiles, &ManifestPatchFile{
+			Filename: pfn,
+			Target:   k.Config.Patches[pfn],
+			SHA256:   sum,
+			Enabled:  e,
+		})
+	}
+
+	// hard links to files which aren't in the output use the hash from the
+	// input firmware
+	sums := map[string]string{}
+	for n, s := range k.inSums {
+		sums[n] = s
+	}
+	for _, e := range m.Entries {
+		switch e.Type {
+		case ManifestTypeFile:
+			sums[e.Name] = e.SHA256
+		case ManifestTypeHardlink:
+			if e.SHA256 = sums[e.Link]; e.SHA256 == "" {
+				k.d("--> warning: hard link target '%s' was not hashed, so only the link will be verified", e.Link)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// writeManifest writes the manifest and checksums next to the output.
+func (k *KoboPatch) writeManifest() error {
+	mf, sf := ManifestPaths(k.outPath(k.Config.Out))
+	for _, x := range []struct {
+		what  string
+		fn    string
+		write func(io.Writer) error
+	}{
+		{"manifest", mf, k.manifest.WriteJSON},
+		{"checksums", sf, k.manifest.WriteSHA256Sums},
+	} {
+		k.d("writing %s to '%s'", x.what, x.fn)
+		var buf bytes.Buffer
+		if err := x.write(&buf); err != nil {
+			k.d("--> %v", err)
+			return wrap(err, "could not generate %s", x.what)
+		}
+		if err := ioutil.WriteFile(x.fn, buf.Bytes(), 0644); err != nil {
+			k.d("--> %v", err)
+			return wrap(err, "could not write %s", x.what)
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the manifest as JSON.
+func (m *Manifest) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// WriteSHA256Sums writes the checksums of the regular files (and hard links
+// with a known target checksum) in the format used by sha256sum, with paths
+// relative to the root.
+func (m *Manifest) WriteSHA256Sums(w io.Writer) error {
+	for _, e := range m.Entries {
+		if e.SHA256 != "" {
+			if _, err := fmt.Fprintf(w, "%s  %s\n", e.SHA256, e.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadManifest reads a manifest written along with the output.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, err
+	}
+	if m.Entries == nil {
+		return nil, errors.New("no entries in manifest")
+	}
+	return &m, nil
+}
+
+// Verify checks a directory (e.g. a mounted device root or an extracted
+// KoboRoot.tgz) against the manifest, and returns the entries which don't
+// match. Modes and ownership aren't checked since they aren't always preserved.
+func (m *Manifest) Verify(root string) []error {
+	var errs []error
+	for _, e := range m.Entries {
+		if err := e.verify(root); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.Name, err))
+		}
+	}
+	return errs
+}
+
+func (e *ManifestEntry) verify(root string) error {
+	fn := filepath.Join(root, filepath.FromSlash(e.Name))
+	fi, err := os.Lstat(fn)
+	if err != nil {
+		return err
+	}
+	switch e.Type {
+	case ManifestTypeDir:
+		if !fi.IsDir() {
+			return errors.New("not a directory")
+		}
+	case ManifestTypeSymlink:
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return errors.New("not a symlink")
+		}
+		if l, err := os.Readlink(fn); err != nil {
+			return err
+		} else if l != e.Link {
+			return fmt.Errorf("symlink points to '%s', expected '%s'", l, e.Link)
+		}
+	case ManifestTypeFile, ManifestTypeHardlink:
+		if !fi.Mode().IsRegular() {
+			return errors.New("not a regular file")
+		}
+		if e.Type == ManifestTypeHardlink && e.SHA256 == "" {
+			// the target wasn't hashed, so check that it's the same file
+			tfi, err := os.Stat(filepath.Join(root, filepath.FromSlash(e.Link)))
+			if err != nil {
+				return fmt.Errorf("could not check hard link target: %w", err)
+			} else if !os.SameFile(fi, tfi) {
+				return fmt.Errorf("not a hard link to '%s'", e.Link)
+			}
+			return nil
+		}
+		if sum, err := sha256File(nil, fn); err != nil {
+			return err
+		} else if sum != e.SHA256 {
+			return fmt.Errorf("sha256 mismatch: expected %s, got %s", e.SHA256, sum)
+		}
+	default:
+		return fmt.Errorf("unknown entry type '%s'", e.Type)
+	}
+	return nil
+}
+
+// sha256File returns the sha256 of a file in fsys, or the OS filesystem if
+// fsys is nil.
+func sha256File(fsys fs.FS, fn string) (string, error) {
+	var f io.ReadCloser
+	var err error
+	if fsys != nil {
+		f, err = fsys.Open(fn)
+	} else {
+		f, err = os.Open(fn)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
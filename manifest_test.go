@@ -0,0 +1,140 @@
+package kobopatch
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	td := t.TempDir()
+
+	pfn := filepath.Join(td, "libtest.so.yaml")
+	if err := ioutil.WriteFile(pfn, []byte("Test:\n  - Enabled: yes\n  - FindReplaceString: {Find: \"hello\", Replace: \"HELLO\"}\nOther:\n  - Enabled: no\n  - FindReplaceString: {Find: \"world\", Replace: \"WORLD\"}\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	afn := filepath.Join(td, "extra.txt")
+	if err := ioutil.WriteFile(afn, []byte("extra"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k := &KoboPatch{
+		Config: &Config{
+			Version:      "4.20.14622",
+			In:           testFirmware(t, "usr/local/Kobo/libtest.so", "hello world", "usr/local/Kobo/stock.so", "stock"),
+			Out:          filepath.Join(td, "KoboRoot.tgz"),
+			Reproducible: true,
+			Patches:      map[string]string{pfn: "usr/local/Kobo/libtest.so"},
+			Files:        map[string]fileDests{afn: {{Dest: "usr/local/extra.txt"}}},
+			Symlinks:     map[string]string{"usr/local/extra.txt": "usr/local/link"},
+			Hardlinks:    map[string]string{"usr/local/extra.txt": "usr/local/hardlink", "usr/local/Kobo/stock.so": "usr/local/stock"},
+		},
+		sums: map[string]string{},
+	}
+	if err := k.OutputInit(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, fn := range []func() error{k.ApplyPatches, k.ApplyFiles, k.ApplySymlinks, k.WriteOutput} {
+		if err := fn(); err != nil {
+			k.OutputAbort()
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	mf, sf := ManifestPaths(k.Config.Out)
+	f, err := os.Open(mf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m, err := ReadManifest(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sum := func(s string) string {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+	}
+	if m.Version != "4.20.14622" || m.Firmware.Path != k.Config.In || m.Firmware.SHA256 == "" {
+		t.Errorf("unexpected firmware info in manifest: %+v", m)
+	}
+	if buf, _ := ioutil.ReadFile(k.Config.Out); m.Output.SHA256 != fmt.Sprintf("%x", sha256.Sum256(buf)) {
+		t.Errorf("incorrect output checksum %s", m.Output.SHA256)
+	}
+	if len(m.PatchFiles) != 1 || m.PatchFiles[0].Filename != pfn || !reflect.DeepEqual(m.PatchFiles[0].Enabled, []string{"Test"}) || m.PatchFiles[0].SHA256 == "" {
+		t.Errorf("unexpected patch files in manifest: %+v", m.PatchFiles)
+	}
+
+	exp := []*ManifestEntry{
+		{Name: "usr/local/Kobo/libtest.so", Type: ManifestTypeFile, Mode: "0755", Size: 11, SHA256: sum("HELLO world")},
+		{Name: "usr/local/extra.txt", Type: ManifestTypeFile, Mode: "0777", Size: 5, SHA256: sum("extra")},
+		{Name: "usr/local/link", Type: ManifestTypeSymlink, Mode: "0777", Link: "/usr/local/extra.txt"},
+		{Name: "usr/local/stock", Type: ManifestTypeHardlink, Mode: "0777", SHA256: sum("stock"), Link: "usr/local/Kobo/stock.so"},
+		{Name: "usr/local/hardlink", Type: ManifestTypeHardlink, Mode: "0777", SHA256: sum("extra"), Link: "usr/local/extra.txt"},
+	}
+	if !reflect.DeepEqual(m.Entries, exp) {
+		t.Errorf("expected entries %s, got %s", jm(exp), jm(m.Entries))
+	}
+
+	if buf, err := ioutil.ReadFile(sf); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if exp := sum("HELLO world") + "  usr/local/Kobo/libtest.so\n" + sum("extra") + "  usr/local/extra.txt\n" + sum("stock") + "  usr/local/stock\n" + sum("extra") + "  usr/local/hardlink\n"; string(buf) != exp {
+		t.Errorf("expected checksums:\n%s\ngot:\n%s", exp, buf)
+	}
+
+	t.Run("Verify", func(t *testing.T) {
+		root := t.TempDir()
+		os.MkdirAll(filepath.Join(root, "usr/local/Kobo"), 0755)
+		for fn, buf := range map[string]string{
+			"usr/local/Kobo/libtest.so": "HELLO world",
+			"usr/local/extra.txt":       "extra",
+			"usr/local/hardlink":        "extra",
+			"usr/local/Kobo/stock.so":   "stock",
+		} {
+			if err := ioutil.WriteFile(filepath.Join(root, fn), []byte(buf), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := os.Symlink("/usr/local/extra.txt", filepath.Join(root, "usr/local/link")); err != nil {
+			t.Skipf("could not create symlink: %v", err)
+		}
+		if err := os.Link(filepath.Join(root, "usr/local/Kobo/stock.so"), filepath.Join(root, "usr/local/stock")); err != nil {
+			t.Skipf("could not create hard link: %v", err)
+		}
+		if errs := m.Verify(root); len(errs) != 0 {
+			t.Errorf("unexpected errors: %v", errs)
+		}
+
+		ioutil.WriteFile(filepath.Join(root, "usr/local/Kobo/libtest.so"), []byte("hello world"), 0644)
+		os.Remove(filepath.Join(root, "usr/local/hardlink"))
+		if errs := m.Verify(root); len(errs) != 2 || !strings.Contains(errs[0].Error(), "usr/local/Kobo/libtest.so: sha256 mismatch") || !errors.Is(errs[1], os.ErrNotExist) {
+			t.Errorf("expected a checksum mismatch and a missing file, got %v", errs)
+		}
+	})
+
+	t.Run("VerifyUnhashedHardlink", func(t *testing.T) {
+		root := t.TempDir()
+		os.MkdirAll(filepath.Join(root, "usr/local"), 0755)
+		for _, fn := range []string{"target", "copy"} {
+			if err := ioutil.WriteFile(filepath.Join(root, "usr/local", fn), []byte("stock"), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := os.Link(filepath.Join(root, "usr/local/target"), filepath.Join(root, "usr/local/link")); err != nil {
+			t.Skipf("could not create hard link: %v", err)
+		}
+		um := &Manifest{Entries: []*ManifestEntry{
+			{Name: "usr/local/link", Type: ManifestTypeHardlink, Mode: "0777", Link: "usr/local/target"},
+			{Name: "usr/local/copy", Type: ManifestTypeHardlink, Mode: "0777", Link: "usr/local/target"},
+		}}
+		if errs := um.Verify(root); len(errs) != 1 || !strings.Contains(errs[0].Error(), "usr/local/copy: not a hard link to 'usr/local/target'") {
+			t.Errorf("expected a single hard link error, got %v", errs)
+		}
+	})
+}
@@ -0,0 +1,324 @@
+package kobopatch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pgaskin/kobopatch/patchfile"
+)
+
+// Version is the kobopatch version recorded in the manifest.
+var Version = "unknown"
+
+// Options configures a KoboPatch.
+type Options struct {
+	// FS contains the files referenced by the config (the firmware, patch
+	// files, translations, and additional files), and relative paths in the
+	// config are resolved against its root. If nil, the OS filesystem is used,
+	// and relative paths are resolved against Dir.
+	FS fs.FS
+
+	// Dir is the directory relative paths in the config are resolved against
+	// (usually the directory containing the config). It is also used for the
+	// output paths in the config. If empty, the current directory is used.
+	Dir string
+
+	// Output, if set, receives the patched KoboRoot.tgz instead of Config.Out.
+	// Since it isn't written to a file, the manifest is only available from
+	// Manifest.
+	Output io.Writer
+
+	// Restore, if set, receives the restore KoboRoot.tgz instead of
+	// Config.Restore (which must still be set to enable it).
+	Restore io.Writer
+
+	// Log receives the messages for the user, and Debug receives verbose
+	// messages for the log file. Either can be nil.
+	Log   io.Writer
+	Debug io.Writer
+
+	// Progress, if set, is called with the current state while reading the
+	// firmware and applying patches. It is not called concurrently, but may be
+	// called from a different goroutine, and must not block for long.
+	Progress func(Progress)
+
+	// Observer, if set, is called with the events from applying the patches
+	// to each firmware entry (including while running the patch tests). It may
+	// be called concurrently for different entries.
+	Observer func(entry string, e patchfile.Event)
+}
+
+// Progress is the state of the current step, as reported to Options.Progress.
+type Progress struct {
+	Read  int64  // bytes of the input firmware read so far
+	Total int64  // size of the input firmware (0 if unknown)
+	Entry string // the firmware entry currently being read or patched
+	Patch string // the patch currently being applied to Entry, if any
+}
+
+// progress tracks the state reported to Options.Progress. A nil progress
+// ignores updates.
+type progress struct {
+	mu sync.Mutex
+	fn func(Progress)
+	p  Progress
+}
+
+func (p *progress) update(fn func(p *Progress)) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(&p.p)
+	p.fn(p.p)
+}
+
+// New creates a new KoboPatch. The config must be loaded with LoadConfig
+// before using it.
+func New(opt Options) *KoboPatch {
+	k := &KoboPatch{opt: opt, sums: map[string]string{}}
+	if opt.Progress != nil {
+		k.prog = &progress{fn: opt.Progress}
+	}
+	if opt.Log != nil {
+		k.Logf = func(format string, a ...interface{}) {
+			fmt.Fprintf(opt.Log, format+"\n", a...)
+		}
+		k.Errorf = k.Logf
+	}
+	if opt.Debug != nil {
+		var mu sync.Mutex
+		k.Debugf = func(format string, a ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintf(opt.Debug, format+"\n", a...)
+		}
+	}
+	return k
+}
+
+// Run checks the firmware, applies the patches, translations, files and
+// symlinks, and writes the output.
+func (k *KoboPatch) Run() error {
+	return k.RunContext(context.Background())
+}
+
+// RunContext is like Run, but stops and removes the output if ctx is
+// cancelled.
+func (k *KoboPatch) RunContext(ctx context.Context) error {
+	k.ctx = ctx
+	defer func() { k.ctx = nil }()
+
+	if err := k.OutputInit(); err != nil {
+		return wrap(err, "could not create output")
+	}
+	if err := k.apply(); err != nil {
+		k.OutputAbort()
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		k.OutputAbort()
+		return err
+	}
+	if err := k.WriteOutput(); err != nil {
+		return wrap(err, "could not write output")
+	}
+	return nil
+}
+
+// Plan is like Run, but returns what would be written instead of writing the
+// output.
+func (k *KoboPatch) Plan() (*Plan, error) {
+	return k.PlanContext(context.Background())
+}
+
+// PlanContext is like Plan, but stops if ctx is cancelled.
+func (k *KoboPatch) PlanContext(ctx context.Context) (*Plan, error) {
+	k.ctx = ctx
+	defer func() { k.ctx = nil }()
+
+	k.PlanInit()
+	if err := k.apply(); err != nil {
+		return nil, err
+	}
+	p, err := k.WritePlan()
+	if err != nil {
+		return nil, wrap(err, "could not generate plan")
+	}
+	return p, nil
+}
+
+// apply runs the steps which add to the output.
+func (k *KoboPatch) apply() error {
+	if err := k.ApplyPatches(); err != nil {
+		return wrap(err, "could not apply patches")
+	}
+	if err := k.ApplyTranslations(); err != nil {
+		return wrap(err, "could not apply translations")
+	}
+	if err := k.ApplyFiles(); err != nil {
+		return wrap(err, "could not apply additional files")
+	}
+	if err := k.ApplySymlinks(); err != nil {
+		return wrap(err, "could not apply additional symlinks")
+	}
+	return nil
+}
+
+// context returns the context for the current call to RunContext,
+// PlanContext, or RunPatchTestsContext, or context.Background if there isn't
+// one.
+func (k *KoboPatch) context() context.Context {
+	if k.ctx == nil {
+		return context.Background()
+	}
+	return k.ctx
+}
+
+// inputs returns the filesystem to read the files referenced by the config
+// from, which accepts the paths from the config as-is.
+func (k *KoboPatch) inputs() fs.FS {
+	if k.opt.FS != nil {
+		return cleanFS{k.opt.FS}
+	}
+	return dirFS(k.opt.Dir)
+}
+
+// outPath resolves an output path from the config.
+func (k *KoboPatch) outPath(p string) string {
+	if k.opt.Dir == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(k.opt.Dir, p)
+}
+
+// readLinkFS is implemented by filesystems which support reading symlinks
+// (this matches fs.ReadLinkFS from newer Go versions).
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+// dirFS is the OS filesystem with relative paths resolved against a directory.
+// Unlike os.DirFS, absolute paths and paths outside the directory are allowed
+// (and the paths use the OS separator), since configs can contain them.
+type dirFS string
+
+func (d dirFS) path(name string) string {
+	if d == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(string(d), name)
+}
+
+// Open implements fs.FS.
+func (d dirFS) Open(name string) (fs.File, error) {
+	f, err := os.Open(d.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stat implements fs.StatFS.
+func (d dirFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(d.path(name))
+}
+
+// Glob implements fs.GlobFS using the OS path syntax.
+func (d dirFS) Glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(d.path(pattern))
+	if err != nil || d == "" || filepath.IsAbs(pattern) {
+		return matches, err
+	}
+	for i, m := range matches {
+		if matches[i], err = filepath.Rel(string(d), m); err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// ReadLink implements readLinkFS.
+func (d dirFS) ReadLink(name string) (string, error) {
+	return os.Readlink(d.path(name))
+}
+
+// cleanFS cleans the paths from the config (e.g. ./src/nickel.yaml) into valid
+// fs.FS paths before passing them to the underlying filesystem.
+type cleanFS struct {
+	fs fs.FS
+}
+
+func (c cleanFS) path(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+// Open implements fs.FS.
+func (c cleanFS) Open(name string) (fs.File, error) {
+	return c.fs.Open(c.path(name))
+}
+
+// Stat implements fs.StatFS.
+func (c cleanFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(c.fs, c.path(name))
+}
+
+// Glob implements fs.GlobFS.
+func (c cleanFS) Glob(pattern string) ([]string, error) {
+	return fs.Glob(c.fs, c.path(pattern))
+}
+
+// ReadLink implements readLinkFS.
+func (c cleanFS) ReadLink(name string) (string, error) {
+	if l, ok := c.fs.(readLinkFS); ok {
+		return l.ReadLink(c.path(name))
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fmt.Errorf("not supported by %T", c.fs)}
+}
+
+// walkFS is like fs.WalkDir, but root can be a path from the config, and the
+// slash-separated path relative to it is also passed to fn.
+func walkFS(fsys fs.FS, root string, fn func(name, rel string, d fs.DirEntry, err error) error) error {
+	root = path.Clean(filepath.ToSlash(root)) // since fs.WalkDir cleans the paths it passes to fn
+	return fs.WalkDir(fsys, root, func(name string, d fs.DirEntry, err error) error {
+		rel := "."
+		if name != root {
+			if root == "." {
+				rel = name
+			} else {
+				rel = strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+			}
+		}
+		return fn(name, rel, d, err)
+	})
+}
+
+// readerAtSeeker is a file which can be used for reading a zip.
+type readerAtSeeker interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// asReaderAtSeeker returns f if it supports random access, or reads it into
+// memory otherwise.
+func asReaderAtSeeker(f fs.File) (readerAtSeeker, error) {
+	if r, ok := f.(readerAtSeeker); ok {
+		return r, nil
+	}
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf), nil
+}
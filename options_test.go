@@ -0,0 +1,146 @@
+package kobopatch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRun(t *testing.T) {
+	fw, err := ioutil.ReadFile(testFirmware(t, "usr/local/Kobo/libtest.so", "hello world"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	files := map[string]string{
+		"fw.zip":           string(fw),
+		"src/libtest.yaml": "Test:\n  - Enabled: yes\n  - FindReplaceString: {Find: \"hello\", Replace: \"HELLO\"}\n",
+		"src/extra/a.txt":  "extra",
+	}
+	conf := "version: 4.20.14622\npatchFormat: kobopatch\nin: fw.zip\nout: out/KoboRoot.tgz\nlog: out/log.txt\npatches:\n  src/libtest.yaml: usr/local/Kobo/libtest.so\nfiles:\n  ./src/extra: usr/local/extra\n"
+	exp := []string{"./usr/local/Kobo/libtest.so", "HELLO world", "./usr/local/extra/", "", "./usr/local/extra/a.txt", "extra"}
+
+	t.Run("FS", func(t *testing.T) {
+		mfs := fstest.MapFS{}
+		for fn, buf := range files {
+			mfs[fn] = &fstest.MapFile{Data: []byte(buf), Mode: 0644}
+		}
+
+		var out, log bytes.Buffer
+		k := New(Options{FS: mfs, Output: &out, Log: &log})
+		if err := k.LoadConfig(strings.NewReader(conf)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := k.Run(); err != nil {
+			t.Fatalf("unexpected error: %v\n%s", err, log.String())
+		}
+
+		fn := filepath.Join(t.TempDir(), "KoboRoot.tgz")
+		if err := ioutil.WriteFile(fn, out.Bytes(), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if act := readTGZ(t, fn); fmt.Sprint(act) != fmt.Sprint(exp) {
+			t.Errorf("expected output %q, got %q", exp, act)
+		}
+		if m := k.Manifest(); m == nil || len(m.Entries) != 3 {
+			t.Errorf("expected manifest with 3 entries, got %+v", m)
+		}
+		if _, err := os.Stat("out"); err == nil {
+			t.Errorf("expected nothing to be written to the current directory")
+		}
+	})
+
+	t.Run("Dir", func(t *testing.T) {
+		td := t.TempDir()
+		for fn, buf := range files {
+			if err := os.MkdirAll(filepath.Join(td, filepath.Dir(fn)), 0755); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(td, fn), []byte(buf), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := os.Mkdir(filepath.Join(td, "out"), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var log bytes.Buffer
+		k := New(Options{Dir: td, Log: &log})
+		if err := k.LoadConfig(strings.NewReader(conf)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := k.Run(); err != nil {
+			t.Fatalf("unexpected error: %v\n%s", err, log.String())
+		}
+
+		if act := readTGZ(t, filepath.Join(td, "out", "KoboRoot.tgz")); fmt.Sprint(act) != fmt.Sprint(exp) {
+			t.Errorf("expected output %q, got %q", exp, act)
+		}
+		for _, fn := range []string{"KoboRoot.tgz.manifest.json", "KoboRoot.tgz.sha256sums"} {
+			if _, err := os.Stat(filepath.Join(td, "out", fn)); err != nil {
+				t.Errorf("expected %s to be written: %v", fn, err)
+			}
+		}
+	})
+}
+
+func TestRunContext(t *testing.T) {
+	td := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(td, "libtest.yaml"), []byte("Test:\n  - Enabled: yes\n  - FindReplaceString: {Find: \"hello\", Replace: \"HELLO\"}\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conf := &Config{
+		Version:     "4.20.14622",
+		In:          testFirmware(t, "usr/local/Kobo/libtest.so", "hello world"),
+		Out:         filepath.Join(td, "KoboRoot.tgz"),
+		PatchFormat: "kobopatch",
+		Patches:     map[string]string{"libtest.yaml": "usr/local/Kobo/libtest.so"},
+	}
+
+	t.Run("Progress", func(t *testing.T) {
+		var last Progress
+		var patches []string
+		k := New(Options{Dir: td, Progress: func(p Progress) {
+			if p.Patch != "" && (len(patches) == 0 || patches[len(patches)-1] != p.Entry+":"+p.Patch) {
+				patches = append(patches, p.Entry+":"+p.Patch)
+			}
+			last = p
+		}})
+		k.Config = conf
+		if err := k.RunContext(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if last.Total == 0 || last.Read != last.Total {
+			t.Errorf("expected all of the firmware to be read, got %+v", last)
+		}
+		if exp := []string{"./usr/local/Kobo/libtest.so:Test"}; fmt.Sprint(patches) != fmt.Sprint(exp) {
+			t.Errorf("expected patches %q to be reported, got %q", exp, patches)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		k := New(Options{Dir: td})
+		k.Config = conf
+		if err := os.Remove(conf.Out); err != nil && !os.IsNotExist(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := k.RunContext(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+		if _, err := os.Stat(conf.Out); err == nil {
+			t.Errorf("expected output to be removed")
+		}
+		if _, err := k.RunPatchTestsContext(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	})
+}
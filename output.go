@@ -0,0 +1,171 @@
+package kobopatch
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// tgzWriter streams a tar.gz to a temporary file, which is renamed to the
+// destination when it is closed. If dest is empty, the output is discarded.
+// The sizes of the entries are tracked as they are written so the output can
+// be checked for consistency without reading it back, and the entries are
+// recorded (with checksums) for the manifest.
+type tgzWriter struct {
+	dest string
+	f    *os.File
+
+	tw    *tar.Writer
+	gz    *gzip.Writer
+	tsize *countWriter // uncompressed tar
+	zsize *countWriter // compressed tar
+
+	hdrSize  int64 // sum of the sizes in the headers
+	dataSize int64 // sum of the data written
+
+	entries []*ManifestEntry
+	esum    hash.Hash // sha256 of the current entry's data
+	zsum    hash.Hash // sha256 of the compressed tar
+}
+
+// newTGZWriter creates a new tgzWriter.
+func newTGZWriter(dest string) (*tgzWriter, error) {
+	if dest == "" {
+		return newTGZStream(ioutil.Discard), nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("could not create temp file: %w", err)
+	}
+	t := newTGZStream(f)
+	t.dest, t.f = dest, f
+	return t, nil
+}
+
+// newTGZStream creates a new tgzWriter which writes directly to w. Nothing is
+// done with w when it is closed or aborted.
+func newTGZStream(w io.Writer) *tgzWriter {
+	t := &tgzWriter{zsum: sha256.New()}
+	t.zsize = &countWriter{w: io.MultiWriter(w, t.zsum)}
+	t.gz = gzip.NewWriter(t.zsize) // note: the gzip header is left without a name or mtime, so it is always the same
+	t.tsize = &countWriter{w: t.gz}
+	t.tw = tar.NewWriter(t.tsize)
+	return t
+}
+
+// WriteHeader writes a tar header.
+func (t *tgzWriter) WriteHeader(h *tar.Header) error {
+	if err := t.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	t.hdrSize += h.Size
+	t.endEntry()
+	t.entries = append(t.entries, newManifestEntry(h))
+	t.esum = sha256.New()
+	return nil
+}
+
+// Write writes data for the current tar entry.
+func (t *tgzWriter) Write(buf []byte) (int, error) {
+	n, err := t.tw.Write(buf)
+	t.dataSize += int64(n)
+	if t.esum != nil {
+		t.esum.Write(buf[:n])
+	}
+	return n, err
+}
+
+// endEntry records the checksum of the current entry, if any.
+func (t *tgzWriter) endEntry() {
+	if t.esum != nil && len(t.entries) != 0 {
+		if e := t.entries[len(t.entries)-1]; e.Type == ManifestTypeFile {
+			e.SHA256 = fmt.Sprintf("%x", t.esum.Sum(nil))
+		}
+	}
+	t.esum = nil
+}
+
+// Close finalizes the tar.gz, checks that the total size of the entries is
+// expected, and moves it to the destination. If it fails, the temp file is
+// removed.
+func (t *tgzWriter) Close(expected int64) error {
+	t.endEntry()
+	if err := t.tw.Close(); err != nil {
+		t.Abort()
+		return fmt.Errorf("could not finalize tar: %w", err)
+	}
+	if err := t.gz.Close(); err != nil {
+		t.Abort()
+		return fmt.Errorf("could not finalize gz: %w", err)
+	}
+	if t.hdrSize != expected || t.dataSize != expected {
+		t.Abort()
+		return fmt.Errorf("size mismatch: expected %d, got %d in headers and %d written (please report this)", expected, t.hdrSize, t.dataSize)
+	}
+	if t.f == nil {
+		return nil
+	}
+	if err := t.f.Chmod(0644); err != nil {
+		t.Abort()
+		return fmt.Errorf("could not set permissions: %w", err)
+	}
+	if err := t.f.Sync(); err != nil {
+		t.Abort()
+		return fmt.Errorf("could not sync output: %w", err)
+	}
+	if err := t.f.Close(); err != nil {
+		t.Abort()
+		return fmt.Errorf("could not close output: %w", err)
+	}
+	if err := os.Rename(t.f.Name(), t.dest); err != nil {
+		t.Abort()
+		return fmt.Errorf("could not move output to destination: %w", err)
+	}
+	t.f = nil
+	return nil
+}
+
+// Abort removes the temp file, if any. It is safe to call Abort more than
+// once, or after Close.
+func (t *tgzWriter) Abort() {
+	if t == nil || t.f == nil {
+		return
+	}
+	t.f.Close()
+	os.Remove(t.f.Name())
+	t.f = nil
+}
+
+// Size returns the uncompressed and compressed sizes written so far.
+func (t *tgzWriter) Size() (int64, int64) {
+	return t.tsize.n, t.zsize.n
+}
+
+// Entries returns the entries written so far. The checksum of the last one is
+// only set after Close.
+func (t *tgzWriter) Entries() []*ManifestEntry {
+	return t.entries
+}
+
+// Sum returns the sha256 of the compressed output written so far.
+func (t *tgzWriter) Sum() string {
+	return fmt.Sprintf("%x", t.zsum.Sum(nil))
+}
+
+// countWriter counts the bytes written to an io.Writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(buf []byte) (int, error) {
+	n, err := c.w.Write(buf)
+	c.n += int64(n)
+	return n, err
+}
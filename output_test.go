@@ -0,0 +1,78 @@
+package kobopatch
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTGZWriter(t *testing.T) {
+	td := t.TempDir()
+	dest := filepath.Join(td, "KoboRoot.tgz")
+
+	write := func(t *testing.T, expected int64) error {
+		w, err := newTGZWriter(dest)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := w.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./test", Size: 4}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := w.Write([]byte("test")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return w.Close(expected)
+	}
+
+	t.Run("SizeMismatch", func(t *testing.T) {
+		if err := write(t, 5); err == nil {
+			t.Errorf("expected size mismatch error")
+		}
+		if fs, _ := ioutil.ReadDir(td); len(fs) != 0 {
+			t.Errorf("expected temp file to be removed, found %s", fs[0].Name())
+		}
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		if err := write(t, 4); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fs, _ := ioutil.ReadDir(td); len(fs) != 1 || fs[0].Name() != "KoboRoot.tgz" {
+			t.Fatalf("expected only the output in the directory, got %v", fs)
+		}
+
+		f, err := os.Open(dest)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer f.Close()
+
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tr := tar.NewReader(zr)
+		h, err := tr.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf, _ := ioutil.ReadAll(tr); h.Name != "./test" || string(buf) != "test" {
+			t.Errorf("unexpected entry %s: %q", h.Name, buf)
+		}
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		w, err := newTGZWriter(dest)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		w.Abort()
+		w.Abort()
+		if fs, _ := ioutil.ReadDir(td); len(fs) != 1 {
+			t.Errorf("expected temp file to be removed and output to be kept, got %v", fs)
+		}
+	})
+}
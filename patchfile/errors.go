@@ -0,0 +1,48 @@
+package patchfile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PatchError is an error from parsing, validating, or applying a patch. Fields
+// which aren't known are left empty. The file isn't included in the message,
+// since it is usually already part of the context the error is displayed in.
+type PatchError struct {
+	File        string // the patch file, if known
+	Patch       string // the name of the patch
+	Line        int    // the line of the instruction (or the patch, if Instruction is 0)
+	Instruction int    // the index of the instruction in the patch, starting at 1
+	Err         error
+}
+
+// Error implements error.
+func (e *PatchError) Error() string {
+	var b strings.Builder
+	if e.Patch != "" {
+		fmt.Fprintf(&b, "patch %#v: ", e.Patch)
+	}
+	if e.Line != 0 {
+		fmt.Fprintf(&b, "line %d: ", e.Line)
+	}
+	if e.Instruction != 0 {
+		fmt.Fprintf(&b, "inst %d: ", e.Instruction)
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+// Unwrap returns the underlying error.
+func (e *PatchError) Unwrap() error {
+	return e.Err
+}
+
+// SetErrorFile sets the File of the PatchError in err, if any, and returns err.
+func SetErrorFile(err error, filename string) error {
+	var pe *PatchError
+	if errors.As(err, &pe) && pe.File == "" {
+		pe.File = filename
+	}
+	return err
+}
@@ -0,0 +1,18 @@
+package patchfile
+
+// PatchInfo describes a patch in a PatchSet.
+type PatchInfo struct {
+	Name         string
+	Enabled      bool
+	Description  string   // may be empty
+	Groups       []string // the PatchGroups the patch is a member of
+	Instructions int      // the number of instructions which modify the binary
+	Line         int      // the line the patch starts at, or 0 if unknown
+}
+
+// Inspector is implemented by a PatchSet which can describe its patches. It is
+// the only way to list the patches in a PatchSet.
+type Inspector interface {
+	// Patches returns information about each patch, sorted by name.
+	Patches() []PatchInfo
+}
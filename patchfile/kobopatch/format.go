@@ -0,0 +1,435 @@
+package kobopatch
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format parses a patch file and returns it in the canonical style. The order
+// of the patches and instructions is kept, and comments are preserved. The
+// canonical style is:
+//   - patches are separated by a blank line, and instructions are indented by
+//     two spaces
+//   - the keys of an instruction are in the same order as the fields of the
+//     struct for the instruction
+//   - FindH and ReplaceH are written as space-separated bytes
+//   - a FlexAbsOffset is written inline if it only has an Offset or Sym, and
+//     as a flow mapping otherwise
+//   - folded block scalars are written as literal ones
+//
+// To catch mistakes, the formatted patch file is checked to be equivalent to
+// the original one.
+func Format(buf []byte) ([]byte, error) {
+	ops, err := Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return buf, nil // nothing but comments
+	}
+	if err := checkNode(&doc); err != nil {
+		return nil, err
+	}
+
+	root := doc.Content[0]
+	for i := 1; i < len(root.Content); i += 2 {
+		for _, inst := range root.Content[i].Content {
+			for j := 0; j+1 < len(inst.Content); j += 2 {
+				if f, ok := reflect.TypeOf(Instruction{}).FieldByName(inst.Content[j].Value); ok {
+					formatNode(inst.Content[j+1], f.Type)
+				}
+			}
+		}
+	}
+
+	p := &printer{col0: map[string]bool{}}
+	for _, l := range strings.Split(string(buf), "\n") {
+		if strings.HasPrefix(l, "#") {
+			p.col0[strings.TrimRight(l, " \t\r")] = true
+		}
+	}
+	p.document(&doc)
+	out := p.buf.Bytes()
+
+	nps, err := Parse(out)
+	if err != nil {
+		return nil, fmt.Errorf("formatted patch file is invalid (this is a bug): %w", err)
+	}
+	if !equivalent(ops.(*PatchSet), nps.(*PatchSet)) {
+		return nil, errors.New("formatted patch file is not equivalent to the original (this is a bug)")
+	}
+	return out, nil
+}
+
+// checkNode checks for features of YAML which can't be formatted.
+func checkNode(n *yaml.Node) error {
+	if n.Kind == yaml.AliasNode || n.Anchor != "" {
+		return fmt.Errorf("line %d: anchors and aliases are not supported", n.Line)
+	}
+	for _, c := range n.Content {
+		if err := checkNode(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatNode canonicalizes the node for a value of type t.
+func formatNode(n *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := make([]reflect.StructField, len(n.Content)/2)
+		idx := make([]int, len(n.Content)/2)
+		for i := range fields {
+			idx[i] = len(n.Content) // unknown keys go last
+			for j := 0; j < t.NumField(); j++ {
+				if strings.Split(t.Field(j).Tag.Get("yaml"), ",")[0] == n.Content[i*2].Value {
+					fields[i], idx[i] = t.Field(j), j
+					break
+				}
+			}
+		}
+		pairs := make([]int, len(fields))
+		for i := range pairs {
+			pairs[i] = i
+		}
+		sort.SliceStable(pairs, func(a, b int) bool {
+			return idx[pairs[a]] < idx[pairs[b]]
+		})
+		content := make([]*yaml.Node, 0, len(n.Content))
+		for _, i := range pairs {
+			k, v := n.Content[i*2], n.Content[i*2+1]
+			if fields[i].Type != nil {
+				formatNode(v, fields[i].Type)
+			}
+			if k.Value == "FindH" || k.Value == "ReplaceH" {
+				formatHex(v)
+			}
+			content = append(content, k, v)
+		}
+		n.Content = content
+	case n.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for _, c := range n.Content {
+			formatNode(c, t.Elem())
+		}
+	}
+	if t == reflect.TypeOf(FlexAbsOffset{}) || t == reflect.TypeOf(BaseAddress{}) {
+		formatFlexAbsOffset(n)
+	}
+}
+
+// formatHex writes a hex string as space-separated bytes. It is left as-is if
+// it isn't valid.
+func formatHex(n *yaml.Node) {
+	if n.Kind != yaml.ScalarNode {
+		return
+	}
+	s := strings.ReplaceAll(n.Value, " ", "")
+	if _, err := hex.DecodeString(s); err != nil || s == "" {
+		return
+	}
+	b := make([]string, len(s)/2)
+	for i := range b {
+		b[i] = s[i*2 : i*2+2]
+	}
+	n.Value, n.Tag, n.Style = strings.Join(b, " "), "!!str", 0
+}
+
+// formatFlexAbsOffset writes a FlexAbsOffset inline if it only has an Offset
+// or a Sym which can't be mistaken for an Offset, and as a flow mapping
+// otherwise.
+func formatFlexAbsOffset(n *yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+	if len(n.Content) == 2 && n.Content[1].Kind == yaml.ScalarNode {
+		k, v := n.Content[0], n.Content[1]
+		var offset int32
+		isOffset := v.DecodeStrict(&offset) == nil
+		if (k.Value == "Offset" && isOffset) || (k.Value == "Sym" && !isOffset) {
+			s := *v
+			s.HeadComment = joinComments(n.HeadComment, k.HeadComment, v.HeadComment)
+			s.LineComment = joinComments(n.LineComment, k.LineComment, v.LineComment)
+			s.FootComment = joinComments(n.FootComment, k.FootComment, v.FootComment)
+			*n = s
+			return
+		}
+	}
+	n.Style = yaml.FlowStyle
+}
+
+func joinComments(c ...string) string {
+	var s []string
+	for _, x := range c {
+		if x != "" {
+			s = append(s, x)
+		}
+	}
+	return strings.Join(s, "\n")
+}
+
+// equivalent checks if two PatchSets are the same, ignoring the differences
+// which Format can make.
+func equivalent(a, b *PatchSet) bool {
+	if len(a.parsed) != len(b.parsed) {
+		return false
+	}
+	for name, pa := range a.parsed {
+		pb, ok := b.parsed[name]
+		if !ok || pa.Enabled != pb.Enabled || pa.Description != pb.Description || !reflect.DeepEqual(pa.PatchGroups, pb.PatchGroups) || len(pa.Instructions) != len(pb.Instructions) {
+			return false
+		}
+		for i := range pa.Instructions {
+			if !reflect.DeepEqual(canonicalInstruction(pa.Instructions[i].Instruction), canonicalInstruction(pb.Instructions[i].Instruction)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func canonicalInstruction(inst PatchableInstruction) PatchableInstruction {
+	hex := func(s *string) *string {
+		if s == nil {
+			return nil
+		}
+		x := strings.ReplaceAll(*s, " ", "")
+		return &x
+	}
+	switch i := inst.(type) {
+	case BaseAddress:
+		i.Inline = false
+		return i
+	case ReplaceBytes:
+		i.FindH, i.ReplaceH = hex(i.FindH), hex(i.ReplaceH)
+		for _, f := range []**FlexAbsOffset{&i.Base, &i.FindInstBLX, &i.ReplaceInstBLX, &i.FindInstBW, &i.ReplaceInstBW} {
+			if *f != nil {
+				c := **f
+				c.Inline = false
+				*f = &c
+			}
+		}
+		return i
+	case ReplaceBytesAtSymbol:
+		i.FindH, i.ReplaceH = hex(i.FindH), hex(i.ReplaceH)
+		return i
+	case ReplaceBytesNOP:
+		i.FindH = hex(i.FindH)
+		return i
+	}
+	return inst
+}
+
+// printer writes the nodes of a patch file in the canonical style.
+type printer struct {
+	buf  bytes.Buffer
+	col0 map[string]bool // comment lines which weren't indented in the source
+}
+
+func (p *printer) document(doc *yaml.Node) {
+	root := doc.Content[0]
+	if doc.HeadComment != "" {
+		p.comment(doc.HeadComment, 0)
+		p.buf.WriteByte('\n')
+	}
+	p.comment(root.HeadComment, 0)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if i != 0 {
+			p.buf.WriteByte('\n')
+		}
+		p.pair(root.Content[i], root.Content[i+1], 0, false)
+	}
+	p.comment(root.FootComment, 0)
+	if doc.FootComment != "" {
+		p.buf.WriteByte('\n')
+		p.comment(doc.FootComment, 0)
+	}
+}
+
+// comment writes a head or foot comment. Lines which weren't indented in the
+// source are kept that way.
+func (p *printer) comment(c string, indent int) {
+	if c = strings.Trim(c, "\n"); c == "" {
+		return
+	}
+	for _, l := range strings.Split(c, "\n") {
+		if l = strings.TrimSpace(l); l == "" {
+			p.buf.WriteByte('\n')
+			continue
+		}
+		if !p.col0[l] {
+			p.buf.WriteString(strings.Repeat(" ", indent))
+		}
+		p.buf.WriteString(l)
+		p.buf.WriteByte('\n')
+	}
+}
+
+// pair writes a key and value of a block mapping with the key at indent. If
+// dash is true, the key is preceded by the dash of a sequence item.
+func (p *printer) pair(k, v *yaml.Node, indent int, dash bool) {
+	ci := indent
+	if dash {
+		ci -= 2
+	}
+	p.comment(k.HeadComment, ci)
+	p.comment(v.HeadComment, ci)
+	p.buf.WriteString(strings.Repeat(" ", ci))
+	if dash {
+		p.buf.WriteString("- ")
+	}
+	p.buf.WriteString(p.scalar(k, false))
+	p.buf.WriteByte(':')
+	p.value(v, indent, k.LineComment)
+	p.comment(k.FootComment, ci)
+	p.comment(v.FootComment, ci)
+}
+
+// item writes an item of a block sequence with the dash at indent.
+func (p *printer) item(n *yaml.Node, indent int) {
+	p.comment(n.HeadComment, indent)
+	if n.Kind == yaml.MappingNode && n.Style&yaml.FlowStyle == 0 && len(n.Content) != 0 {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			p.pair(n.Content[i], n.Content[i+1], indent+2, i == 0)
+		}
+	} else {
+		p.buf.WriteString(strings.Repeat(" ", indent))
+		p.buf.WriteByte('-')
+		p.value(n, indent, "")
+	}
+	p.comment(n.FootComment, indent)
+}
+
+// value writes the rest of the line after a key or dash at indent, and the
+// lines for the value after it. The comments are written at the end of the
+// line.
+func (p *printer) value(n *yaml.Node, indent int, lc ...string) {
+	lc = append(lc, n.LineComment)
+	switch {
+	case n.Kind == yaml.ScalarNode && n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0:
+		p.buf.WriteString(" |")
+		v := n.Value
+		for _, l := range strings.Split(v, "\n") {
+			if l != "" {
+				if l[0] == ' ' {
+					p.buf.WriteByte('2')
+				}
+				break
+			}
+		}
+		switch {
+		case !strings.HasSuffix(v, "\n"):
+			p.buf.WriteByte('-')
+		case strings.HasSuffix(v, "\n\n"):
+			p.buf.WriteByte('+')
+			v = v[:len(v)-1]
+		default:
+			v = v[:len(v)-1]
+		}
+		p.lineComment(lc...)
+		if n.Value != "" {
+			for _, l := range strings.Split(v, "\n") {
+				if l != "" {
+					p.buf.WriteString(strings.Repeat(" ", indent+2))
+					p.buf.WriteString(l)
+				}
+				p.buf.WriteByte('\n')
+			}
+		}
+	case n.Kind == yaml.ScalarNode:
+		if s := p.scalar(n, false); s != "" {
+			p.buf.WriteByte(' ')
+			p.buf.WriteString(s)
+		}
+		p.lineComment(lc...)
+	case n.Style&yaml.FlowStyle != 0:
+		p.buf.WriteByte(' ')
+		p.buf.WriteString(p.flow(n, &lc))
+		p.lineComment(lc...)
+	case n.Kind == yaml.MappingNode:
+		p.lineComment(lc...)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			p.pair(n.Content[i], n.Content[i+1], indent+2, false)
+		}
+	case n.Kind == yaml.SequenceNode:
+		p.lineComment(lc...)
+		for _, c := range n.Content {
+			p.item(c, indent+2)
+		}
+	default:
+		p.lineComment(lc...)
+	}
+}
+
+// lineComment writes the comments and ends the line.
+func (p *printer) lineComment(lc ...string) {
+	for _, c := range lc {
+		for _, l := range strings.Split(c, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				p.buf.WriteByte(' ')
+				p.buf.WriteString(l)
+			}
+		}
+	}
+	p.buf.WriteByte('\n')
+}
+
+// flow returns a node in the flow style. The comments of the nodes inside it
+// are appended to lc.
+func (p *printer) flow(n *yaml.Node, lc *[]string) string {
+	var s []string
+	for i, c := range n.Content {
+		*lc = append(*lc, c.HeadComment, c.LineComment, c.FootComment)
+		switch {
+		case n.Kind == yaml.MappingNode && i%2 == 0:
+			continue
+		case n.Kind == yaml.MappingNode:
+			s = append(s, p.scalar(n.Content[i-1], true)+": "+p.flow(c, lc))
+		default:
+			s = append(s, p.flow(c, lc))
+		}
+	}
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "{" + strings.Join(s, ", ") + "}"
+	case yaml.SequenceNode:
+		return "[" + strings.Join(s, ", ") + "]"
+	default:
+		return p.scalar(n, true)
+	}
+}
+
+// scalar returns a single-line scalar in the same style as the source if
+// possible, or double-quoted otherwise.
+func (p *printer) scalar(n *yaml.Node, flow bool) string {
+	var tag string
+	if n.Style&yaml.TaggedStyle != 0 {
+		tag = n.Tag + " "
+	}
+	switch {
+	case strings.Contains(n.Value, "\n"):
+	case n.Style&yaml.SingleQuotedStyle != 0:
+		return tag + "'" + strings.ReplaceAll(n.Value, "'", "''") + "'"
+	case n.Style&(yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) != 0:
+	case flow && strings.ContainsAny(n.Value, ",[]{}"):
+	default:
+		return tag + n.Value
+	}
+	return tag + strconv.Quote(n.Value)
+}
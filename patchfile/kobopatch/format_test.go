@@ -0,0 +1,124 @@
+package kobopatch
+
+import (
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	for _, c := range []struct {
+		what, in, out string
+	}{
+		{"KeyOrder", `
+A:
+- Enabled: yes
+- ReplaceBytes: {ReplaceH: 00 BF, Offset: 0x10, FindH: 00 46}
+- FindReplaceString:
+    Replace: b
+    Find: a
+`, `A:
+  - Enabled: yes
+  - ReplaceBytes: {Offset: 0x10, FindH: 00 46, ReplaceH: 00 BF}
+  - FindReplaceString:
+      Find: a
+      Replace: b
+`},
+		{"Hex", `
+A:
+  - Enabled: yes
+  - ReplaceBytes: {FindH: "0046  ", ReplaceH: 00bf}
+  - ReplaceBytes: {FindH: 0, ReplaceH: 1}
+`, `A:
+  - Enabled: yes
+  - ReplaceBytes: {FindH: 00 46, ReplaceH: 00 bf}
+  - ReplaceBytes: {FindH: 0, ReplaceH: 1}
+`},
+		{"FlexAbsOffset", `
+A:
+  - Enabled: yes
+  - BaseAddress: {Sym: _ZN3FooC1Ev}
+  - BaseAddress:
+      Offset: 0x20
+  - BaseAddress: {Sym: "123"}
+  - BaseAddress: "123"
+  - BaseAddress:
+      Rel: 4
+      SymPLT: "a, b"
+  - ReplaceBytes:
+      Base: {Sym: _ZN3FooC1Ev}
+      FindInstBLX: {SymPLT: _ZN3BarC1Ev}
+      ReplaceInstNOP: true
+`, `A:
+  - Enabled: yes
+  - BaseAddress: _ZN3FooC1Ev
+  - BaseAddress: 0x20
+  - BaseAddress: "123"
+  - BaseAddress: "123"
+  - BaseAddress: {SymPLT: "a, b", Rel: 4}
+  - ReplaceBytes:
+      Base: _ZN3FooC1Ev
+      FindInstBLX: {SymPLT: _ZN3BarC1Ev}
+      ReplaceInstNOP: true
+`},
+		{"Comments", `# Header
+
+# A
+A:
+    # enabled
+    - Enabled: no # line
+    - Description: >
+        Folded
+        text.
+    # base
+    - BaseAddress: {Sym: _ZN3FooC1Ev} # sym
+    - ReplaceZlibGroup:
+        Replacements:
+        - {Replace: b, Find: a}
+B:
+    - Enabled: yes
+    - FindReplaceString: {Find: 'it''s', Replace: "\x00"}
+# footer
+`, `# Header
+
+# A
+A:
+  # enabled
+  - Enabled: no # line
+  - Description: |
+      Folded text.
+  # base
+  - BaseAddress: _ZN3FooC1Ev # sym
+  - ReplaceZlibGroup:
+      Replacements:
+        - {Find: a, Replace: b}
+
+B:
+  - Enabled: yes
+  - FindReplaceString: {Find: 'it''s', Replace: "\x00"}
+# footer
+`},
+	} {
+		t.Run(c.what, func(t *testing.T) {
+			out, err := Format([]byte(c.in))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(out) != c.out {
+				t.Errorf("expected:\n%s\ngot:\n%s", c.out, out)
+			}
+			if again, err := Format(out); err != nil {
+				t.Errorf("unexpected error formatting output: %v", err)
+			} else if string(again) != string(out) {
+				t.Errorf("expected formatting to be idempotent, got:\n%s", again)
+			}
+		})
+	}
+
+	for _, in := range []string{
+		"A:\n  - Enabled: yes\n  - NotAnInstruction: 1\n",
+		"A:\n  - Enabled: yes\n  - FindReplaceString: &x {Find: a, Replace: b}\n",
+	} {
+		if _, err := Format([]byte(in)); err == nil {
+			t.Errorf("expected error formatting %q", in)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package kobopatch
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"reflect"
 	"sort"
@@ -19,6 +20,7 @@ type PatchSet struct {
 // cannot be re-marshaled directly (use the PatchNode and InstructionNode for
 // that).
 type parsedPatch struct {
+	Line         int
 	Enabled      bool
 	Description  string
 	PatchGroups  []string
@@ -33,7 +35,28 @@ type parsedInstruction struct {
 }
 
 func init() {
-	patchfile.RegisterFormat("kobopatch", Parse)
+	patchfile.Register(patchfile.Format{
+		Name:       "kobopatch",
+		Extensions: []string{".yaml", ".yml"},
+		Detect:     Detect,
+		Parse:      Parse,
+		Formatter:  Format,
+	})
+}
+
+// Detect reports whether buf looks like a kobopatch patch file (i.e. it is a
+// non-empty YAML mapping of sequences).
+func Detect(buf []byte) bool {
+	var psn map[string]yaml.Node
+	if err := yaml.Unmarshal(buf, &psn); err != nil || len(psn) == 0 {
+		return false
+	}
+	for _, node := range psn {
+		if node.Kind != yaml.SequenceNode {
+			return false
+		}
+	}
+	return true
 }
 
 // Parse parses a PatchSet from a buf.
@@ -53,22 +76,26 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 		patchfile.Log("  unmarshaling patch %#v to PatchNode ([]yaml.Node)\n", name)
 		var pn PatchNode
 		if err := node.DecodeStrict(&pn); err != nil {
-			return nil, fmt.Errorf("line %d: patch %#v: %w", node.Line, name, err)
+			return nil, &patchfile.PatchError{Patch: name, Line: node.Line, Err: err}
 		}
 
 		patchfile.Log("  converting to []InstructionNode (map[string]yaml.Node)\n")
 		ns, err := pn.ToInstructionNodes()
 		if err != nil {
-			return nil, fmt.Errorf("line %d: patch %#v: %w", node.Line, name, err)
+			return nil, &patchfile.PatchError{Patch: name, Line: node.Line, Err: err}
 		}
 
 		patchfile.Log("  converting to *parsedPatch\n")
-		ps.parsed[name] = &parsedPatch{}
+		ps.parsed[name] = &parsedPatch{Line: node.Line}
 		for i, instNode := range ns {
 			patchfile.Log("    unmarshaling instruction %d to Instruction\n", i+1)
 			inst, err := instNode.ToInstruction()
 			if err != nil {
-				return nil, fmt.Errorf("line %d: patch %#v: instruction %d: %w", node.Line, name, i+1, err)
+				if pe, ok := err.(*patchfile.PatchError); ok {
+					pe.Patch, pe.Instruction = name, i+1
+					return nil, pe
+				}
+				return nil, &patchfile.PatchError{Patch: name, Line: instNode.Line(node.Line), Instruction: i + 1, Err: err}
 			}
 
 			patchfile.Log("      converting to SingleInstruction...")
@@ -79,7 +106,7 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 				ps.parsed[name].Enabled = bool(sinst.(Enabled))
 			case Description:
 				if ps.parsed[name].Description != "" {
-					return nil, fmt.Errorf("patch %#v: line %d: instruction %d: duplicate Description instruction", name, instNode.Line(node.Line), i+1)
+					return nil, &patchfile.PatchError{Patch: name, Line: instNode.Line(node.Line), Instruction: i + 1, Err: errors.New("duplicate Description instruction")}
 				}
 				ps.parsed[name].Description = string(sinst.(Description))
 			case PatchGroup:
@@ -99,11 +126,11 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 }
 
 // ApplyTo applies a PatchSet to a Patcher.
-func (ps *PatchSet) ApplyTo(pt *patchlib.Patcher) error {
+func (ps *PatchSet) ApplyTo(pt *patchlib.Patcher, obs patchfile.Observer) error {
 	patchfile.Log("validating patch file\n")
 	if err := ps.Validate(); err != nil {
 		err = fmt.Errorf("invalid patch file: %w", err)
-		fmt.Printf("  Error: %v\n", err)
+		patchfile.Notify(obs, patchfile.Event{Type: patchfile.EventError, Err: err})
 		return err
 	}
 
@@ -112,17 +139,22 @@ func (ps *PatchSet) ApplyTo(pt *patchlib.Patcher) error {
 		patch := ps.parsed[name]
 		patchfile.Log("  Patch(%#v) enabled=%t\n", name, patch.Enabled)
 
+		if err := pt.Context().Err(); err != nil {
+			return err
+		}
+
 		patchfile.Log("    ResetBaseAddress()\n")
 		pt.ResetBaseAddress()
 
 		if !patch.Enabled {
 			patchfile.Log("    skipping\n")
-			fmt.Printf("  SKIP  `%s`\n", name)
+			patchfile.Notify(obs, patchfile.Event{Type: patchfile.EventPatchSkip, Patch: name})
 			continue
 		}
 
 		patchfile.Log("    applying\n")
-		fmt.Printf("  APPLY `%s`\n", name)
+		patchfile.Notify(obs, patchfile.Event{Type: patchfile.EventPatchStart, Patch: name})
+		unhook := patchfile.HookInstructions(pt, obs, name)
 
 		patchfile.Log("    looping over instructions\n")
 		for _, inst := range patch.Instructions {
@@ -130,17 +162,61 @@ func (ps *PatchSet) ApplyTo(pt *patchlib.Patcher) error {
 			if err := inst.Instruction.ApplyTo(pt, func(format string, a ...interface{}) {
 				patchfile.Log("        %s\n", fmt.Sprintf(format, a...))
 			}); err != nil {
-				err = fmt.Errorf("could not apply patch %#v: line %d: inst %d: %w", name, inst.Line, inst.Index, err)
+				unhook()
+				err = fmt.Errorf("could not apply %w", &patchfile.PatchError{Patch: name, Line: inst.Line, Instruction: inst.Index, Err: err})
 				patchfile.Log("        %v", err)
-				fmt.Printf("    Error: %v\n", err)
+				patchfile.Notify(obs, patchfile.Event{Type: patchfile.EventError, Patch: name, Err: err})
 				return err
 			}
 		}
+		unhook()
 	}
 
 	return nil
 }
 
+// Patches returns information about each patch, sorted by name.
+func (ps *PatchSet) Patches() []patchfile.PatchInfo {
+	pi := make([]patchfile.PatchInfo, 0, len(ps.parsed))
+	for _, name := range ps.SortedNames() {
+		patch := ps.parsed[name]
+		pi = append(pi, patchfile.PatchInfo{
+			Name:         name,
+			Enabled:      patch.Enabled,
+			Description:  patch.Description,
+			Groups:       append([]string{}, patch.PatchGroups...),
+			Instructions: len(patch.Instructions),
+			Line:         patch.Line,
+		})
+	}
+	return pi
+}
+
+// Lint returns warnings about deprecated instructions in the PatchSet.
+func (ps *PatchSet) Lint() []string {
+	var w []string
+	for _, name := range ps.SortedNames() {
+		for _, inst := range ps.parsed[name].Instructions {
+			pfx := fmt.Sprintf("patch %#v: line %d: inst %d", name, inst.Line, inst.Index)
+			switch i := inst.Instruction.(type) {
+			case FindBaseAddressSymbol:
+				w = append(w, fmt.Sprintf("%s: FindBaseAddressSymbol is deprecated, use BaseAddress instead", pfx))
+			case ReplaceBytesAtSymbol:
+				w = append(w, fmt.Sprintf("%s: ReplaceBytesAtSymbol is deprecated, use ReplaceBytes with Base instead", pfx))
+			case ReplaceBytesNOP:
+				w = append(w, fmt.Sprintf("%s: ReplaceBytesNOP is deprecated, use ReplaceBytes with ReplaceInstNOP instead", pfx))
+			case ReplaceBLX:
+				w = append(w, fmt.Sprintf("%s: ReplaceBLX is deprecated, use ReplaceBytes with FindInstBLX and ReplaceInstBLX instead", pfx))
+			case ReplaceBytes:
+				if i.FindBLX != nil {
+					w = append(w, fmt.Sprintf("%s: ReplaceBytes: FindBLX is deprecated, use FindInstBLX instead", pfx))
+				}
+			}
+		}
+	}
+	return w
+}
+
 // SetEnabled sets the Enabled state of a Patch in a PatchSet.
 func (ps *PatchSet) SetEnabled(patch string, enabled bool) error {
 	if patch, ok := ps.parsed[patch]; ok {
@@ -171,56 +247,58 @@ func (ps *PatchSet) Validate() error {
 		seenPatchGroups := map[string]bool{}
 		for _, g := range patch.PatchGroups {
 			if seenPatchGroups[g] {
-				return fmt.Errorf("patch %#v: duplicate PatchGroup instruction for PatchGroup %#v", name, g)
+				return &patchfile.PatchError{Patch: name, Err: fmt.Errorf("duplicate PatchGroup instruction for PatchGroup %#v", g)}
 			}
 			seenPatchGroups[g] = true
 			if patch.Enabled {
 				if r, ok := usedPatchGroups[g]; ok {
-					return fmt.Errorf("patch %#v: more than one patch enabled in PatchGroup %#v (other patch is %#v)", name, g, r)
+					return &patchfile.PatchError{Patch: name, Err: fmt.Errorf("more than one patch enabled in PatchGroup %#v (other patch is %#v)", g, r)}
 				}
 				usedPatchGroups[g] = name
 			}
 		}
 
 		if len(patch.Instructions) == 0 {
-			return fmt.Errorf("patch %#v: no instructions which modify anything", name)
+			return &patchfile.PatchError{Patch: name, Err: errors.New("no instructions which modify anything")}
 		}
 
 		for _, inst := range patch.Instructions {
-			pfx := fmt.Sprintf("patch %#v: line %d: inst %d", name, inst.Line, inst.Index)
+			instErr := func(err error) error {
+				return &patchfile.PatchError{Patch: name, Line: inst.Line, Instruction: inst.Index, Err: err}
+			}
 			switch inst.Instruction.(type) {
 			case ReplaceBytesNOP:
 				if len(inst.Instruction.(ReplaceBytesNOP).Find)%2 != 0 {
-					return fmt.Errorf("%s: ReplaceBytesNOP: find must be a multiple of 2 to be replaced with 00 46 (MOV r0, r0)", pfx)
+					return instErr(errors.New("ReplaceBytesNOP: find must be a multiple of 2 to be replaced with 00 46 (MOV r0, r0)"))
 				}
 			case ReplaceString:
 				if inst.Instruction.(ReplaceString).MustMatchLength {
 					if d := len(inst.Instruction.(ReplaceString).Replace) - len(inst.Instruction.(ReplaceString).Find); d < 0 {
-						return fmt.Errorf("%s: ReplaceString: replacement string %d chars too short", pfx, -d)
+						return instErr(fmt.Errorf("ReplaceString: replacement string %d chars too short", -d))
 					} else if d > 0 {
-						return fmt.Errorf("%s: ReplaceString: replacement string %d chars too long", pfx, d)
+						return instErr(fmt.Errorf("ReplaceString: replacement string %d chars too long", d))
 					}
 				}
 			case FindReplaceString:
 				if inst.Instruction.(FindReplaceString).MustMatchLength {
 					if d := len(inst.Instruction.(FindReplaceString).Replace) - len(inst.Instruction.(FindReplaceString).Find); d < 0 {
-						return fmt.Errorf("%s: FindReplaceString: replacement string %d chars too short", pfx, -d)
+						return instErr(fmt.Errorf("FindReplaceString: replacement string %d chars too short", -d))
 					} else if d > 0 {
-						return fmt.Errorf("%s: FindReplaceString: replacement string %d chars too long", pfx, d)
+						return instErr(fmt.Errorf("FindReplaceString: replacement string %d chars too long", d))
 					}
 				}
 			case FindZlibHash:
 				if len(inst.Instruction.(FindZlibHash)) != 40 {
-					return fmt.Errorf("%s: FindZlibHash: hash must be 40 chars long", pfx)
+					return instErr(errors.New("FindZlibHash: hash must be 40 chars long"))
 				}
 			case ReplaceZlibGroup:
 				r := inst.Instruction.(ReplaceZlibGroup)
 				if len(r.Replacements) == 0 {
-					return fmt.Errorf("%s: ReplaceZlibGroup: no replacements specified", pfx)
+					return instErr(errors.New("ReplaceZlibGroup: no replacements specified"))
 				}
 				for i, repl := range r.Replacements {
 					if repl.Find == "" || repl.Replace == "" {
-						return fmt.Errorf("%s: ReplaceZlibGroup: replacement %d: Find and Replace must be set", pfx, i+1)
+						return instErr(fmt.Errorf("ReplaceZlibGroup: replacement %d: Find and Replace must be set", i+1))
 					}
 				}
 			}
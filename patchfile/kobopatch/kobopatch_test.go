@@ -0,0 +1,155 @@
+package kobopatch
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/pgaskin/kobopatch/patchfile"
+	"github.com/pgaskin/kobopatch/patchlib"
+)
+
+func TestLint(t *testing.T) {
+	ps, err := Parse([]byte(`
+Old:
+  - Enabled: no
+  - FindBaseAddressSymbol: _ZN3Foo3barEv
+  - ReplaceBytesNOP: {Offset: 4, Find: [0x00, 0x46]}
+  - ReplaceBytes: {Offset: 8, FindBLX: 0x1234, ReplaceH: 00 46 00 46}
+New:
+  - Enabled: yes
+  - BaseAddress: {Sym: _ZN3Foo3barEv}
+  - ReplaceBytes: {Offset: 8, FindInstBLX: {Sym: _ZN3Foo3bazEv}, ReplaceInstNOP: yes}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l, ok := ps.(patchfile.Linter)
+	if !ok {
+		t.Fatalf("expected PatchSet to implement Linter")
+	}
+	exp := []string{
+		`patch "Old": line 4: inst 2: FindBaseAddressSymbol is deprecated, use BaseAddress instead`,
+		`patch "Old": line 5: inst 3: ReplaceBytesNOP is deprecated, use ReplaceBytes with ReplaceInstNOP instead`,
+		`patch "Old": line 6: inst 4: ReplaceBytes: FindBLX is deprecated, use FindInstBLX instead`,
+	}
+	if act := l.Lint(); !reflect.DeepEqual(act, exp) {
+		t.Errorf("expected %q, got %q", exp, act)
+	}
+}
+
+func TestApplyToObserver(t *testing.T) {
+	ps, err := Parse([]byte(`
+A:
+  - Enabled: yes
+  - FindReplaceString: {Find: "hello", Replace: "HELLO"}
+B:
+  - Enabled: no
+  - FindReplaceString: {Find: "world", Replace: "WORLD"}
+C:
+  - Enabled: yes
+  - FindReplaceString: {Find: "nothing", Replace: "NOTHING"}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var act []string
+	pt := patchlib.NewPatcher([]byte("hello world"))
+	pt.Hook(func(offset int32, find, replace []byte) error {
+		act = append(act, fmt.Sprintf("hook %d", offset))
+		return nil
+	})
+	err = ps.ApplyTo(pt, patchfile.ObserverFunc(func(e patchfile.Event) {
+		switch e.Type {
+		case patchfile.EventInstruction:
+			act = append(act, fmt.Sprintf("%s %s %d %q %q", e.Type, e.Patch, e.Offset, e.Find, e.Replace))
+		default:
+			act = append(act, fmt.Sprintf("%s %s", e.Type, e.Patch))
+		}
+	}))
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	exp := []string{
+		`PatchStart A`,
+		`hook 0`,
+		`Instruction A 0 "hello" "HELLO"`,
+		`PatchSkip B`,
+		`PatchStart C`,
+		`Error C`,
+	}
+	if !reflect.DeepEqual(act, exp) {
+		t.Errorf("expected %q, got %q", exp, act)
+	}
+	if pt.GetHook() == nil {
+		t.Errorf("expected the existing hook to be restored")
+	}
+}
+
+func TestPatchError(t *testing.T) {
+	_, err := Parse([]byte(`
+A:
+  - Enabled: yes
+  - NotAnInstruction: 1
+`))
+	var pe *patchfile.PatchError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected PatchError, got %v", err)
+	}
+	if pe.Patch != "A" || pe.Line != 4 || pe.Instruction != 2 {
+		t.Errorf("unexpected PatchError %+v", pe)
+	}
+	if exp := `patch "A": line 4: inst 2: unknown instruction type "NotAnInstruction"`; err.Error() != exp {
+		t.Errorf("expected message %q, got %q", exp, err.Error())
+	}
+
+	ps, err := Parse([]byte(`
+A:
+  - Enabled: yes
+  - BaseAddress: 2
+  - ReplaceBytes: {Offset: 1, FindH: 00 01, ReplaceH: 01 00}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = ps.ApplyTo(patchlib.NewPatcher([]byte{0, 1, 2, 3, 4, 5}), nil)
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected PatchError, got %v", err)
+	}
+	if pe.Patch != "A" || pe.Line != 5 || pe.Instruction != 3 {
+		t.Errorf("unexpected PatchError %+v", pe)
+	}
+	var pte *patchlib.PatcherError
+	if !errors.As(err, &pte) {
+		t.Fatalf("expected PatcherError, got %v", err)
+	}
+	if pte.Op != "ReplaceBytes" || pte.Offset != 3 || !reflect.DeepEqual(pte.Expected, []byte{0, 1}) || !reflect.DeepEqual(pte.Actual, []byte{3, 4}) {
+		t.Errorf("unexpected PatcherError %+v", pte)
+	}
+}
+
+func TestPatches(t *testing.T) {
+	ps, err := Parse([]byte(`
+B:
+  - Enabled: no
+  - PatchGroup: G
+  - BaseAddress: 2
+  - ReplaceBytes: {Offset: 1, FindH: 00 01, ReplaceH: 01 00}
+A:
+  - Enabled: yes
+  - Description: Does something.
+  - FindReplaceString: {Find: a, Replace: b}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := []patchfile.PatchInfo{
+		{Name: "A", Enabled: true, Description: "Does something.", Groups: []string{}, Instructions: 1, Line: 8},
+		{Name: "B", Enabled: false, Groups: []string{"G"}, Instructions: 2, Line: 3},
+	}
+	if act := ps.(patchfile.Inspector).Patches(); !reflect.DeepEqual(act, exp) {
+		t.Errorf("expected %+v, got %+v", exp, act)
+	}
+}
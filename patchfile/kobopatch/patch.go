@@ -2,10 +2,12 @@ package kobopatch
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
 
+	"github.com/pgaskin/kobopatch/patchfile"
 	"github.com/pgaskin/kobopatch/patchlib"
 	"gopkg.in/yaml.v3"
 )
@@ -66,11 +68,11 @@ func (i InstructionNode) ToInstruction() (*Instruction, error) {
 	var n Instruction
 	for name, node := range i {
 		if found {
-			return nil, fmt.Errorf("line %d: multiple types found in instruction, maybe you forgot a '-'", node.Line)
+			return nil, &patchfile.PatchError{Line: node.Line, Err: errors.New("multiple types found in instruction, maybe you forgot a '-'")}
 		} else if field := reflect.ValueOf(&n).Elem().FieldByName(name); !field.IsValid() {
-			return nil, fmt.Errorf("line %d: unknown instruction type %#v", node.Line, name)
+			return nil, &patchfile.PatchError{Line: node.Line, Err: fmt.Errorf("unknown instruction type %#v", name)}
 		} else if err := node.DecodeStrict(field.Addr().Interface()); err != nil {
-			return nil, fmt.Errorf("line %d: error decoding instruction: %w", node.Line, err)
+			return nil, &patchfile.PatchError{Line: node.Line, Err: fmt.Errorf("error decoding instruction: %w", err)}
 		} else {
 			found = true
 		}
@@ -0,0 +1,126 @@
+package patchfile
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pgaskin/kobopatch/patchlib"
+)
+
+// EventType is the type of an Event.
+type EventType int
+
+// Event types.
+const (
+	EventPatchStart  EventType = iota // an enabled patch is about to be applied
+	EventPatchSkip                    // a disabled patch was skipped
+	EventInstruction                  // an instruction changed bytes in the binary
+	EventError                        // the PatchSet could not be applied
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPatchStart:
+		return "PatchStart"
+	case EventPatchSkip:
+		return "PatchSkip"
+	case EventInstruction:
+		return "Instruction"
+	case EventError:
+		return "Error"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is reported to an Observer while a PatchSet is being applied.
+type Event struct {
+	Type  EventType
+	Patch string // the patch the event is for (empty for errors not specific to a patch)
+
+	Offset  int32  // for EventInstruction, the absolute offset of the change
+	Find    []byte // for EventInstruction, the original bytes (must not be modified)
+	Replace []byte // for EventInstruction, the new bytes (must not be modified)
+
+	Err error // for EventError
+}
+
+// Observer receives the events from PatchSet.ApplyTo.
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc is an Observer which calls a function.
+type ObserverFunc func(Event)
+
+// Observe implements Observer.
+func (fn ObserverFunc) Observe(e Event) {
+	fn(e)
+}
+
+// Observers is an Observer which passes the events to each non-nil Observer
+// in order.
+type Observers []Observer
+
+// Observe implements Observer.
+func (o Observers) Observe(e Event) {
+	for _, obs := range o {
+		if obs != nil {
+			obs.Observe(e)
+		}
+	}
+}
+
+// Printer returns an Observer which displays the patches being applied and
+// errors to w.
+func Printer(w io.Writer) Observer {
+	return ObserverFunc(func(e Event) {
+		switch e.Type {
+		case EventPatchStart:
+			fmt.Fprintf(w, "  APPLY `%s`\n", e.Patch)
+		case EventPatchSkip:
+			fmt.Fprintf(w, "  SKIP  `%s`\n", e.Patch)
+		case EventError:
+			if e.Patch != "" {
+				fmt.Fprintf(w, "    Error: %v\n", e.Err)
+			} else {
+				fmt.Fprintf(w, "  Error: %v\n", e.Err)
+			}
+		}
+	})
+}
+
+// Notify is used by formats to report an event to obs, which may be nil.
+func Notify(obs Observer, e Event) {
+	if obs != nil {
+		obs.Observe(e)
+	}
+}
+
+// HookInstructions is used by formats to report the changes made by the
+// instructions of a patch to obs as EventInstruction using the Patcher's hook.
+// The existing hook is still called first, and is restored by the returned
+// function, which must be called once the patch has been applied.
+func HookInstructions(pt *patchlib.Patcher, obs Observer, patch string) func() {
+	prev := pt.GetHook()
+	if obs == nil {
+		return func() {}
+	}
+	pt.Hook(func(offset int32, find, replace []byte) error {
+		if prev != nil {
+			if err := prev(offset, find, replace); err != nil {
+				return err
+			}
+		}
+		obs.Observe(Event{
+			Type:    EventInstruction,
+			Patch:   patch,
+			Offset:  offset,
+			Find:    find,
+			Replace: replace,
+		})
+		return nil
+	})
+	return func() {
+		pt.Hook(prev)
+	}
+}
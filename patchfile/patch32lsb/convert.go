@@ -0,0 +1,227 @@
+package patch32lsb
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pgaskin/kobopatch/patchfile/kobopatch"
+	"github.com/pgaskin/kobopatch/patchlib"
+	"gopkg.in/yaml.v3"
+)
+
+// Convert converts a PatchSet to an equivalent kobopatch patch file. The
+// patches are sorted by name, and the comments in each patch are used as its
+// description.
+func Convert(ps *PatchSet) ([]byte, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, n := range ps.SortedNames() {
+		var desc []string
+		insts := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, i := range (*ps)[n] {
+			var name string
+			var value *yaml.Node
+			switch {
+			case i.Enabled != nil:
+				name, value = "Enabled", boolNode(*i.Enabled)
+			case i.PatchGroup != nil:
+				name, value = "PatchGroup", strNode(*i.PatchGroup)
+			case i.Comment != nil:
+				if *i.Comment != "" {
+					desc = append(desc, *i.Comment)
+				}
+				continue
+			case i.BaseAddress != nil:
+				name, value = "BaseAddress", intNode(*i.BaseAddress)
+			case i.FindBaseAddress != nil:
+				name, value = "FindBaseAddressString", strNode(*i.FindBaseAddress)
+			case i.ReplaceBytes != nil:
+				r := *i.ReplaceBytes
+				name, value = "ReplaceBytes", flowNode(offset(r.Offset),
+					"FindH", strNode(fmt.Sprintf("% X", r.Find)),
+					"ReplaceH", strNode(fmt.Sprintf("% X", r.Replace)))
+			case i.ReplaceFloat != nil:
+				r := *i.ReplaceFloat
+				name, value = "ReplaceFloat", flowNode(offset(r.Offset),
+					"Find", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: strconv.FormatFloat(r.Find, 'g', -1, 64)},
+					"Replace", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: strconv.FormatFloat(r.Replace, 'g', -1, 64)})
+			case i.ReplaceInt != nil:
+				r := *i.ReplaceInt
+				name, value = "ReplaceInt", flowNode(offset(r.Offset),
+					"Find", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(int(r.Find))},
+					"Replace", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(int(r.Replace))})
+			case i.ReplaceString != nil:
+				r := *i.ReplaceString
+				name, value = "ReplaceString", flowNode(offset(r.Offset),
+					"Find", strNode(r.Find),
+					"Replace", strNode(r.Replace))
+			case i.FindZlib != nil:
+				name, value = "FindZlib", strNode(*i.FindZlib)
+			case i.FindZlibHash != nil:
+				name, value = "FindZlibHash", strNode(*i.FindZlibHash)
+			case i.ReplaceZlib != nil:
+				r := *i.ReplaceZlib
+				name, value = "ReplaceZlib", flowNode(offset(r.Offset),
+					"Find", strNode(r.Find),
+					"Replace", strNode(r.Replace))
+			case i.FindReplaceString != nil:
+				r := *i.FindReplaceString
+				name, value = "FindReplaceString", flowNode(nil,
+					"Find", strNode(r.Find),
+					"Replace", strNode(r.Replace))
+			default:
+				return nil, fmt.Errorf("patch '%s': line %d: invalid instruction: %#v", n, i.Line, i)
+			}
+			insts.Content = append(insts.Content, mapNode(name, value))
+		}
+		if len(desc) != 0 {
+			d := strNode(strings.Join(desc, "\n"))
+			if len(desc) > 1 {
+				d.Style, d.Value = yaml.LiteralStyle, d.Value+"\n"
+			}
+			// put it after the Enabled instruction like most kobopatch patches
+			var at int
+			for j, inst := range insts.Content {
+				if inst.Content[0].Value == "Enabled" {
+					at = j + 1
+					break
+				}
+			}
+			insts.Content = append(insts.Content, nil)
+			copy(insts.Content[at+1:], insts.Content[at:])
+			insts.Content[at] = mapNode("Description", d)
+		}
+		root.Content = append(root.Content, strNode(n), insts)
+	}
+
+	buf, err := yaml.Marshal(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}})
+	if err != nil {
+		return nil, fmt.Errorf("could not generate patch file: %w", err)
+	}
+
+	buf, err = kobopatch.Format(buf)
+	if err != nil {
+		return nil, fmt.Errorf("could not format patch file: %w", err)
+	}
+
+	kps, err := kobopatch.Parse(buf)
+	if err != nil {
+		return nil, fmt.Errorf("converted patch file is invalid: %w", err)
+	}
+	if err := kps.Validate(); err != nil {
+		return nil, fmt.Errorf("converted patch file is invalid: %w", err)
+	}
+	return buf, nil
+}
+
+// CheckConvert checks that a kobopatch patch file converted from ps gives the
+// same result as ps when applied to bin. Each patch is checked on its own, then
+// the patches which are enabled by default are checked together. If a patch
+// can't be applied to bin, it must fail to apply in both versions. The
+// enabled state of the patches in ps is left unchanged.
+func CheckConvert(ps *PatchSet, converted, bin []byte) error {
+	kpsi, err := kobopatch.Parse(converted)
+	if err != nil {
+		return fmt.Errorf("could not parse converted patch file: %w", err)
+	}
+	kps := kpsi.(*kobopatch.PatchSet)
+
+	names := ps.SortedNames()
+	if kn := kps.SortedNames(); strings.Join(kn, "\x00") != strings.Join(names, "\x00") {
+		return fmt.Errorf("converted patch file has different patches (%q != %q)", kn, names)
+	}
+
+	defaults := map[string]bool{}
+	for _, p := range ps.Patches() {
+		defaults[p.Name] = p.Enabled
+	}
+	defer func() {
+		for _, n := range names {
+			ps.SetEnabled(n, defaults[n])
+		}
+	}()
+
+	check := func(what string, enabled func(string) bool) error {
+		for _, n := range names {
+			if err := ps.SetEnabled(n, enabled(n)); err != nil {
+				return err
+			}
+			if err := kps.SetEnabled(n, enabled(n)); err != nil {
+				return err
+			}
+		}
+
+		pt := patchlib.NewPatcher(append([]byte(nil), bin...))
+		err := ps.ApplyTo(pt, nil)
+
+		kpt := patchlib.NewPatcher(append([]byte(nil), bin...))
+		kerr := kps.ApplyTo(kpt, nil)
+
+		switch {
+		case err != nil && kerr == nil:
+			return fmt.Errorf("%s: original failed to apply (%v), but the converted one didn't", what, err)
+		case err == nil && kerr != nil:
+			return fmt.Errorf("%s: converted failed to apply (%v), but the original one didn't", what, kerr)
+		case err == nil && !bytes.Equal(pt.GetBytes(), kpt.GetBytes()):
+			return fmt.Errorf("%s: output differs", what)
+		}
+		return nil
+	}
+
+	for _, n := range names {
+		if err := check(fmt.Sprintf("patch '%s'", n), func(o string) bool {
+			return o == n
+		}); err != nil {
+			return err
+		}
+	}
+	return check("default patches", func(n string) bool {
+		return defaults[n]
+	})
+}
+
+// mapNode returns a block mapping of the keys and values in kv.
+func mapNode(kv ...interface{}) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.MappingNode}
+	for i := 0; i < len(kv); i += 2 {
+		n.Content = append(n.Content, strNode(kv[i].(string)), kv[i+1].(*yaml.Node))
+	}
+	return n
+}
+
+// flowNode is like mapNode, but returns a flow mapping and adds the keys and
+// values in pre first.
+func flowNode(pre []interface{}, kv ...interface{}) *yaml.Node {
+	n := mapNode(append(pre, kv...)...)
+	n.Style = yaml.FlowStyle
+	return n
+}
+
+// offset returns the key and value for an Offset, or nothing if it is 0.
+func offset(i int32) []interface{} {
+	if i == 0 {
+		return nil
+	}
+	return []interface{}{"Offset", intNode(i)}
+}
+
+func strNode(s string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s}
+}
+
+// boolNode returns a yes/no node. The tag is left empty, since the encoder
+// would quote it otherwise.
+func boolNode(b bool) *yaml.Node {
+	if b {
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: "yes"}
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: "no"}
+}
+
+func intNode(i int32) *yaml.Node {
+	if i < 0 {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(int(i))}
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: fmt.Sprintf("0x%X", i)}
+}
@@ -0,0 +1,80 @@
+package patch32lsb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvert(t *testing.T) {
+	ps, err := Parse([]byte("<Patch>\n" +
+		"patch_name = `Bytes`\n" +
+		"patch_enable = `yes`\n" +
+		"# Replaces some bytes.\n" +
+		"#\n" +
+		"# Really.\n" +
+		"base_address = 0004\n" +
+		"replace_bytes = 0002, 06 07, 60 70\n" +
+		"replace_int = 0000, 4, 40\n" +
+		"</Patch>\n" +
+		"\n" +
+		"<Patch>\n" +
+		"patch_name = `Strings`\n" +
+		"patch_enable = `no`\n" +
+		"patch_group = `G`\n" +
+		"find_replace_string = `hello`, `HELLO`\n" +
+		"replace_string = 0006, `world`, `WORLD`\n" +
+		"</Patch>\n" +
+		"\n" +
+		"<Patch>\n" +
+		"patch_name = `Other`\n" +
+		"patch_enable = `no`\n" +
+		"patch_group = `G`\n" +
+		"# Says hi: and \"quotes\".\n" +
+		"find_base_address = `hello`\n" +
+		"replace_string = 0000, `hello`, `howdy`\n" +
+		"</Patch>\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	buf, err := Convert(ps.(*PatchSet))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, `Bytes:
+  - Enabled: yes
+  - Description: |
+      Replaces some bytes.
+      Really.
+  - BaseAddress: 0x4
+  - ReplaceBytes: {Offset: 0x2, FindH: 06 07, ReplaceH: 60 70}
+  - ReplaceInt: {Find: 4, Replace: 40}
+
+Other:
+  - Enabled: no
+  - Description: 'Says hi: and "quotes".'
+  - PatchGroup: G
+  - FindBaseAddressString: hello
+  - ReplaceString: {Find: hello, Replace: howdy}
+
+Strings:
+  - Enabled: no
+  - PatchGroup: G
+  - FindReplaceString: {Find: hello, Replace: HELLO}
+  - ReplaceString: {Offset: 0x6, Find: world, Replace: WORLD}
+`, string(buf))
+
+	bin := []byte("\x00\x01\x02\x03\x04\x05\x06\x07hello world")
+	assert.NoError(t, CheckConvert(ps.(*PatchSet), buf, bin))
+	assert.NoError(t, CheckConvert(ps.(*PatchSet), buf, []byte("nothing to patch here")))
+
+	for _, p := range ps.(*PatchSet).Patches() {
+		if p.Name == "Bytes" {
+			assert.True(t, p.Enabled, "expected the enabled state to be restored")
+		}
+	}
+
+	bad := []byte(string(buf[:len(buf)-len("WORLD}\n")]) + "W0RLD}\n")
+	assert.Error(t, CheckConvert(ps.(*PatchSet), bad, bin))
+}
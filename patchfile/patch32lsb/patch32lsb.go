@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/pgaskin/kobopatch/patchfile"
@@ -17,6 +18,7 @@ type PatchSet map[string]patch
 
 type patch []instruction
 type instruction struct {
+	Line            int
 	Enabled         *bool
 	PatchGroup      *string
 	BaseAddress     *int32
@@ -66,36 +68,37 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 	eqRegexp := regexp.MustCompile(" +?= +?")
 	for i, l := range strings.Split(strings.ReplaceAll(string(buf), "\r\n", "\n"), "\n") {
 		l = strings.TrimSpace(l)
+		n := len(curPatch)
 		switch {
 		case strings.HasPrefix(l, "#"), l == "":
 			c := strings.TrimLeft(l, "# ")
 			if strings.HasPrefix(c, "patch_group") {
-				return nil, fmt.Errorf("line %d: patch_group should not be a comment", i+1)
+				return nil, &patchfile.PatchError{Line: i + 1, Err: errors.New("patch_group should not be a comment")}
 			}
 			curPatch = append(curPatch, instruction{Comment: &c})
 			break
 		case strings.ToLower(l) == "<patch>":
 			if inPatch {
-				return nil, fmt.Errorf("line %d: unexpected <Patch> (already in patch)", i+1)
+				return nil, &patchfile.PatchError{Line: i + 1, Err: errors.New("unexpected <Patch> (already in patch)")}
 			}
 			curPatch = patch{}
 			inPatch = true
 			break
 		case strings.ToLower(l) == "</patch>":
 			if !inPatch {
-				return nil, fmt.Errorf("line %d: unexpected </Patch> (not in patch)", i+1)
+				return nil, &patchfile.PatchError{Line: i + 1, Err: errors.New("unexpected </Patch> (not in patch)")}
 			}
 			if patchName == "" {
-				return nil, fmt.Errorf("line %d: no patch_name for patch", i+1)
+				return nil, &patchfile.PatchError{Line: i + 1, Err: errors.New("no patch_name for patch")}
 			}
 			if _, ok := ps[patchName]; ok {
-				return nil, fmt.Errorf("line %d: duplicate patch with name '%s'", i+1, patchName)
+				return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("duplicate patch with name '%s'", patchName)}
 			}
 			ps[patchName] = curPatch[:]
 			inPatch = false
 			break
 		case !eqRegexp.MatchString(l):
-			return nil, fmt.Errorf("line %d: bad instruction: no equals sign", i+1)
+			return nil, &patchfile.PatchError{Line: i + 1, Err: errors.New("bad instruction: no equals sign")}
 		case eqRegexp.MatchString(l):
 			spl := eqRegexp.Split(l, 2)
 			switch strings.ToLower(spl[0]) {
@@ -103,17 +106,17 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 				var err error
 				patchName, err = unescape(spl[1])
 				if err != nil {
-					return nil, fmt.Errorf("line %d: error unescaping patch_name: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("error unescaping patch_name: %w", err)}
 				}
 			case "patch_group":
 				g, err := unescape(spl[1])
 				if err != nil {
-					return nil, fmt.Errorf("line %d: error unescaping patch_group: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("error unescaping patch_group: %w", err)}
 				}
 				curPatch = append(curPatch, instruction{PatchGroup: &g})
 			case "patch_enable":
 				if patchName == "" {
-					return nil, fmt.Errorf("line %d: patch_enable set before patch_name", i+1)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: errors.New("patch_enable set before patch_name")}
 				}
 				switch spl[1] {
 				case "`yes`":
@@ -123,7 +126,7 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 					e := false
 					curPatch = append(curPatch, instruction{Enabled: &e})
 				default:
-					return nil, fmt.Errorf("line %d: unexpected patch_enable value '%s' (should be yes or no)", i+1, spl[1])
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("unexpected patch_enable value '%s' (should be yes or no)", spl[1])}
 				}
 			case "replace_bytes":
 				args := strings.ReplaceAll(spl[1], " ", "")
@@ -131,7 +134,7 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 				var find, replace []byte
 				_, err := fmt.Sscanf(args, "%x,%x,%x", &offset, &find, &replace)
 				if err != nil {
-					return nil, fmt.Errorf("line %d: replace_bytes malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("replace_bytes malformed: %w", err)}
 				}
 				curPatch = append(curPatch, instruction{ReplaceBytes: &struct {
 					Offset  int32
@@ -142,7 +145,7 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 				var addr int32
 				_, err := fmt.Sscanf(spl[1], "%x", &addr)
 				if err != nil {
-					return nil, fmt.Errorf("line %d: base_address malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("base_address malformed: %w", err)}
 				}
 				curPatch = append(curPatch, instruction{BaseAddress: &addr})
 			case "replace_float":
@@ -151,7 +154,7 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 				var find, replace float64
 				_, err := fmt.Sscanf(args, "%x,%f,%f", &offset, &find, &replace)
 				if err != nil {
-					return nil, fmt.Errorf("line %d: replace_float malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("replace_float malformed: %w", err)}
 				}
 				curPatch = append(curPatch, instruction{ReplaceFloat: &struct {
 					Offset  int32
@@ -164,7 +167,7 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 				var find, replace uint8
 				_, err := fmt.Sscanf(args, "%x,%d,%d", &offset, &find, &replace)
 				if err != nil {
-					return nil, fmt.Errorf("line %d: replace_int malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("replace_int malformed: %w", err)}
 				}
 				curPatch = append(curPatch, instruction{ReplaceInt: &struct {
 					Offset  int32
@@ -174,13 +177,13 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 			case "find_base_address":
 				str, err := unescape(spl[1])
 				if err != nil {
-					return nil, fmt.Errorf("line %d: find_base_address malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("find_base_address malformed: %w", err)}
 				}
 				curPatch = append(curPatch, instruction{FindBaseAddress: &str})
 			case "replace_string":
 				ab := strings.SplitN(spl[1], ", ", 2)
 				if len(ab) != 2 {
-					return nil, fmt.Errorf("line %d: replace_string malformed", i+1)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: errors.New("replace_string malformed")}
 				}
 				var offset int32
 				if len(ab[0]) == 8 {
@@ -189,21 +192,21 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 				}
 				_, err := fmt.Sscanf(ab[0], "%x", &offset)
 				if err != nil {
-					return nil, fmt.Errorf("line %d: replace_string offset malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("replace_string offset malformed: %w", err)}
 				}
 				var find, replace, leftover string
 				leftover = ab[1]
 				find, leftover, err = unescapeFirst(leftover)
 				if err != nil {
-					return nil, fmt.Errorf("line %d: replace_string find malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("replace_string find malformed: %w", err)}
 				}
 				leftover = strings.TrimLeft(leftover, ", ")
 				replace, leftover, err = unescapeFirst(leftover)
 				if err != nil {
-					return nil, fmt.Errorf("line %d: replace_string replace malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("replace_string replace malformed: %w", err)}
 				}
 				if leftover != "" {
-					return nil, fmt.Errorf("line %d: replace_string malformed: extraneous characters after last argument", i+1)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: errors.New("replace_string malformed: extraneous characters after last argument")}
 				}
 				curPatch = append(curPatch, instruction{ReplaceString: &struct {
 					Offset  int32
@@ -213,19 +216,19 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 			case "find_zlib":
 				str, err := unescape(spl[1])
 				if err != nil {
-					return nil, fmt.Errorf("line %d: find_zlib malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("find_zlib malformed: %w", err)}
 				}
 				curPatch = append(curPatch, instruction{FindZlib: &str})
 			case "find_zlib_hash":
 				str, err := unescape(spl[1])
 				if err != nil {
-					return nil, fmt.Errorf("line %d: find_zlib_hash malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("find_zlib_hash malformed: %w", err)}
 				}
 				curPatch = append(curPatch, instruction{FindZlibHash: &str})
 			case "replace_zlib":
 				ab := strings.SplitN(spl[1], ", ", 2)
 				if len(ab) != 2 {
-					return nil, fmt.Errorf("line %d: replace_zlib malformed", i+1)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: errors.New("replace_zlib malformed")}
 				}
 				var offset int32
 				if len(ab[0]) == 8 {
@@ -234,21 +237,21 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 				}
 				_, err := fmt.Sscanf(ab[0], "%x", &offset)
 				if err != nil {
-					return nil, fmt.Errorf("line %d: replace_zlib offset malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("replace_zlib offset malformed: %w", err)}
 				}
 				var find, replace, leftover string
 				leftover = ab[1]
 				find, leftover, err = unescapeFirst(leftover)
 				if err != nil {
-					return nil, fmt.Errorf("line %d: replace_zlib find malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("replace_zlib find malformed: %w", err)}
 				}
 				leftover = strings.TrimLeft(leftover, ", ")
 				replace, leftover, err = unescapeFirst(leftover)
 				if err != nil {
-					return nil, fmt.Errorf("line %d: replace_zlib replace malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("replace_zlib replace malformed: %w", err)}
 				}
 				if leftover != "" {
-					return nil, fmt.Errorf("line %d: replace_zlib malformed: extraneous characters after last argument", i+1)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: errors.New("replace_zlib malformed: extraneous characters after last argument")}
 				}
 				curPatch = append(curPatch, instruction{ReplaceZlib: &struct {
 					Offset  int32
@@ -260,40 +263,60 @@ func Parse(buf []byte) (patchfile.PatchSet, error) {
 				leftover = spl[1]
 				find, leftover, err := unescapeFirst(leftover)
 				if err != nil {
-					return nil, fmt.Errorf("line %d: find_replace_string find malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("find_replace_string find malformed: %w", err)}
 				}
 				leftover = strings.TrimLeft(leftover, ", ")
 				replace, leftover, err = unescapeFirst(leftover)
 				if err != nil {
-					return nil, fmt.Errorf("line %d: find_replace_string replace malformed: %w", i+1, err)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("find_replace_string replace malformed: %w", err)}
 				}
 				if leftover != "" {
-					return nil, fmt.Errorf("line %d: find_replace_string malformed: extraneous characters after last argument", i+1)
+					return nil, &patchfile.PatchError{Line: i + 1, Err: errors.New("find_replace_string malformed: extraneous characters after last argument")}
 				}
 				curPatch = append(curPatch, instruction{FindReplaceString: &struct {
 					Find    string
 					Replace string
 				}{Find: find, Replace: replace}})
 			default:
-				return nil, fmt.Errorf("line %d: unexpected instruction: %s", i+1, spl[0])
+				return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("unexpected instruction: %s", spl[0])}
 			}
 		default:
-			return nil, fmt.Errorf("line %d: unexpected statement: %s", i+1, l)
+			return nil, &patchfile.PatchError{Line: i + 1, Err: fmt.Errorf("unexpected statement: %s", l)}
+		}
+		for j := n; j < len(curPatch); j++ {
+			curPatch[j].Line = i + 1
 		}
 	}
 	return &ps, nil
 }
 
+// Detect reports whether buf looks like a patch32lsb patch file (i.e. it has a
+// <Patch> tag on its own line).
+func Detect(buf []byte) bool {
+	for _, l := range bytes.Split(buf, []byte{'\n'}) {
+		if bytes.EqualFold(bytes.TrimSpace(l), []byte("<Patch>")) {
+			return true
+		}
+	}
+	return false
+}
+
 // Validate validates the PatchSet.
 func (ps *PatchSet) Validate() error {
 	enabledPatchGroups := map[string]bool{}
-	for n, p := range *ps {
+	for _, n := range ps.SortedNames() {
+		p := (*ps)[n]
 		pgc := 0
 		ec := 0
 		e := false
 		pg := ""
 
-		for _, i := range p {
+		var line int
+		if len(p) != 0 {
+			line = p[0].Line
+		}
+
+		for idx, i := range p {
 			ic := 0
 			if i.Enabled != nil {
 				ec++
@@ -332,7 +355,7 @@ func (ps *PatchSet) Validate() error {
 			if i.FindZlibHash != nil {
 				ic++
 				if len(*i.FindZlibHash) != 40 {
-					return fmt.Errorf("hash must be 40 chars in FindZlibHash in `%s`", n)
+					return &patchfile.PatchError{Patch: n, Line: i.Line, Instruction: idx + 1, Err: errors.New("hash must be 40 chars in FindZlibHash")}
 				}
 			}
 			if i.ReplaceZlib != nil {
@@ -342,18 +365,18 @@ func (ps *PatchSet) Validate() error {
 				ic++
 			}
 			if ic != 1 {
-				return fmt.Errorf("internal error (you should report this): ic > 1, '%#v'", i)
+				return &patchfile.PatchError{Patch: n, Line: i.Line, Instruction: idx + 1, Err: fmt.Errorf("internal error (you should report this): ic > 1, '%#v'", i)}
 			}
 		}
 		if ec != 1 {
-			return fmt.Errorf("you must have exactly 1 patch_enable option in each patch (%s)", n)
+			return &patchfile.PatchError{Patch: n, Line: line, Err: errors.New("you must have exactly 1 patch_enable option in each patch")}
 		}
 		if pgc > 1 {
-			return fmt.Errorf("you must have at most 1 patch_group option in each patch (%s)", n)
+			return &patchfile.PatchError{Patch: n, Line: line, Err: errors.New("you must have at most 1 patch_group option in each patch")}
 		}
 		if pg != "" && e {
 			if _, ok := enabledPatchGroups[pg]; ok {
-				return fmt.Errorf("more than one patch enabled in patch_group '%s'", pg)
+				return &patchfile.PatchError{Patch: n, Line: line, Err: fmt.Errorf("more than one patch enabled in patch_group '%s'", pg)}
 			}
 			enabledPatchGroups[pg] = true
 		}
@@ -362,20 +385,23 @@ func (ps *PatchSet) Validate() error {
 }
 
 // ApplyTo applies a PatchSet to a Patcher.
-func (ps *PatchSet) ApplyTo(pt *patchlib.Patcher) error {
+func (ps *PatchSet) ApplyTo(pt *patchlib.Patcher, obs patchfile.Observer) error {
 	patchfile.Log("validating patch file\n")
 	err := ps.Validate()
 	if err != nil {
 		err = fmt.Errorf("invalid patch file: %w", err)
-		fmt.Printf("  Error: %v\n", err)
+		patchfile.Notify(obs, patchfile.Event{Type: patchfile.EventError, Err: err})
 		return err
 	}
 
 	patchfile.Log("looping over patches\n")
-	num, total := 0, len(*ps)
-	for n, p := range *ps {
+	for _, n := range ps.SortedNames() {
+		p := (*ps)[n]
 		var err error
-		num++
+		if err := pt.Context().Err(); err != nil {
+			return err
+		}
+
 		patchfile.Log("  ResetBaseAddress()\n")
 		pt.ResetBaseAddress()
 
@@ -390,15 +416,16 @@ func (ps *PatchSet) ApplyTo(pt *patchlib.Patcher) error {
 
 		if !enabled {
 			patchfile.Log("  skipping patch `%s`\n", n)
-			fmt.Printf("  [%d/%d] Skipping disabled patch `%s`\n", num, total, n)
+			patchfile.Notify(obs, patchfile.Event{Type: patchfile.EventPatchSkip, Patch: n})
 			continue
 		}
 
 		patchfile.Log("  applying patch `%s`\n", n)
-		fmt.Printf("  [%d/%d] Applying patch `%s`\n", num, total, n)
+		patchfile.Notify(obs, patchfile.Event{Type: patchfile.EventPatchStart, Patch: n})
+		unhook := patchfile.HookInstructions(pt, obs, n)
 
 		patchfile.Log("looping over instructions\n")
-		for _, i := range p {
+		for idx, i := range p {
 			switch {
 			case i.Enabled != nil || i.PatchGroup != nil || i.Comment != nil:
 				patchfile.Log("  skipping non-instruction Enabled(), PatchGroup() or Comment()\n")
@@ -457,11 +484,14 @@ func (ps *PatchSet) ApplyTo(pt *patchlib.Patcher) error {
 			}
 
 			if err != nil {
-				patchfile.Log("could not apply patch: %v\n", err)
-				fmt.Printf("    Error: could not apply patch: %v\n", err)
+				unhook()
+				err = fmt.Errorf("could not apply %w", &patchfile.PatchError{Patch: n, Line: i.Line, Instruction: idx + 1, Err: err})
+				patchfile.Log("%v\n", err)
+				patchfile.Notify(obs, patchfile.Event{Type: patchfile.EventError, Patch: n, Err: err})
 				return err
 			}
 		}
+		unhook()
 	}
 
 	return nil
@@ -487,6 +517,47 @@ func (ps *PatchSet) SetEnabled(patch string, enabled bool) error {
 	return nil
 }
 
+// Patches returns information about each patch, sorted by name. The
+// description is made from the comments in the patch, and the line is the line
+// of the first comment or instruction after the <Patch> tag.
+func (ps *PatchSet) Patches() []patchfile.PatchInfo {
+	pi := make([]patchfile.PatchInfo, 0, len(*ps))
+	for _, name := range ps.SortedNames() {
+		info := patchfile.PatchInfo{Name: name, Groups: []string{}}
+		var desc []string
+		for _, i := range (*ps)[name] {
+			if info.Line == 0 {
+				info.Line = i.Line
+			}
+			switch {
+			case i.Enabled != nil:
+				info.Enabled = *i.Enabled
+			case i.PatchGroup != nil:
+				info.Groups = append(info.Groups, *i.PatchGroup)
+			case i.Comment != nil:
+				if *i.Comment != "" {
+					desc = append(desc, *i.Comment)
+				}
+			default:
+				info.Instructions++
+			}
+		}
+		info.Description = strings.Join(desc, "\n")
+		pi = append(pi, info)
+	}
+	return pi
+}
+
+// SortedNames gets the names of patches sorted alphabetically.
+func (ps *PatchSet) SortedNames() []string {
+	names := make([]string, 0, len(*ps))
+	for name := range *ps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func unescape(str string) (string, error) {
 	if !(strings.HasPrefix(str, "`") && strings.HasSuffix(str, "`")) || (string(str[len(str)-2]) == `\` && string(str[len(str)-3]) != `\`) {
 		return str, errors.New("string not wrapped in backticks")
@@ -559,5 +630,10 @@ func unescapeFirst(str string) (string, string, error) {
 }
 
 func init() {
-	patchfile.RegisterFormat("patch32lsb", Parse)
+	patchfile.Register(patchfile.Format{
+		Name:       "patch32lsb",
+		Extensions: []string{".patch"},
+		Detect:     Detect,
+		Parse:      Parse,
+	})
 }
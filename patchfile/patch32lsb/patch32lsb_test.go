@@ -1,8 +1,10 @@
 package patch32lsb
 
 import (
+	"errors"
 	"testing"
 
+	"github.com/pgaskin/kobopatch/patchfile"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,3 +37,64 @@ func TestUnescapeFirst(t *testing.T) {
 		assert.Equal(t, "dfgdfg dfgdfgd fgdf dfg `dfg`", r)
 	}
 }
+
+func TestPatches(t *testing.T) {
+	ps, err := Parse([]byte("<Patch>\n" +
+		"patch_name = `B`\n" +
+		"patch_enable = `no`\n" +
+		"patch_group = `G`\n" +
+		"replace_bytes = 0001, 00 01, 01 00\n" +
+		"</Patch>\n" +
+		"\n" +
+		"<Patch>\n" +
+		"# Does something.\n" +
+		"#\n" +
+		"# Really.\n" +
+		"patch_name = `A`\n" +
+		"patch_enable = `yes`\n" +
+		"base_address = 0002\n" +
+		"find_replace_string = `a`, `b`\n" +
+		"</Patch>\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []patchfile.PatchInfo{
+		{Name: "A", Enabled: true, Description: "Does something.\nReally.", Groups: []string{}, Instructions: 2, Line: 9},
+		{Name: "B", Enabled: false, Groups: []string{"G"}, Instructions: 1, Line: 3},
+	}, ps.(patchfile.Inspector).Patches())
+}
+
+func TestValidatePatchError(t *testing.T) {
+	ps, err := Parse([]byte("<Patch>\n" +
+		"patch_name = `A`\n" +
+		"patch_enable = `yes`\n" +
+		"patch_group = `G`\n" +
+		"</Patch>\n" +
+		"\n" +
+		"<Patch>\n" +
+		"patch_name = `B`\n" +
+		"patch_enable = `yes`\n" +
+		"patch_group = `G`\n" +
+		"</Patch>\n" +
+		"\n" +
+		"<Patch>\n" +
+		"patch_name = `C`\n" +
+		"patch_enable = `no`\n" +
+		"find_zlib_hash = `abc`\n" +
+		"</Patch>\n"))
+	assert.NoError(t, err)
+
+	err = ps.Validate()
+	var pe *patchfile.PatchError
+	if assert.True(t, errors.As(err, &pe), "expected a PatchError, got %v", err) {
+		assert.Equal(t, "B", pe.Patch)
+		assert.Equal(t, 9, pe.Line)
+		assert.EqualError(t, err, "patch \"B\": line 9: more than one patch enabled in patch_group 'G'")
+	}
+
+	assert.NoError(t, ps.SetEnabled("B", false))
+	err = ps.Validate()
+	if assert.True(t, errors.As(err, &pe), "expected a PatchError, got %v", err) {
+		assert.Equal(t, "C", pe.Patch)
+		assert.Equal(t, 16, pe.Line)
+		assert.Equal(t, 2, pe.Instruction)
+	}
+}
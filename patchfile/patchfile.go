@@ -2,8 +2,14 @@
 package patchfile
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
 
 	"github.com/pgaskin/kobopatch/patchlib"
 )
@@ -15,53 +21,171 @@ var Log = func(format string, a ...interface{}) {}
 type PatchSet interface {
 	// Validate validates the PatchSet.
 	Validate() error
-	// ApplyTo applies a PatchSet to a Patcher.
-	ApplyTo(*patchlib.Patcher) error
+	// ApplyTo applies a PatchSet to a Patcher, reporting the progress to an
+	// Observer (which may be nil).
+	ApplyTo(*patchlib.Patcher, Observer) error
 	// SetEnabled sets the Enabled state of a Patch in a PatchSet.
 	SetEnabled(string, bool) error
 }
 
-var formats = map[string]func([]byte) (PatchSet, error){}
+// Linter is implemented by a PatchSet which can report problems which don't
+// prevent it from being applied (e.g. deprecated instructions).
+type Linter interface {
+	// Lint returns warnings about the PatchSet.
+	Lint() []string
+}
 
-// RegisterFormat registers a format.
-func RegisterFormat(name string, f func([]byte) (PatchSet, error)) {
-	if _, ok := formats[name]; ok {
-		panic("attempt to register duplicate format " + name)
+// Format describes a patch format.
+type Format struct {
+	Name       string
+	Extensions []string                       // lowercase file extensions including the dot (e.g. .yaml)
+	Detect     func(buf []byte) bool          // reports whether buf is in this format (optional)
+	Parse      func([]byte) (PatchSet, error) // parses a PatchSet (required)
+	Formatter  func([]byte) ([]byte, error)   // rewrites a patch file in the canonical style (optional)
+}
+
+var formats = map[string]Format{}
+
+// Register registers a format.
+func Register(f Format) {
+	if _, ok := formats[f.Name]; ok {
+		panic("attempt to register duplicate format " + f.Name)
+	}
+	if f.Parse == nil {
+		panic("attempt to register format " + f.Name + " without a parser")
 	}
-	formats[name] = f
+	formats[f.Name] = f
+}
+
+// RegisterFormat registers a format which is only used when requested by name.
+func RegisterFormat(name string, f func([]byte) (PatchSet, error)) {
+	Register(Format{Name: name, Parse: f})
 }
 
 // GetFormat gets a format.
 func GetFormat(name string) (func([]byte) (PatchSet, error), bool) {
 	f, ok := formats[name]
-	return f, ok
+	return f.Parse, ok
 }
 
-// GetFormats gets all registered formats.
+// GetFormats gets all registered formats in alphabetical order.
 func GetFormats() []string {
 	f := []string{}
 	for n := range formats {
 		f = append(f, n)
 	}
+	sort.Strings(f)
 	return f
 }
 
-// ReadFromFile reads a patchset from a file (but does not validate it).
+// Detect returns the name of the format of a patch file. The content detectors
+// are tried first, in alphabetical order of the formats, then the extension of
+// filename (which may be empty).
+func Detect(filename string, buf []byte) (string, error) {
+	for _, n := range GetFormats() {
+		if d := formats[n].Detect; d != nil && d(buf) {
+			return n, nil
+		}
+	}
+	if ext := strings.ToLower(path.Ext(filename)); ext != "" {
+		for _, n := range GetFormats() {
+			for _, e := range formats[n].Extensions {
+				if e == ext {
+					return n, nil
+				}
+			}
+		}
+	}
+	if filename == "" {
+		return "", errors.New("could not detect patch format")
+	}
+	return "", fmt.Errorf("could not detect patch format of '%s'", filename)
+}
+
+// ReadFromFile reads a patchset from a file (but does not validate it). If
+// format is empty, it is detected.
 func ReadFromFile(format, filename string) (PatchSet, error) {
+	return read(format, filename, func() ([]byte, error) {
+		return ioutil.ReadFile(filename)
+	})
+}
+
+// ReadFromFS is like ReadFromFile, but reads the file from fsys.
+func ReadFromFS(fsys fs.FS, format, filename string) (PatchSet, error) {
+	return read(format, filename, func() ([]byte, error) {
+		return fs.ReadFile(fsys, filename)
+	})
+}
+
+// ReadFromReader is like ReadFromFile, but reads the patchset from r. The
+// filename is only used for detecting the format and for errors, and may be
+// empty.
+func ReadFromReader(r io.Reader, format, filename string) (PatchSet, error) {
+	return read(format, filename, func() ([]byte, error) {
+		return ioutil.ReadAll(r)
+	})
+}
+
+// Parse parses a patchset from buf (but does not validate it). If format is
+// empty, it is detected. The filename is only used for detecting the format and
+// for errors, and may be empty.
+func Parse(format, filename string, buf []byte) (PatchSet, error) {
+	if format == "" {
+		var err error
+		if format, err = Detect(filename, buf); err != nil {
+			return nil, err
+		}
+	}
+
 	f, ok := GetFormat(format)
 	if !ok {
 		return nil, fmt.Errorf("no format called '%s'", format)
 	}
 
-	buf, err := ioutil.ReadFile(filename)
+	ps, err := f(buf)
 	if err != nil {
-		return nil, fmt.Errorf("could not open patch file: %w", err)
+		return nil, fmt.Errorf("could not parse patch file: %w", SetErrorFile(err, filename))
 	}
 
-	ps, err := f(buf)
+	return ps, nil
+}
+
+// Reformat rewrites a patch file in the canonical style for the format. If
+// format is empty, it is detected. The filename is only used for detecting the
+// format and for errors, and may be empty.
+func Reformat(format, filename string, buf []byte) ([]byte, error) {
+	if format == "" {
+		var err error
+		if format, err = Detect(filename, buf); err != nil {
+			return nil, err
+		}
+	}
+
+	f, ok := formats[format]
+	if !ok {
+		return nil, fmt.Errorf("no format called '%s'", format)
+	}
+	if f.Formatter == nil {
+		return nil, fmt.Errorf("formatting is not supported for %s patch files", format)
+	}
+
+	nbuf, err := f.Formatter(buf)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse patch file: %w", err)
+		return nil, fmt.Errorf("could not format patch file: %w", SetErrorFile(err, filename))
 	}
 
-	return ps, nil
+	return nbuf, nil
+}
+
+func read(format, filename string, readFile func() ([]byte, error)) (PatchSet, error) {
+	if _, ok := GetFormat(format); !ok && format != "" {
+		return nil, fmt.Errorf("no format called '%s'", format)
+	}
+
+	buf, err := readFile()
+	if err != nil {
+		return nil, fmt.Errorf("could not open patch file: %w", err)
+	}
+
+	return Parse(format, filename, buf)
 }
@@ -0,0 +1,75 @@
+package patchfile_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pgaskin/kobopatch/patchfile"
+	_ "github.com/pgaskin/kobopatch/patchfile/kobopatch"
+	_ "github.com/pgaskin/kobopatch/patchfile/patch32lsb"
+)
+
+const (
+	testKobopatch  = "Test:\n  - Enabled: yes\n  - FindReplaceString: {Find: a, Replace: b}\n"
+	testPatch32lsb = "<Patch>\npatch_name = `Test`\npatch_enable = `yes`\nfind_replace_string = `a`, `b`\n</Patch>\n"
+)
+
+func TestDetect(t *testing.T) {
+	for _, c := range []struct {
+		filename, buf, format string
+	}{
+		{"test.yaml", testKobopatch, "kobopatch"},
+		{"test.patch", testPatch32lsb, "patch32lsb"},
+		{"test.patch", testKobopatch, "kobopatch"},
+		{"test.yaml", testPatch32lsb, "patch32lsb"},
+		{"", testKobopatch, "kobopatch"},
+		{"", testPatch32lsb, "patch32lsb"},
+		{"test.YML", "", "kobopatch"},
+		{"test.patch", "# empty\n", "patch32lsb"},
+		{"test.txt", "", ""},
+		{"", "", ""},
+	} {
+		if format, err := patchfile.Detect(c.filename, []byte(c.buf)); c.format == "" && err == nil {
+			t.Errorf("%q %q: expected error, got format %q", c.filename, c.buf, format)
+		} else if c.format != "" && err != nil {
+			t.Errorf("%q %q: unexpected error: %v", c.filename, c.buf, err)
+		} else if format != c.format {
+			t.Errorf("%q %q: expected format %q, got %q", c.filename, c.buf, c.format, format)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	for _, buf := range []string{testKobopatch, testPatch32lsb} {
+		ps, err := patchfile.ReadFromReader(strings.NewReader(buf), "", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if pi := ps.(patchfile.Inspector).Patches(); len(pi) != 1 || pi[0].Name != "Test" {
+			t.Errorf("expected patch Test, got %+v", pi)
+		}
+	}
+
+	fsys := fstest.MapFS{"a/renamed.txt": {Data: []byte(testPatch32lsb)}}
+	if _, err := patchfile.ReadFromFS(fsys, "", "a/renamed.txt"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := patchfile.ReadFromFS(fsys, "kobopatch", "a/renamed.txt"); err == nil {
+		t.Errorf("expected error parsing with the wrong format")
+	}
+	if _, err := patchfile.ReadFromFS(fsys, "invalid", "a/renamed.txt"); err == nil {
+		t.Errorf("expected error for invalid format")
+	}
+}
+
+func TestReformat(t *testing.T) {
+	if buf, err := patchfile.Reformat("", "test.yaml", []byte("Test:\n- Enabled: yes\n- FindReplaceString: {Replace: b, Find: a}\n")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if exp := "Test:\n  - Enabled: yes\n  - FindReplaceString: {Find: a, Replace: b}\n"; string(buf) != exp {
+		t.Errorf("expected %q, got %q", exp, buf)
+	}
+	if _, err := patchfile.Reformat("", "test.patch", []byte(testPatch32lsb)); err == nil {
+		t.Errorf("expected error for format without a formatter")
+	}
+}
@@ -0,0 +1,34 @@
+package patchlib
+
+// PatcherError is an error from a Patcher operation.
+type PatcherError struct {
+	Op       string // the operation which failed (e.g. ReplaceBytes)
+	Offset   int32  // the absolute offset the operation was applied at, or -1 if not applicable
+	Expected []byte // the bytes which were expected at Offset, if applicable
+	Actual   []byte // the bytes which were at Offset instead (up to the length of Expected)
+	Err      error
+}
+
+// Error implements error.
+func (e *PatcherError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *PatcherError) Unwrap() error {
+	return e.Err
+}
+
+// newError returns a PatcherError for an operation at an absolute offset
+// (or -1). If expected is not nil, the actual bytes are read from the buffer.
+func (p *Patcher) newError(op string, offset int32, expected []byte, err error) error {
+	e := &PatcherError{Op: op, Offset: offset, Expected: expected, Err: err}
+	if expected != nil && offset >= 0 && offset < int32(len(p.buf)) {
+		end := offset + int32(len(expected))
+		if end > int32(len(p.buf)) {
+			end = int32(len(p.buf))
+		}
+		e.Actual = append([]byte(nil), p.buf[offset:end]...)
+	}
+	return e
+}
@@ -4,6 +4,7 @@ package patchlib
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
 	"crypto/sha1"
 	"debug/elf"
 	"encoding/binary"
@@ -23,6 +24,7 @@ type Patcher struct {
 	buf  []byte
 	cur  int32
 	hook func(offset int32, find, replace []byte) error
+	ctx  context.Context
 
 	dynsymsLoaded       bool // for lazy-loading on first use
 	dynsymsLoadedPLTGOT bool // for only decoding PLT if needed (on first use)
@@ -31,7 +33,7 @@ type Patcher struct {
 
 // NewPatcher creates a new Patcher.
 func NewPatcher(in []byte) *Patcher {
-	return &Patcher{in, 0, nil, false, false, nil}
+	return &Patcher{buf: in}
 }
 
 // GetBytes returns the current content of the Patcher.
@@ -51,13 +53,34 @@ func (p *Patcher) Hook(fn func(offset int32, find, replace []byte) error) {
 	p.hook = fn
 }
 
+// GetHook returns the hook set by Hook, or nil if none was set.
+func (p *Patcher) GetHook() func(offset int32, find, replace []byte) error {
+	return p.hook
+}
+
+// SetContext sets the context used to cancel long-running operations (e.g.
+// ExtractZlib and decoding the ELF symbols) and patch formats applying patches
+// to the Patcher. If nil (the default), context.Background is used.
+func (p *Patcher) SetContext(ctx context.Context) {
+	p.ctx = ctx
+}
+
+// Context returns the context set by SetContext, or context.Background if none
+// was set.
+func (p *Patcher) Context() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
 // BaseAddress moves cur to an offset. The offset starts at 0.
 func (p *Patcher) BaseAddress(offset int32) error {
 	if offset < 0 {
-		return errors.New("BaseAddress: offset less than 0")
+		return p.newError("BaseAddress", offset, nil, errors.New("offset less than 0"))
 	}
 	if offset >= int32(len(p.buf)) {
-		return errors.New("BaseAddress: offset greater than length of buf")
+		return p.newError("BaseAddress", offset, nil, errors.New("offset greater than length of buf"))
 	}
 	p.cur = offset
 	return nil
@@ -66,11 +89,11 @@ func (p *Patcher) BaseAddress(offset int32) error {
 // FindBaseAddress moves cur to the offset of a sequence of bytes.
 func (p *Patcher) FindBaseAddress(find []byte) error {
 	if len(find) > len(p.buf) {
-		return errors.New("FindBaseAddress: length of bytes to find greater than buf")
+		return p.newError("FindBaseAddress", -1, nil, errors.New("length of bytes to find greater than buf"))
 	}
 	i := bytes.Index(p.buf, find)
 	if i < 0 {
-		return errors.New("FindBaseAddress: could not find bytes")
+		return p.newError("FindBaseAddress", -1, nil, errors.New("could not find bytes"))
 	}
 	p.cur = int32(i)
 	return nil
@@ -86,10 +109,7 @@ func (p *Patcher) FindBaseAddressString(find string) error {
 
 // ReplaceBytes replaces the first occurrence of a sequence of bytes with another of the same length.
 func (p *Patcher) ReplaceBytes(offset int32, find, replace []byte) error {
-	if err := p.replaceValue(offset, find, replace, true); err != nil {
-		return fmt.Errorf("ReplaceBytes: %w", err)
-	}
-	return nil
+	return p.replaceValue("ReplaceBytes", offset, find, replace, true)
 }
 
 // ReplaceString replaces the first occurrence of a string with another of the same length.
@@ -99,42 +119,33 @@ func (p *Patcher) ReplaceString(offset int32, find, replace string) error {
 		replace += "\x00"
 		replace = replace + find[len(replace):]
 	}
-	if err := p.replaceValue(offset, find, replace, false); err != nil {
-		return fmt.Errorf("ReplaceString: %w", err)
-	}
-	return nil
+	return p.replaceValue("ReplaceString", offset, find, replace, false)
 }
 
 // ReplaceInt replaces the first occurrence of an integer between 0 and 255 inclusively.
 func (p *Patcher) ReplaceInt(offset int32, find, replace uint8) error {
-	if err := p.replaceValue(offset, find, replace, true); err != nil {
-		return fmt.Errorf("ReplaceInt: %w", err)
-	}
-	return nil
+	return p.replaceValue("ReplaceInt", offset, find, replace, true)
 }
 
 // ReplaceFloat replaces the first occurrence of a float.
 func (p *Patcher) ReplaceFloat(offset int32, find, replace float64) error {
-	if err := p.replaceValue(offset, find, replace, true); err != nil {
-		return fmt.Errorf("ReplaceFloat: %w", err)
-	}
-	return nil
+	return p.replaceValue("ReplaceFloat", offset, find, replace, true)
 }
 
 // FindZlib finds the base address of a zlib css stream based on a substring (not sensitive to whitespace).
 func (p *Patcher) FindZlib(find string) error {
 	if len(find) > len(p.buf) {
-		return errors.New("FindZlib: length of string to find greater than buf")
+		return p.newError("FindZlib", -1, nil, errors.New("length of string to find greater than buf"))
 	}
 	z, err := p.ExtractZlib()
 	if err != nil {
-		return fmt.Errorf("FindZlib: could not extract zlib streams: %w", err)
+		return p.newError("FindZlib", -1, nil, fmt.Errorf("could not extract zlib streams: %w", err))
 	}
 	var i int32
 	for _, zi := range z {
 		if strings.Contains(zi.CSS, find) || strings.Contains(stripWhitespace(zi.CSS), stripWhitespace(find)) {
 			if i != 0 {
-				return errors.New("FindZlib: substring to find is not unique")
+				return p.newError("FindZlib", -1, nil, errors.New("substring to find is not unique"))
 			}
 			i = zi.Offset
 			continue
@@ -148,7 +159,7 @@ func (p *Patcher) FindZlib(find string) error {
 		findm = strings.ReplaceAll(findm, "\n    ", "\n")
 		if strings.Contains(zi.CSS, findm) || strings.Contains(stripWhitespace(zi.CSS), stripWhitespace(findm)) {
 			if i != 0 {
-				return errors.New("FindZlib: substring to find is not unique")
+				return p.newError("FindZlib", -1, nil, errors.New("substring to find is not unique"))
 			}
 			i = zi.Offset
 			continue
@@ -159,7 +170,7 @@ func (p *Patcher) FindZlib(find string) error {
 		findm = strings.ReplaceAll(findm, " {", "{")
 		if strings.Contains(zi.CSS, findm) || strings.Contains(stripWhitespace(zi.CSS), stripWhitespace(findm)) {
 			if i != 0 {
-				return errors.New("FindZlib: substring to find is not unique")
+				return p.newError("FindZlib", -1, nil, errors.New("substring to find is not unique"))
 			}
 			i = zi.Offset
 			continue
@@ -171,14 +182,14 @@ func (p *Patcher) FindZlib(find string) error {
 		findm = strings.ReplaceAll(findm, "; ", ";")
 		if strings.Contains(zi.CSS, findm) || strings.Contains(stripWhitespace(zi.CSS), stripWhitespace(findm)) {
 			if i != 0 {
-				return errors.New("FindZlib: substring to find is not unique")
+				return p.newError("FindZlib", -1, nil, errors.New("substring to find is not unique"))
 			}
 			i = zi.Offset
 			continue
 		}
 	}
 	if i == 0 {
-		return errors.New("FindZlib: could not find string")
+		return p.newError("FindZlib", -1, nil, errors.New("could not find string"))
 	}
 	p.cur = i
 	return nil
@@ -187,11 +198,11 @@ func (p *Patcher) FindZlib(find string) error {
 // FindZlibHash finds the base address of a zlib css stream based on it's SHA1 hash (can be found using the cssextract tool).
 func (p *Patcher) FindZlibHash(hash string) error {
 	if len(hash) != 40 {
-		return errors.New("FindZlibHash: invalid hash")
+		return p.newError("FindZlibHash", -1, nil, errors.New("invalid hash"))
 	}
 	z, err := p.ExtractZlib()
 	if err != nil {
-		return fmt.Errorf("FindZlibHash: could not extract zlib streams: %w", err)
+		return p.newError("FindZlibHash", -1, nil, fmt.Errorf("could not extract zlib streams: %w", err))
 	}
 	f := false
 	for _, zi := range z {
@@ -202,7 +213,7 @@ func (p *Patcher) FindZlibHash(hash string) error {
 		}
 	}
 	if !f {
-		return errors.New("FindZlibHash: could not find hash")
+		return p.newError("FindZlibHash", -1, nil, errors.New("could not find hash"))
 	}
 	return nil
 }
@@ -220,23 +231,23 @@ type Replacement struct {
 // ReplaceZlibGroup is the same as ReplaceZlib, but it replaces all at once.
 func (p *Patcher) ReplaceZlibGroup(offset int32, repl []Replacement) error {
 	if !bytes.HasPrefix(p.buf[p.cur+offset:p.cur+offset+2], []byte{0x78, 0x9c}) {
-		return errors.New("ReplaceZlib: not a zlib stream")
+		return p.newError("ReplaceZlib", p.cur+offset, nil, errors.New("not a zlib stream"))
 	}
 	r, err := zlib.NewReader(bytes.NewReader(p.buf[p.cur+offset:])) // Need to use go zlib lib because it is more lenient about corrupt data after end of zlib stream
 	if err != nil {
-		return fmt.Errorf("ReplaceZlib: could not initialize zlib reader: %w", err)
+		return p.newError("ReplaceZlib", p.cur+offset, nil, fmt.Errorf("could not initialize zlib reader: %w", err))
 	}
 	dbuf, err := ioutil.ReadAll(r)
 	r.Close()
 	if err != nil && !strings.Contains(err.Error(), "corrupt input") && !strings.Contains(err.Error(), "invalid checksum") {
-		return fmt.Errorf("ReplaceZlib: could not decompress stream: %w", err)
+		return p.newError("ReplaceZlib", p.cur+offset, nil, fmt.Errorf("could not decompress stream: %w", err))
 	}
 	if len(dbuf) == 0 || !utf8.Valid(dbuf) {
-		return errors.New("ReplaceZlib: not a valid zlib stream")
+		return p.newError("ReplaceZlib", p.cur+offset, nil, errors.New("not a valid zlib stream"))
 	}
 	tbuf := compress(dbuf)
 	if !bytes.HasPrefix(p.buf[p.cur+offset:], tbuf) || len(tbuf) < 4 {
-		return errors.New("ReplaceZlib: sanity check failed: recompressed original data does not match original (this is a bug, so please report it)")
+		return p.newError("ReplaceZlib", p.cur+offset, nil, errors.New("sanity check failed: recompressed original data does not match original (this is a bug, so please report it)"))
 	}
 	for _, r := range repl {
 		find, replace := r.Find, r.Replace
@@ -252,7 +263,7 @@ func (p *Patcher) ReplaceZlibGroup(offset int32, repl []Replacement) error {
 					find = strings.ReplaceAll(find, "; ", ";")
 					find = strings.ReplaceAll(find, "{ ", "{")
 					if !bytes.Contains(dbuf, []byte(find)) {
-						return fmt.Errorf("ReplaceZlib: find string not found in stream (%s)", strings.ReplaceAll(find, "\n", "\\n"))
+						return p.newError("ReplaceZlib", p.cur+offset, nil, fmt.Errorf("find string not found in stream (%s)", strings.ReplaceAll(find, "\n", "\\n")))
 					}
 				}
 			}
@@ -261,7 +272,7 @@ func (p *Patcher) ReplaceZlibGroup(offset int32, repl []Replacement) error {
 	}
 	nbuf := compress(dbuf)
 	if len(nbuf) == 0 {
-		return errors.New("ReplaceZlib: error compressing new data (this is a bug, so please report it)")
+		return p.newError("ReplaceZlib", p.cur+offset, nil, errors.New("error compressing new data (this is a bug, so please report it)"))
 	}
 	if len(nbuf) > len(tbuf) {
 		// Attempt to remove indentation to save space
@@ -284,22 +295,22 @@ func (p *Patcher) ReplaceZlibGroup(offset int32, repl []Replacement) error {
 		nbuf = compress(dbuf)
 	}
 	if len(nbuf) > len(tbuf) {
-		return fmt.Errorf("ReplaceZlib: new compressed data is %d bytes longer than old data (try removing whitespace or unnecessary css)", len(nbuf)-len(tbuf))
+		return p.newError("ReplaceZlib", p.cur+offset, nil, fmt.Errorf("new compressed data is %d bytes longer than old data (try removing whitespace or unnecessary css)", len(nbuf)-len(tbuf)))
 	}
 	if p.hook != nil {
 		if err := p.hook(p.cur+offset, tbuf, nbuf); err != nil {
-			return fmt.Errorf("hook returned error: %v", err)
+			return p.newError("ReplaceZlib", p.cur+offset, nil, fmt.Errorf("hook returned error: %w", err))
 		}
 	}
 	copy(p.buf[p.cur+offset:p.cur+offset+int32(len(tbuf))], nbuf)
 	r, err = zlib.NewReader(bytes.NewReader(p.buf[p.cur+offset:])) // Need to use go zlib lib because it is more lenient about corrupt data after end of zlib stream
 	if err != nil {
-		return fmt.Errorf("ReplaceZlib: could not initialize zlib reader: %w", err)
+		return p.newError("ReplaceZlib", p.cur+offset, nil, fmt.Errorf("could not initialize zlib reader: %w", err))
 	}
 	ndbuf, err := ioutil.ReadAll(r)
 	r.Close()
 	if !bytes.Equal(dbuf, ndbuf) {
-		return errors.New("ReplaceZlib: decompressed new data does not match new data (this is a bug, so please report it)")
+		return p.newError("ReplaceZlib", p.cur+offset, nil, errors.New("decompressed new data does not match new data (this is a bug, so please report it)"))
 	}
 	return nil
 }
@@ -312,8 +323,14 @@ type ZlibItem struct {
 
 // ExtractZlib extracts all CSS zlib streams. It returns it as a map of offsets and strings.
 func (p *Patcher) ExtractZlib() ([]ZlibItem, error) {
+	ctx := p.Context()
 	zlibs := []ZlibItem{}
 	for i := 0; i < len(p.buf)-2; i++ {
+		if i%(1<<20) == 0 {
+			if err := ctx.Err(); err != nil {
+				return zlibs, err
+			}
+		}
 		if bytes.HasPrefix(p.buf[i:i+2], []byte{0x78, 0x9c}) {
 			r, err := zlib.NewReader(bytes.NewReader(p.buf[i:])) // Need to use go zlib lib because it is more lenient about corrupt data after end of zlib stream
 			if err != nil {
@@ -353,9 +370,9 @@ func (p *Patcher) GetCur() int32 {
 // its base address (error if not found). The symbol table will be loaded if not
 // already done.
 func (p *Patcher) ResolveSym(name string) (int32, error) {
-	s, err := p.getDynsym(name, false)
+	s, err := p.getDynsym("ResolveSym", name, false)
 	if err != nil {
-		return 0, fmt.Errorf("ResolveSym(%#v): %w", name, err)
+		return 0, err
 	}
 	return int32(s.Offset), nil
 }
@@ -364,12 +381,12 @@ func (p *Patcher) ResolveSym(name string) (int32, error) {
 // returns its PLT address (error if it doesn't have one). The symbol table will
 // be loaded if not already done.
 func (p *Patcher) ResolveSymPLT(name string) (int32, error) {
-	s, err := p.getDynsym(name, true)
+	s, err := p.getDynsym("ResolveSymPLT", name, true)
 	if err != nil {
-		return 0, fmt.Errorf("ResolveSymPLT(%#v): %w", name, err)
+		return 0, err
 	}
 	if s.OffsetPLT == 0 {
-		return 0, fmt.Errorf("ResolveSymPLT(%#v) = %#v: no PLT entry found", name, s)
+		return 0, p.newError("ResolveSymPLT", -1, nil, fmt.Errorf("%#v = %#v: no PLT entry found", name, s))
 	}
 	return int32(s.OffsetPLT), nil
 }
@@ -378,23 +395,24 @@ func (p *Patcher) ResolveSymPLT(name string) (int32, error) {
 // returns its PLT tail call address (error if it doesn't have one). The symbol
 // table will be loaded if not already done.
 func (p *Patcher) ResolveSymPLTTail(name string) (int32, error) {
-	s, err := p.getDynsym(name, true)
+	s, err := p.getDynsym("ResolveSymPLTTail", name, true)
 	if err != nil {
-		return 0, fmt.Errorf("ResolveSymPLTTail(%#v): %w", name, err)
+		return 0, err
 	}
 	if s.OffsetPLT == 0 {
-		return 0, fmt.Errorf("ResolveSymPLTTail(%#v) = %#v: no PLT entry found", name, s)
+		return 0, p.newError("ResolveSymPLTTail", -1, nil, fmt.Errorf("%#v = %#v: no PLT entry found", name, s))
 	}
 	if s.OffsetPLTTail == 0 {
-		return 0, fmt.Errorf("ResolveSymPLTTail(%#v) = %#v: no tail stub before PLT entry", name, s)
+		return 0, p.newError("ResolveSymPLTTail", -1, nil, fmt.Errorf("%#v = %#v: no tail stub before PLT entry", name, s))
 	}
 	return int32(s.OffsetPLTTail), nil
 }
 
-func (p *Patcher) getDynsym(name string, needPLTGOT bool) (*dynsym, error) {
-	ds, err := p.ExtractDynsyms(needPLTGOT)
+// getDynsym finds a symbol for op, returning a PatcherError if it fails.
+func (p *Patcher) getDynsym(op, name string, needPLTGOT bool) (*dynsym, error) {
+	ds, err := p.extractDynsyms(needPLTGOT)
 	if err != nil {
-		return nil, fmt.Errorf("get dynsyms: %w", err)
+		return nil, p.newError(op, -1, nil, fmt.Errorf("get dynsyms for %#v: %w", name, err))
 	}
 	for _, s := range ds {
 		if s.Name == name {
@@ -406,18 +424,33 @@ func (p *Patcher) getDynsym(name string, needPLTGOT bool) (*dynsym, error) {
 			return s, nil
 		}
 	}
-	return nil, fmt.Errorf("no such symbol %#v", name)
+	return nil, p.newError(op, -1, nil, fmt.Errorf("no such symbol %#v", name))
 }
 
+// ExtractDynsyms loads the dynamic symbols from the ELF binary (and decodes the
+// PLT if needPLTGOT is true), or returns the ones which were already loaded.
+// If the Patcher's context is cancelled, its error is returned as-is.
 func (p *Patcher) ExtractDynsyms(needPLTGOT bool) ([]*dynsym, error) {
+	ds, err := p.extractDynsyms(needPLTGOT)
+	if err != nil && err != p.Context().Err() {
+		return nil, p.newError("ExtractDynsyms", -1, nil, err)
+	}
+	return ds, err
+}
+
+func (p *Patcher) extractDynsyms(needPLTGOT bool) ([]*dynsym, error) {
 	if !p.dynsymsLoaded || (needPLTGOT && !p.dynsymsLoadedPLTGOT) {
+		if err := p.Context().Err(); err != nil {
+			return nil, err
+		}
+
 		e, err := elf.NewFile(bytes.NewReader(p.buf))
 		if err != nil {
 			return nil, fmt.Errorf("load elf: %w", err)
 		}
 		defer e.Close()
 
-		ds, err := decdynsym(e, !needPLTGOT)
+		ds, err := decdynsym(p.Context(), e, !needPLTGOT)
 		if err != nil {
 			return nil, fmt.Errorf("load syms (pltgot: %t): %w", needPLTGOT, err)
 		}
@@ -431,9 +464,9 @@ func (p *Patcher) ExtractDynsyms(needPLTGOT bool) ([]*dynsym, error) {
 // replaceValue encodes find and replace as little-endian binary and replaces
 // the first occurrence starting at cur. The lengths of the encoded find and
 // replace must be the same, or an error will be returned.
-func (p *Patcher) replaceValue(offset int32, find, replace interface{}, strictOffset bool) error {
+func (p *Patcher) replaceValue(op string, offset int32, find, replace interface{}, strictOffset bool) error {
 	if int32(len(p.buf)) < p.cur+offset {
-		return errors.New("offset past end of buf")
+		return p.newError(op, p.cur+offset, nil, errors.New("offset past end of buf"))
 	}
 
 	var err error
@@ -444,7 +477,7 @@ func (p *Patcher) replaceValue(offset int32, find, replace interface{}, strictOf
 	} else {
 		fbuf, err = toLEBin(find)
 		if err != nil {
-			return fmt.Errorf("could not encode find: %v", err)
+			return p.newError(op, p.cur+offset, nil, fmt.Errorf("could not encode find: %w", err))
 		}
 	}
 
@@ -453,28 +486,28 @@ func (p *Patcher) replaceValue(offset int32, find, replace interface{}, strictOf
 	} else {
 		rbuf, err = toLEBin(replace)
 		if err != nil {
-			return fmt.Errorf("could not encode replace: %v", err)
+			return p.newError(op, p.cur+offset, nil, fmt.Errorf("could not encode replace: %w", err))
 		}
 	}
 
 	if len(fbuf) != len(rbuf) {
-		return errors.New("length mismatch in byte replacement")
+		return p.newError(op, p.cur+offset, nil, errors.New("length mismatch in byte replacement"))
 	}
 	if int32(len(p.buf)) < p.cur+offset+int32(len(fbuf)) {
-		return errors.New("replaced value past end of buf")
+		return p.newError(op, p.cur+offset, nil, errors.New("replaced value past end of buf"))
 	}
 
 	if !bytes.Contains(p.buf[p.cur+offset:], fbuf) {
-		return errors.New("could not find specified bytes")
+		return p.newError(op, p.cur+offset, fbuf, errors.New("could not find specified bytes"))
 	}
 
 	if strictOffset && !bytes.HasPrefix(p.buf[p.cur+offset:], fbuf) {
-		return errors.New("could not find specified bytes at offset")
+		return p.newError(op, p.cur+offset, fbuf, errors.New("could not find specified bytes at offset"))
 	}
 
 	if p.hook != nil {
 		if err := p.hook(p.cur+offset, fbuf, rbuf); err != nil {
-			return fmt.Errorf("hook returned error: %v", err)
+			return p.newError(op, p.cur+offset, nil, fmt.Errorf("hook returned error: %w", err))
 		}
 	}
 	copy(p.buf[p.cur+offset:], bytes.Replace(p.buf[p.cur+offset:], fbuf, rbuf, 1))
@@ -525,11 +558,11 @@ func stripWhitespace(src string) string {
 func (p *Patcher) FindBaseAddressSymbol(find string) error {
 	e, err := elf.NewFile(bytes.NewReader(p.buf))
 	if err != nil {
-		return fmt.Errorf("FindBaseAddressSymbol: could not open file as elf binary: %w", err)
+		return p.newError("FindBaseAddressSymbol", -1, nil, fmt.Errorf("could not open file as elf binary: %w", err))
 	}
 	syms, err := e.DynamicSymbols()
 	if err != nil {
-		return fmt.Errorf("FindBaseAddressSymbol: could not read dynsyms: %w", err)
+		return p.newError("FindBaseAddressSymbol", -1, nil, fmt.Errorf("could not read dynsyms: %w", err))
 	}
 	for _, sym := range syms {
 		name, err := demangle.ToString(sym.Name)
@@ -541,7 +574,7 @@ func (p *Patcher) FindBaseAddressSymbol(find string) error {
 			return nil
 		}
 	}
-	return errors.New("FindBaseAddressSymbol: could not find symbol")
+	return p.newError("FindBaseAddressSymbol", -1, nil, errors.New("could not find symbol"))
 }
 
 // ReplaceBLX replaces a BLX instruction at PC (offset). Find and Replace are the target offsets.
@@ -549,19 +582,19 @@ func (p *Patcher) FindBaseAddressSymbol(find string) error {
 // Deprecated: Assemble the instruction with AsmBLX and use ReplaceBytes instead.
 func (p *Patcher) ReplaceBLX(offset int32, find, replace uint32) error {
 	if int32(len(p.buf)) < p.cur+offset {
-		return errors.New("ReplaceBLX: offset past end of buf")
+		return p.newError("ReplaceBLX", p.cur+offset, nil, errors.New("offset past end of buf"))
 	}
 	fi, ri := AsmBLX(uint32(p.cur+offset), find), AsmBLX(uint32(p.cur+offset), replace)
 	f, r := mustBytes(toBEBin(fi)), mustBytes(toBEBin(ri))
 	if len(f) != len(r) {
-		return errors.New("ReplaceBLX: internal error: wrong blx length")
+		return p.newError("ReplaceBLX", p.cur+offset, nil, errors.New("internal error: wrong blx length"))
 	}
 	if !bytes.HasPrefix(p.buf[p.cur+offset:], f) {
-		return errors.New("ReplaceBLX: could not find bytes")
+		return p.newError("ReplaceBLX", p.cur+offset, f, errors.New("could not find bytes"))
 	}
 	if p.hook != nil {
 		if err := p.hook(p.cur+offset, f, r); err != nil {
-			return fmt.Errorf("hook returned error: %v", err)
+			return p.newError("ReplaceBLX", p.cur+offset, nil, fmt.Errorf("hook returned error: %w", err))
 		}
 	}
 	copy(p.buf[p.cur+offset:], r)
@@ -573,21 +606,21 @@ func (p *Patcher) ReplaceBLX(offset int32, find, replace uint32) error {
 // Deprecated: Generate the NOP externally and use ReplaceBytes instead.
 func (p *Patcher) ReplaceBytesNOP(offset int32, find []byte) error {
 	if int32(len(p.buf)) < offset {
-		return errors.New("ReplaceBytesNOP: offset past end of buf")
+		return p.newError("ReplaceBytesNOP", offset, nil, errors.New("offset past end of buf"))
 	}
 	if len(find)%2 != 0 {
-		return errors.New("ReplaceBytesNOP: find not a multiple of 2")
+		return p.newError("ReplaceBytesNOP", offset, nil, errors.New("find not a multiple of 2"))
 	}
 	r := make([]byte, len(find))
 	for i := 0; i < len(r); i += 2 {
 		r[i], r[i+1] = 0x00, 0x46
 	}
 	if !bytes.HasPrefix(p.buf[offset:], find) {
-		return errors.New("ReplaceBytesNOP: could not find bytes")
+		return p.newError("ReplaceBytesNOP", offset, find, errors.New("could not find bytes"))
 	}
 	if p.hook != nil {
 		if err := p.hook(offset, find, r); err != nil {
-			return fmt.Errorf("hook returned error: %v", err)
+			return p.newError("ReplaceBytesNOP", offset, nil, fmt.Errorf("hook returned error: %w", err))
 		}
 	}
 	copy(p.buf[offset:], r)
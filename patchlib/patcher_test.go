@@ -1,8 +1,10 @@
 package patchlib
 
 import (
+	"context"
 	"crypto/sha1"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"reflect"
@@ -263,6 +265,42 @@ func TestReal(t *testing.T) {
 
 // TODO: test symbol stuff?
 
+func TestSymError(t *testing.T) {
+	p := NewPatcher([]byte(`not an elf`))
+	for op, fn := range map[string]func(string) (int32, error){
+		"ResolveSym":        p.ResolveSym,
+		"ResolveSymPLT":     p.ResolveSymPLT,
+		"ResolveSymPLTTail": p.ResolveSymPLTTail,
+	} {
+		_, errr := fn("sym")
+		var pe *PatcherError
+		if !errors.As(errr, &pe) || pe.Op != op || pe.Offset != -1 {
+			t.Errorf("%s: expected a PatcherError, got %#v", op, errr)
+		}
+	}
+
+	_, errr := p.ExtractDynsyms(false)
+	var pe *PatcherError
+	if !errors.As(errr, &pe) || pe.Op != "ExtractDynsyms" {
+		t.Errorf("ExtractDynsyms: expected a PatcherError, got %#v", errr)
+	}
+}
+
+func TestContext(t *testing.T) {
+	p := NewPatcher([]byte(`this is a test`))
+	ctx, cancel := context.WithCancel(context.Background())
+	p.SetContext(ctx)
+
+	_, errr := p.ExtractZlib()
+	nerr(t, errr)
+
+	cancel()
+	_, errr = p.ExtractZlib()
+	eq(t, errr, context.Canceled, "ExtractZlib should return the context error")
+	_, errr = p.ExtractDynsyms(false)
+	eq(t, errr, context.Canceled, "ExtractDynsyms should return the context error")
+}
+
 func nerr(t *testing.T, err error) {
 	if err != nil {
 		debug.PrintStack()
@@ -0,0 +1,447 @@
+package patchlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf16"
+)
+
+// QM is a compiled Qt translation file. It is read and written the same way as
+// QTranslator and lrelease from Qt 5.
+type QM struct {
+	Language     string
+	Dependencies []string
+	NumerusRules []byte
+	Messages     []*QMMessage
+
+	// Compressed is true if message prefixes are shortened and a context hash
+	// table is included (lrelease -compress).
+	Compressed bool
+}
+
+// QMMessage is a translated message. The Comment is the disambiguation.
+type QMMessage struct {
+	Context      string
+	Source       string
+	Comment      string
+	Translations []string // one for each numerus form for plural messages (empty strings are untranslated)
+}
+
+var qmMagic = []byte{0x3C, 0xB8, 0x64, 0x18, 0xCA, 0xEF, 0x9C, 0x95, 0xCD, 0x21, 0x1C, 0xBF, 0x60, 0xA1, 0xBD, 0xDD}
+
+// Section tags.
+const (
+	qmContexts     = 0x2F
+	qmHashes       = 0x42
+	qmMessages     = 0x69
+	qmNumerusRules = 0x88
+	qmDependencies = 0x96
+	qmLanguage     = 0xA7
+)
+
+// Message tags.
+const (
+	qmTagEnd         = 1
+	qmTagTranslation = 3
+	qmTagObsolete1   = 5
+	qmTagSourceText  = 6
+	qmTagContext     = 7
+	qmTagComment     = 8
+)
+
+// How much of a message needs to be written to distinguish it from its
+// neighbours (only used when compressing).
+const (
+	qmPrefixNone = iota
+	qmPrefixHash
+	qmPrefixContext
+	qmPrefixSourceText
+	qmPrefixComment
+)
+
+// ReadQM parses a .qm file. Messages which were shortened by lrelease -compress
+// (which only happens when adjacent messages have the same hash) cannot be
+// read, since the source text is not stored.
+func ReadQM(buf []byte) (*QM, error) {
+	if !bytes.HasPrefix(buf, qmMagic) {
+		return nil, errors.New("not a qm file: bad magic")
+	}
+	q := &QM{}
+	r := &qmReader{buf: buf, off: len(qmMagic)}
+	for r.off < len(r.buf) {
+		tag, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.bytes()
+		if err != nil {
+			return nil, fmt.Errorf("section %#x: %w", tag, err)
+		}
+		s := &qmReader{buf: data}
+		switch tag {
+		case qmLanguage:
+			q.Language = string(data)
+		case qmDependencies:
+			for s.off < len(s.buf) {
+				dep, err := s.qstring()
+				if err != nil {
+					return nil, fmt.Errorf("dependencies: %w", err)
+				}
+				q.Dependencies = append(q.Dependencies, dep)
+			}
+		case qmNumerusRules:
+			q.NumerusRules = append([]byte(nil), data...)
+		case qmHashes:
+			// the messages are read sequentially instead
+		case qmContexts:
+			q.Compressed = true // the table is rebuilt when writing
+		case qmMessages:
+			for s.off < len(s.buf) {
+				m, err := s.message()
+				if err != nil {
+					return nil, fmt.Errorf("message %d: %w", len(q.Messages), err)
+				}
+				q.Messages = append(q.Messages, m)
+			}
+		default:
+			return nil, fmt.Errorf("unknown section %#x", tag)
+		}
+	}
+	return q, nil
+}
+
+// Find gets a message by its context, source text, and comment, or nil if it
+// doesn't exist.
+func (q *QM) Find(context, source, comment string) *QMMessage {
+	for _, m := range q.Messages {
+		if m.Context == context && m.Source == source && m.Comment == comment {
+			return m
+		}
+	}
+	return nil
+}
+
+// Set replaces the translations of a message, adding it if it doesn't exist.
+// It returns true if an existing message was replaced. Note that QTranslator
+// falls back to the message without a comment if a message with the requested
+// comment does not exist, and lrelease drops comments which are not needed to
+// disambiguate messages.
+func (q *QM) Set(context, source, comment string, translations ...string) bool {
+	if m := q.Find(context, source, comment); m != nil {
+		m.Translations = translations
+		return true
+	}
+	q.Messages = append(q.Messages, &QMMessage{context, source, comment, translations})
+	return false
+}
+
+// Bytes encodes the QM. The messages are sorted by context, source text, and
+// comment.
+func (q *QM) Bytes() []byte {
+	msgs := make([]*QMMessage, len(q.Messages))
+	copy(msgs, q.Messages)
+	sort.SliceStable(msgs, func(i, j int) bool {
+		a, b := msgs[i], msgs[j]
+		if a.Context != b.Context {
+			return a.Context < b.Context
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Comment < b.Comment
+	})
+
+	var deps bytes.Buffer
+	for _, dep := range q.Dependencies {
+		writeQString(&deps, dep)
+	}
+
+	var hashes, messages, contexts bytes.Buffer
+	if len(msgs) != 0 || q.Compressed {
+		type offset struct{ h, o uint32 }
+		offsets := make([]offset, len(msgs))
+		cpPrev, cpNext := qmPrefixNone, qmPrefixNone
+		for i, m := range msgs {
+			cpPrev, cpNext = cpNext, qmPrefixNone
+			if i+1 < len(msgs) {
+				cpNext = qmCommonPrefix(m, msgs[i+1])
+			}
+			prefix := qmPrefixComment
+			if q.Compressed {
+				prefix = max(cpPrev, cpNext+1)
+			}
+			offsets[i] = offset{qmHash(m), uint32(messages.Len())}
+			writeQMMessage(&messages, m, prefix)
+		}
+		sort.Slice(offsets, func(i, j int) bool {
+			if offsets[i].h != offsets[j].h {
+				return offsets[i].h < offsets[j].h
+			}
+			return offsets[i].o < offsets[j].o
+		})
+		for _, o := range offsets {
+			binary.Write(&hashes, binary.BigEndian, o.h)
+			binary.Write(&hashes, binary.BigEndian, o.o)
+		}
+		if q.Compressed {
+			writeQMContexts(&contexts, msgs)
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(qmMagic)
+	for _, s := range []struct {
+		tag  byte
+		data []byte
+	}{
+		{qmLanguage, []byte(q.Language)},
+		{qmDependencies, deps.Bytes()},
+		{qmHashes, hashes.Bytes()},
+		{qmMessages, messages.Bytes()},
+		{qmContexts, contexts.Bytes()},
+		{qmNumerusRules, q.NumerusRules},
+	} {
+		if len(s.data) != 0 {
+			buf.WriteByte(s.tag)
+			binary.Write(&buf, binary.BigEndian, uint32(len(s.data)))
+			buf.Write(s.data)
+		}
+	}
+	return buf.Bytes()
+}
+
+func qmCommonPrefix(a, b *QMMessage) int {
+	switch {
+	case qmHash(a) != qmHash(b):
+		return qmPrefixNone
+	case a.Context != b.Context:
+		return qmPrefixHash
+	case a.Source != b.Source:
+		return qmPrefixContext
+	case a.Comment != b.Comment:
+		return qmPrefixSourceText
+	default:
+		return qmPrefixComment
+	}
+}
+
+func writeQMMessage(w *bytes.Buffer, m *QMMessage, prefix int) {
+	for _, t := range m.Translations {
+		w.WriteByte(qmTagTranslation)
+		writeQString(w, t)
+	}
+	// like lrelease, anything less than the context is written in full
+	if prefix >= qmPrefixComment || prefix <= qmPrefixHash {
+		w.WriteByte(qmTagComment)
+		writeQByteArray(w, m.Comment)
+	}
+	if prefix >= qmPrefixSourceText || prefix <= qmPrefixHash {
+		w.WriteByte(qmTagSourceText)
+		writeQByteArray(w, m.Source)
+	}
+	w.WriteByte(qmTagContext)
+	writeQByteArray(w, m.Context)
+	w.WriteByte(qmTagEnd)
+}
+
+// writeQMContexts writes the hash table used by QTranslator to quickly check
+// if a context is present in compressed files. Within a bucket, contexts are in
+// reverse order like the QMultiMap used by lrelease. If there are too many
+// contexts, the table is left out (lrelease only warns about it).
+func writeQMContexts(w *bytes.Buffer, msgs []*QMMessage) {
+	var ctxs []string
+	seen := map[string]bool{}
+	for _, m := range msgs {
+		if !seen[m.Context] {
+			seen[m.Context] = true
+			ctxs = append(ctxs, m.Context)
+		}
+	}
+	sort.Strings(ctxs)
+
+	var size uint16
+	switch {
+	case len(ctxs) < 60:
+		size = 151
+	case len(ctxs) < 200:
+		size = 503
+	case len(ctxs) < 2500:
+		size = 3079
+	default:
+		size = 32719
+	}
+
+	buckets := map[uint32][]string{}
+	var hs []uint32
+	for _, c := range ctxs {
+		h := elfHash([]byte(c)) % uint32(size)
+		if _, ok := buckets[h]; !ok {
+			hs = append(hs, h)
+		}
+		buckets[h] = append([]string{c}, buckets[h]...)
+	}
+	sort.Slice(hs, func(i, j int) bool { return hs[i] < hs[j] })
+
+	table := make([]uint16, size)
+	pool := []byte{0, 0} // offset 0 cannot be used
+	for _, h := range hs {
+		table[h] = uint16(len(pool) >> 1)
+		for _, c := range buckets[h] {
+			if len(c) > 255 {
+				c = c[:255]
+			}
+			pool = append(pool, byte(len(c)))
+			pool = append(pool, c...)
+		}
+		if len(pool)&1 != 0 {
+			pool = append(pool, 0) // offsets must be even
+		}
+	}
+	if len(pool) > 131072 {
+		return
+	}
+
+	binary.Write(w, binary.BigEndian, size)
+	binary.Write(w, binary.BigEndian, table)
+	w.Write(pool)
+}
+
+func qmHash(m *QMMessage) uint32 {
+	return elfHash([]byte(m.Source + m.Comment))
+}
+
+// elfHash is the hash used by QTranslator.
+func elfHash(b []byte) uint32 {
+	var h uint32
+	for _, c := range b {
+		if c == 0 {
+			break
+		}
+		h = (h << 4) + uint32(c)
+		if g := h & 0xF0000000; g != 0 {
+			h ^= g >> 24
+			h &^= g
+		}
+	}
+	if h == 0 {
+		h = 1
+	}
+	return h
+}
+
+// writeQString writes s like a QDataStream (UTF-16BE with a byte length). Empty
+// strings are written as a null QString.
+func writeQString(w *bytes.Buffer, s string) {
+	if s == "" {
+		binary.Write(w, binary.BigEndian, uint32(0xFFFFFFFF))
+		return
+	}
+	u := utf16.Encode([]rune(s))
+	binary.Write(w, binary.BigEndian, uint32(len(u)*2))
+	binary.Write(w, binary.BigEndian, u)
+}
+
+// writeQByteArray writes s like a QDataStream writes a QByteArray.
+func writeQByteArray(w *bytes.Buffer, s string) {
+	binary.Write(w, binary.BigEndian, uint32(len(s)))
+	w.WriteString(s)
+}
+
+type qmReader struct {
+	buf []byte
+	off int
+}
+
+func (r *qmReader) byte() (byte, error) {
+	if r.off >= len(r.buf) {
+		return 0, fmt.Errorf("unexpected end of data at %#x", r.off)
+	}
+	r.off++
+	return r.buf[r.off-1], nil
+}
+
+func (r *qmReader) uint32() (uint32, error) {
+	if r.off+4 > len(r.buf) {
+		return 0, fmt.Errorf("unexpected end of data at %#x", r.off)
+	}
+	r.off += 4
+	return binary.BigEndian.Uint32(r.buf[r.off-4:]), nil
+}
+
+// bytes reads a length-prefixed byte array (a null QByteArray is returned as
+// an empty one).
+func (r *qmReader) bytes() ([]byte, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0xFFFFFFFF {
+		return nil, nil
+	}
+	if uint64(r.off)+uint64(n) > uint64(len(r.buf)) {
+		return nil, fmt.Errorf("length %d at %#x out of bounds", n, r.off-4)
+	}
+	r.off += int(n)
+	return r.buf[r.off-int(n) : r.off], nil
+}
+
+func (r *qmReader) qstring() (string, error) {
+	b, err := r.bytes()
+	if err != nil {
+		return "", err
+	}
+	if len(b)%2 != 0 {
+		return "", fmt.Errorf("odd string length %d at %#x", len(b), r.off-len(b)-4)
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(u)), nil
+}
+
+func (r *qmReader) message() (*QMMessage, error) {
+	m := &QMMessage{}
+	var hasContext, hasSource, hasComment bool
+	for {
+		tag, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case qmTagEnd:
+			if !hasContext || !hasSource || !hasComment {
+				return nil, errors.New("message was shortened by lrelease -compress")
+			}
+			return m, nil
+		case qmTagTranslation:
+			t, err := r.qstring()
+			if err != nil {
+				return nil, fmt.Errorf("translation: %w", err)
+			}
+			m.Translations = append(m.Translations, t)
+		case qmTagObsolete1:
+			if _, err := r.uint32(); err != nil {
+				return nil, err
+			}
+		case qmTagSourceText, qmTagContext, qmTagComment:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			switch tag {
+			case qmTagSourceText:
+				m.Source, hasSource = string(b), true
+			case qmTagContext:
+				m.Context, hasContext = string(b), true
+			case qmTagComment:
+				m.Comment, hasComment = string(b), true
+			}
+		default:
+			return nil, fmt.Errorf("unsupported tag %#x at %#x", tag, r.off-1)
+		}
+	}
+}
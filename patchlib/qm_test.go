@@ -0,0 +1,128 @@
+package patchlib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestQM(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		q := &QM{
+			Language:     "ru_RU",
+			Dependencies: []string{"qtbase_ru"},
+			NumerusRules: []byte{0x11, 0x01},
+			Messages: []*QMMessage{
+				{"Dialog", "Open", "", []string{"Открыть"}},
+				{"Dialog", "%n book(s)", "", []string{"%n книга", "", "%n книг"}},
+				{"", "No context", "disambiguation", []string{"Без контекста"}},
+				{"Other", "Emoji", "", []string{"\U0001F600"}},
+			},
+			Compressed: compressed,
+		}
+
+		buf := q.Bytes()
+		r, err := ReadQM(buf)
+		if err != nil {
+			t.Fatalf("compressed=%t: unexpected error: %v", compressed, err)
+		}
+		if r.Language != q.Language || !reflect.DeepEqual(r.Dependencies, q.Dependencies) || !bytes.Equal(r.NumerusRules, q.NumerusRules) || r.Compressed != compressed {
+			t.Errorf("compressed=%t: unexpected header %+v", compressed, r)
+		}
+		if len(r.Messages) != len(q.Messages) {
+			t.Fatalf("compressed=%t: expected %d messages, got %d", compressed, len(q.Messages), len(r.Messages))
+		}
+		for _, m := range q.Messages {
+			if rm := r.Find(m.Context, m.Source, m.Comment); rm == nil || !reflect.DeepEqual(rm, m) {
+				t.Errorf("compressed=%t: expected %+v, got %+v", compressed, m, rm)
+			}
+		}
+		if !bytes.Equal(r.Bytes(), buf) {
+			t.Errorf("compressed=%t: expected output to be identical after reading it", compressed)
+		}
+	}
+}
+
+func TestQMBytes(t *testing.T) {
+	q := &QM{
+		Language:     "de",
+		NumerusRules: []byte{0x01, 0x01},
+		Messages: []*QMMessage{
+			{"C", "a", "", []string{"b"}},
+		},
+	}
+	exp := "" +
+		"3cb86418caef9c95cd211cbf60a1bddd" + // magic
+		"a7" + "00000002" + "6465" + // language
+		"42" + "00000008" + "00000061" + "00000000" + // hashes
+		"69" + "00000019" + "03" + "00000002" + "0062" + "08" + "00000000" + "06" + "00000001" + "61" + "07" + "00000001" + "43" + "01" + // messages
+		"88" + "00000002" + "0101" // numerus rules
+	if act := hex.EncodeToString(q.Bytes()); act != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, act)
+	}
+}
+
+func TestQMSet(t *testing.T) {
+	q := &QM{Messages: []*QMMessage{
+		{"B", "a", "", []string{"1"}},
+		{"A", "a", "x", []string{"2"}},
+	}}
+	if !q.Set("B", "a", "", "3") {
+		t.Errorf("expected existing message to be replaced")
+	}
+	if q.Set("A", "a", "", "4") {
+		t.Errorf("expected message with a different comment to be added")
+	}
+	r, err := ReadQM(q.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := []*QMMessage{
+		{"A", "a", "", []string{"4"}},
+		{"A", "a", "x", []string{"2"}},
+		{"B", "a", "", []string{"3"}},
+	}
+	if !reflect.DeepEqual(r.Messages, exp) {
+		t.Errorf("expected sorted messages %+v, got %+v", exp, r.Messages)
+	}
+}
+
+func TestReadQMErrors(t *testing.T) {
+	magic := "3cb86418caef9c95cd211cbf60a1bddd"
+	for _, tc := range []struct {
+		what string
+		qm   string
+	}{
+		{"Empty", ""},
+		{"BadMagic", "3cb86418caef9c95cd211cbf60a1bdde"},
+		{"TruncatedSection", magic + "a7" + "00000005" + "6465"},
+		{"UnknownSection", magic + "01" + "00000000"},
+		{"UnterminatedMessage", magic + "69" + "00000005" + "07" + "00000000"},
+		{"UnknownTag", magic + "69" + "00000001" + "02"},
+		{"OddString", magic + "69" + "00000006" + "03" + "00000001" + "00"},
+		{"Shortened", magic + "69" + "00000006" + "07" + "00000000" + "01"},
+	} {
+		buf, _ := hex.DecodeString(tc.qm)
+		if _, err := ReadQM(buf); err == nil {
+			t.Errorf("%s: expected error", tc.what)
+		}
+	}
+}
+
+func TestElfHash(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		out uint32
+	}{
+		{"", 1},
+		{"a", 0x61},
+		{"ab", 0x672},
+		{"a\x00b", 0x61},
+		{"abcdefghi", 0x9ABAA69},
+	} {
+		if h := elfHash([]byte(tc.in)); h != tc.out {
+			t.Errorf("%q: expected %#x, got %#x", tc.in, tc.out, h)
+		}
+	}
+}
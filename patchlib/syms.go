@@ -1,6 +1,7 @@
 package patchlib
 
 import (
+	"context"
 	"debug/elf"
 	"encoding/binary"
 	"fmt"
@@ -28,7 +29,7 @@ type dynsym struct {
 	Demangled string // optional
 }
 
-func decdynsym(e *elf.File, skipPLTGOT bool) ([]*dynsym, error) {
+func decdynsym(ctx context.Context, e *elf.File, skipPLTGOT bool) ([]*dynsym, error) {
 	if e.Class != elf.ELFCLASS32 && e.Machine != elf.EM_ARM {
 		return nil, fmt.Errorf("not a 32-bit arm elf")
 	}
@@ -41,6 +42,11 @@ func decdynsym(e *elf.File, skipPLTGOT bool) ([]*dynsym, error) {
 		return nil, fmt.Errorf("get dynamic symbols: %w", err)
 	}
 	for i, edynsym := range edynsyms {
+		if i%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
 		if edynsym.Name == "" {
 			// discard unnamed symbols (usually just _init, etc stuff)
 			continue
@@ -72,7 +78,7 @@ func decdynsym(e *elf.File, skipPLTGOT bool) ([]*dynsym, error) {
 	for _, pltrel := range pltrels {
 		pltrelidx[elf.R_SYM32(pltrel.Info)] = pltrel
 	}
-	pltents, err := decplt(e)
+	pltents, err := decplt(ctx, e)
 	if err != nil {
 		return nil, fmt.Errorf("decode plt: %w", err)
 	}
@@ -151,7 +157,7 @@ type pltent struct {
 	GOTOffset     uint32
 }
 
-func decplt(e *elf.File) ([]pltent, error) {
+func decplt(ctx context.Context, e *elf.File) ([]pltent, error) {
 	if e.Class != elf.ELFCLASS32 && e.Machine != elf.EM_ARM {
 		return nil, fmt.Errorf("not a 32-bit arm elf")
 	}
@@ -174,6 +180,9 @@ func decplt(e *elf.File) ([]pltent, error) {
 	var pltents []pltent
 	pc := uint32(plt.Offset)
 	for len(buf) != 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		if len(asmbufi) != len(asmbufo) {
 			panic("len(asmbufi) != len(asmbufo)")
 		}
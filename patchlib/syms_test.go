@@ -1,6 +1,7 @@
 package patchlib
 
 import (
+	"context"
 	"debug/elf"
 	"os"
 	"testing"
@@ -19,7 +20,7 @@ func TestSyms(t *testing.T) {
 	}
 	defer e.Close()
 
-	dynsyms, err := decdynsym(e, false)
+	dynsyms, err := decdynsym(context.Background(), e, false)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -30,7 +31,7 @@ func TestSyms(t *testing.T) {
 			break
 		}
 	}
-	if _, err := decdynsym(e, true); err != nil {
+	if _, err := decdynsym(context.Background(), e, true); err != nil {
 		t.Errorf("unexpected error decoding elf with corrupt plt with pltgot skipped: %v", err)
 	}
 
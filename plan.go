@@ -0,0 +1,128 @@
+package kobopatch
+
+import (
+	"errors"
+
+	"github.com/pgaskin/kobopatch/patchfile"
+)
+
+// Plan describes what will be written to the output KoboRoot.tgz. It is
+// filled in while the patches, translations, files and symlinks are applied.
+type Plan struct {
+	Targets      []*PlanTarget
+	Translations []*PlanFile
+	Files        []*PlanFile
+	Symlinks     []*PlanSymlink
+
+	// Size is the size of the uncompressed output tar, and CompressedSize is
+	// the size of the resulting KoboRoot.tgz.
+	Size           int64
+	CompressedSize int64
+}
+
+// PlanTarget is a firmware file which will be patched.
+type PlanTarget struct {
+	Name         string
+	Size         int64
+	PatchFiles   []*PlanPatchFile
+	Translations []*PlanTranslation
+}
+
+// PlanPatchFile is a patch file which will be applied to a PlanTarget.
+type PlanPatchFile struct {
+	Filename string
+	Format   string
+	Enabled  []string
+}
+
+// PlanTranslation is a message which will be replaced or added in a
+// PlanTarget (which is a qm file).
+type PlanTranslation struct {
+	Context string
+	Source  string
+	Comment string
+}
+
+// PlanFile is a file which will be added to the output.
+type PlanFile struct {
+	Source string
+	Dest   string
+	Size   int64
+}
+
+// PlanSymlink is a symlink or hard link which will be added to the output.
+type PlanSymlink struct {
+	Target   string
+	Dest     string
+	Hardlink bool
+}
+
+// enabledPatches returns the names of the enabled patches in ps.
+func enabledPatches(ps patchfile.PatchSet) ([]string, error) {
+	in, ok := ps.(patchfile.Inspector)
+	if !ok {
+		return nil, errors.New("patch format does not support listing patches")
+	}
+	enabled := []string{}
+	for _, p := range in.Patches() {
+		if p.Enabled {
+			enabled = append(enabled, p.Name)
+		}
+	}
+	return enabled, nil
+}
+
+// WritePlan finalizes the output (which must have been initialized with
+// PlanInit) and returns the plan.
+func (k *KoboPatch) WritePlan() (*Plan, error) {
+	k.d("\n\nKoboPatch::WritePlan")
+
+	k.d("Finalizing output and checking consistency (expected size %d)", k.outTarExpectedSize)
+	if err := k.out.Close(k.outTarExpectedSize); err != nil {
+		k.d("--> %v", err)
+		return nil, wrap(err, "could not finalize output tar.gz")
+	}
+	k.plan.Size, k.plan.CompressedSize = k.out.Size()
+
+	k.dp("  | ", "%s", jm(k.plan))
+	return k.plan, nil
+}
+
+// PrintPlan displays the plan to the user.
+func (k *KoboPatch) PrintPlan(p *Plan) {
+	if p == nil {
+		k.e("no plan")
+		return
+	}
+
+	k.l("\nPlan:")
+	for _, t := range p.Targets {
+		k.l("  PATCH  %s (%d bytes)", t.Name, t.Size)
+		for _, pf := range t.PatchFiles {
+			k.l("    %s (%s)", pf.Filename, pf.Format)
+			if len(pf.Enabled) == 0 {
+				k.l("      (no patches enabled)")
+			}
+			for _, name := range pf.Enabled {
+				k.l("      ENABLED  `%s`", name)
+			}
+		}
+		for _, tr := range t.Translations {
+			k.l("    TRANSLATE  `%s` `%s`", tr.Context, tr.Source)
+		}
+	}
+	for _, f := range p.Translations {
+		k.l("  LRELEASE  %-35s  TO  %s (%d bytes)", f.Source, f.Dest, f.Size)
+	}
+	for _, f := range p.Files {
+		k.l("  ADD  %-35s  TO  %s (%d bytes)", f.Source, f.Dest, f.Size)
+	}
+	for _, s := range p.Symlinks {
+		if s.Hardlink {
+			k.l("  HARDLINK %-35s  TO  %s", s.Target, s.Dest)
+		} else {
+			k.l("  SYMLINK  %-35s  TO  %s", s.Target, s.Dest)
+		}
+	}
+	k.l("\nOutput: %d bytes (%d bytes compressed)", p.Size, p.CompressedSize)
+}
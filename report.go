@@ -0,0 +1,244 @@
+package kobopatch
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pgaskin/kobopatch/patchfile"
+)
+
+// TestReport is the result of running the patch tests.
+type TestReport struct {
+	Version  string        `json:"version"`  // the firmware version tested (from the config if it couldn't be detected)
+	Firmware string        `json:"firmware"` // the firmware file which was tested
+	Files    []*TestFile   `json:"files"`
+	Time     time.Duration `json:"-"`
+}
+
+// TestFile is the result of testing the patches in a patch file.
+type TestFile struct {
+	Filename string        `json:"filename"`
+	Target   string        `json:"target"`
+	Patches  []*TestPatch  `json:"patches"`
+	Time     time.Duration `json:"-"`
+}
+
+// TestPatch is the result of testing a single patch, or a combination of
+// patches for test modes other than TestIndividual.
+type TestPatch struct {
+	Name        string        `json:"name"`
+	Mode        string        `json:"mode"`
+	Enabled     []string      `json:"enabled,omitempty"`   // the patches which were enabled, for combinations
+	Conflicts   []string      `json:"conflicts,omitempty"` // the patches which work individually but fail together, if any
+	Error       error         `json:"-"`
+	Line        int           `json:"line,omitempty"`        // the line of the failing instruction, if known
+	Instruction int           `json:"instruction,omitempty"` // the index of the failing instruction, if known
+	Time        time.Duration `json:"-"`
+}
+
+// Failed returns the number of failed patches.
+func (r *TestReport) Failed() int {
+	var n int
+	for _, f := range r.Files {
+		n += f.Failed()
+	}
+	return n
+}
+
+// Failed returns the number of failed patches.
+func (f *TestFile) Failed() int {
+	var n int
+	for _, p := range f.Patches {
+		if p.Error != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// setError sets the error for a patch, and the line and instruction index if
+// it is a patchfile.PatchError.
+func (p *TestPatch) setError(err error) {
+	p.Error = err
+	var pe *patchfile.PatchError
+	if errors.As(err, &pe) {
+		p.Line, p.Instruction = pe.Line, pe.Instruction
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r *TestReport) MarshalJSON() ([]byte, error) {
+	type report TestReport
+	return json.Marshal(struct {
+		*report
+		Tests  int     `json:"tests"`
+		Failed int     `json:"failed"`
+		Time   float64 `json:"time"`
+	}{(*report)(r), len(r.tests()), r.Failed(), r.Time.Seconds()})
+}
+
+// MarshalJSON implements json.Marshaler.
+func (f *TestFile) MarshalJSON() ([]byte, error) {
+	type file TestFile
+	return json.Marshal(struct {
+		*file
+		Time float64 `json:"time"`
+	}{(*file)(f), f.Time.Seconds()})
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p *TestPatch) MarshalJSON() ([]byte, error) {
+	type patch TestPatch
+	var e string
+	if p.Error != nil {
+		e = p.Error.Error()
+	}
+	return json.Marshal(struct {
+		*patch
+		Passed bool    `json:"passed"`
+		Error  string  `json:"error,omitempty"`
+		Time   float64 `json:"time"`
+	}{(*patch)(p), p.Error == nil, e, p.Time.Seconds()})
+}
+
+func (r *TestReport) tests() []*TestPatch {
+	ps := []*TestPatch{}
+	for _, f := range r.Files {
+		ps = append(ps, f.Patches...)
+	}
+	return ps
+}
+
+// WriteJSON writes the report as JSON.
+func (r *TestReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(r)
+}
+
+// WriteJUnit writes the report as JUnit XML, with a test suite for each patch
+// file and a test case for each patch.
+func (r *TestReport) WriteJUnit(w io.Writer) error {
+	type property struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	}
+	type failure struct {
+		Message string `xml:"message,attr"`
+		Text    string `xml:",chardata"`
+	}
+	type testcase struct {
+		Name      string   `xml:"name,attr"`
+		Classname string   `xml:"classname,attr"`
+		Time      string   `xml:"time,attr"`
+		Failure   *failure `xml:"failure,omitempty"`
+	}
+	type testsuite struct {
+		Name       string     `xml:"name,attr"`
+		Tests      int        `xml:"tests,attr"`
+		Failures   int        `xml:"failures,attr"`
+		Time       string     `xml:"time,attr"`
+		Properties []property `xml:"properties>property"`
+		Testcases  []testcase `xml:"testcase"`
+	}
+	type testsuites struct {
+		XMLName    xml.Name    `xml:"testsuites"`
+		Name       string      `xml:"name,attr"`
+		Tests      int         `xml:"tests,attr"`
+		Failures   int         `xml:"failures,attr"`
+		Time       string      `xml:"time,attr"`
+		Testsuites []testsuite `xml:"testsuite"`
+	}
+
+	secs := func(d time.Duration) string {
+		return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+	}
+
+	x := testsuites{
+		Name:     "kobopatch " + r.Version,
+		Tests:    len(r.tests()),
+		Failures: r.Failed(),
+		Time:     secs(r.Time),
+	}
+	for _, f := range r.Files {
+		s := testsuite{
+			Name:     f.Filename,
+			Tests:    len(f.Patches),
+			Failures: f.Failed(),
+			Time:     secs(f.Time),
+			Properties: []property{
+				{"version", r.Version},
+				{"firmware", r.Firmware},
+				{"target", f.Target},
+			},
+		}
+		for _, p := range f.Patches {
+			name := p.Name
+			if p.Mode != TestIndividual {
+				name = "[" + p.Mode + "] " + name
+			}
+			c := testcase{
+				Name:      name,
+				Classname: f.Filename,
+				Time:      secs(p.Time),
+			}
+			if p.Error != nil {
+				c.Failure = &failure{Message: p.Error.Error(), Text: p.Error.Error()}
+				if p.Line != 0 {
+					c.Failure.Text = fmt.Sprintf("%s:%d (instruction %d): %v", f.Filename, p.Line, p.Instruction, p.Error)
+				}
+				if len(p.Conflicts) != 0 {
+					c.Failure.Text += fmt.Sprintf("\nconflict between `%s`", strings.Join(p.Conflicts, "`, `"))
+				}
+			}
+			s.Testcases = append(s.Testcases, c)
+		}
+		x.Testsuites = append(x.Testsuites, s)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "    ")
+	if err := enc.Encode(x); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// WriteReport writes a test report to a file in the specified format (json or
+// junit).
+func (k *KoboPatch) WriteReport(r *TestReport, format, filename string) error {
+	k.d("\n\nKoboPatch::WriteReport(%#v, %#v)", format, filename)
+
+	var write func(io.Writer) error
+	switch format {
+	case "json":
+		write = r.WriteJSON
+	case "junit":
+		write = r.WriteJUnit
+	default:
+		return fmt.Errorf("unknown report format %#v", format)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		k.d("--> %v", err)
+		return wrap(err, "could not create report file")
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		k.d("--> %v", err)
+		return wrap(err, "could not write report")
+	}
+	return f.Close()
+}
@@ -0,0 +1,101 @@
+package kobopatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pgaskin/kobopatch/patchfile"
+)
+
+func testReport() *TestReport {
+	fail := &TestPatch{Name: "Fail", Mode: TestIndividual, Time: time.Millisecond}
+	fail.setError(fmt.Errorf("could not apply %w", &patchfile.PatchError{Patch: "Fail", Line: 12, Instruction: 3, Err: errors.New("FindReplaceString: could not find bytes")}))
+	conflict := &TestPatch{Name: "default patches", Mode: TestDefaults, Enabled: []string{"A", "B", "Pass"}, Conflicts: []string{"A", "B"}, Time: time.Millisecond}
+	conflict.setError(fmt.Errorf("could not apply %w", &patchfile.PatchError{Patch: "B", Line: 5, Instruction: 1, Err: errors.New("FindReplaceString: could not find bytes")}))
+	return &TestReport{
+		Version:  "4.20.14622",
+		Firmware: "kobo-update-4.20.14622.zip",
+		Files: []*TestFile{{
+			Filename: "src/libnickel.so.1.0.0.yaml",
+			Target:   "./usr/local/Kobo/libnickel.so.1.0.0",
+			Patches:  []*TestPatch{{Name: "Pass", Mode: TestIndividual, Time: time.Millisecond}, fail, conflict},
+			Time:     time.Millisecond * 2,
+		}},
+		Time: time.Millisecond * 3,
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testReport().WriteJSON(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var r struct {
+		Version string
+		Tests   int
+		Failed  int
+		Files   []struct {
+			Patches []struct {
+				Name        string
+				Mode        string
+				Conflicts   []string
+				Passed      bool
+				Error       string
+				Line        int
+				Instruction int
+				Time        float64
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Version != "4.20.14622" || r.Tests != 3 || r.Failed != 2 || len(r.Files) != 1 || len(r.Files[0].Patches) != 3 {
+		t.Fatalf("unexpected report: %s", buf.String())
+	}
+	if p := r.Files[0].Patches[0]; !p.Passed || p.Error != "" || p.Time != 0.001 {
+		t.Errorf("unexpected result for passing patch: %+v", p)
+	}
+	if p := r.Files[0].Patches[1]; p.Passed || p.Error == "" || p.Line != 12 || p.Instruction != 3 {
+		t.Errorf("unexpected result for failing patch: %+v", p)
+	}
+	if p := r.Files[0].Patches[2]; p.Passed || p.Mode != TestDefaults || len(p.Conflicts) != 2 {
+		t.Errorf("unexpected result for conflicting patches: %+v", p)
+	}
+}
+
+func TestReportJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testReport().WriteJUnit(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var r struct {
+		Tests     int `xml:"tests,attr"`
+		Failures  int `xml:"failures,attr"`
+		Testsuite []struct {
+			Name     string `xml:"name,attr"`
+			Testcase []struct {
+				Name    string `xml:"name,attr"`
+				Failure *struct {
+					Message string `xml:"message,attr"`
+				} `xml:"failure"`
+			} `xml:"testcase"`
+		} `xml:"testsuite"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Tests != 3 || r.Failures != 2 || len(r.Testsuite) != 1 || len(r.Testsuite[0].Testcase) != 3 {
+		t.Fatalf("unexpected report: %s", buf.String())
+	}
+	if c := r.Testsuite[0].Testcase; c[0].Failure != nil || c[1].Failure == nil || c[1].Name != "Fail" || c[2].Name != "[defaults] default patches" {
+		t.Errorf("unexpected test cases: %s", buf.String())
+	}
+}
@@ -25,7 +25,7 @@ func main() {
 	input := pflag.StringP("input", "i", "", "the file to patch (required)")
 	patchFile := pflag.StringP("patch-file", "p", "", "the file containing the patches (required)")
 	output := pflag.StringP("output", "o", "", "the file to write the patched output to (will be overwritten if exists) (required)")
-	patchFormat := pflag.StringP("patch-format", "f", "kobopatch", fmt.Sprintf("the patch format (one of: %s)", strings.Join(patchfile.GetFormats(), ",")))
+	patchFormat := pflag.StringP("patch-format", "f", "", fmt.Sprintf("the patch format (one of: %s) (detected if not specified)", strings.Join(patchfile.GetFormats(), ",")))
 	verbose := pflag.BoolP("verbose", "v", false, "show verbose output from patchlib")
 	help := pflag.BoolP("help", "h", false, "show this help text")
 	pflag.Parse()
@@ -41,7 +41,7 @@ func main() {
 		errexit("Error: input, patch-file, and output flags are required. See --help for more info.\n")
 	}
 
-	if !sliceContains(patchfile.GetFormats(), *patchFormat) {
+	if *patchFormat != "" && !sliceContains(patchfile.GetFormats(), *patchFormat) {
 		errexit("Error: invalid format %s. See --help for more info.\n", *patchFormat)
 	}
 
@@ -70,7 +70,7 @@ func main() {
 
 	pt := patchlib.NewPatcher(buf)
 
-	err = ps.ApplyTo(pt)
+	err = ps.ApplyTo(pt, patchfile.Printer(os.Stdout))
 	if err != nil {
 		errexit("Error: could not apply patch file: %v\n", err)
 	}